@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +21,7 @@ import (
 	"github.com/rs/cors"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc"
 )
 
 // load env variables
@@ -52,23 +55,177 @@ func main() {
 	// Auth Module
 	as := service.NewAuthService()
 
+	// Rate Limiting (per route and user, or client IP for anonymous requests)
+	routeLimits, err := transport.ParseRouteLimits(envString("RATE_LIMIT_ROUTES", "POST /message=10/1m, PATCH /message/{id}=30/1m, POST /message/{id}/report=10/1m, POST /message/{id}/vote=30/1m, PUT /message/{id}/repost=30/1m, POST /attachment=20/1m, POST /user/me/drafts=20/1m, POST /batch=30/1m"))
+	if err != nil {
+		log.Fatal("RATE_LIMIT_ROUTES: ", err)
+	}
+	defaultLimit, err := service.ParseRateLimit(envString("RATE_LIMIT_DEFAULT", "300/1m"))
+	if err != nil {
+		log.Fatal("RATE_LIMIT_DEFAULT: ", err)
+	}
+	// the number of reverse proxies, "true" for a single one
+	trustedProxies := envInt("RATE_LIMIT_TRUST_PROXY", 0)
+	if os.Getenv("RATE_LIMIT_TRUST_PROXY") == "true" {
+		trustedProxies = 1
+	}
+	rl := transport.NewRateLimiter(service.NewMemoryRateLimitStore(), as, defaultLimit, routeLimits, trustedProxies)
+	router.Use(rl.Middleware)
+
+	// Response Cache (disabled, if RESPONSE_CACHE_SIZE isn't set)
+	rc := transport.NewResponseCache(envInt("RESPONSE_CACHE_SIZE", 0), time.Duration(envInt("RESPONSE_CACHE_TTL", 60))*time.Second)
+
+	// Blob Storage (uploads in a local directory or an S3 compatible bucket)
+	blobs := blobStore()
+
+	// Image Module (processed images like custom avatars)
+	is := service.NewImageService(blobs, envInt("IMAGE_MAX_PIXELS", 40000000))
+	it := transport.NewImageController(is)
+
 	// User Module
 	ur := persistence.NewUserPersistor(db.Collection("user"))
-	us := service.NewUserService(ur)
-	ut := transport.NewUserController(us, as)
-	ut.RegisterRoutes(router)
+	us := service.NewUserService(ur, is)
+	ut := transport.NewUserController(us, as, int64(envInt("AVATAR_MAX_SIZE", 5<<20)))
 
 	// Message Module
 	mr := persistence.NewMessagePersistor(db.Collection("message"))
-	ms := service.NewMessageService(mr)
-	mt := transport.NewMessageController(ms, as)
-	mt.RegisterRoutes(router)
+	ensureIndexes("message", mr.EnsureIndexes)
+	rr := persistence.NewRelationPersistor(db.Collection("relation"))
+	ensureIndexes("relation", rr.EnsureIndexes)
+	ap := persistence.NewAttachmentPersistor(db.Collection("attachment"), db.Collection("message"), db.Collection("draft"))
+	ms := service.NewMessageService(mr, contentPolicy(mr, ur, rr), rr, ap)
+	ms.Subscribe(func(e service.MessageEvent) { rc.Invalidate("message") })
+	// embedded authors (expand=author) change, when profiles are synced on sign in
+	us.Subscribe(func(e service.UserEvent) { rc.Invalidate("message") })
+	us.Subscribe(func(e service.UserEvent) { rc.Invalidate("user") })
+	pnp := persistence.NewPinPersistor(db.Collection("pin"))
+	ensureIndexes("pin", pnp.EnsureIndexes)
+	ps := service.NewPinService(pnp, ms)
+	ms.Subscribe(ps.OnMessageEvent)
+	mt := transport.NewMessageController(ms, us, ps, as, rc)
+
+	// Pin Module (announcements and profile pins)
+	pt := transport.NewPinController(ps, as, rc)
+
+	// Poll Module (votes and live tallies)
+	plt := transport.NewPollController(ms, as)
+	ms.Subscribe(plt.OnMessageEvent)
+
+	// Repost Module (quotes are created like other messages)
+	rpt := transport.NewRepostController(ms, as)
+
+	// Bookmark Module (private bookmarks and collections)
+	bmp := persistence.NewBookmarkPersistor(db.Collection("bookmark"))
+	ensureIndexes("bookmark", bmp.EnsureIndexes)
+	bs := service.NewBookmarkService(bmp, ms)
+	ms.Subscribe(bs.OnMessageEvent)
+	bmt := transport.NewBookmarkController(bs, as)
+
+	// Attachment Module
+	maxAttachmentSize := int64(envInt("ATTACHMENT_MAX_SIZE", 10<<20))
+	ats := service.NewAttachmentService(ap, blobs, ms, maxAttachmentSize,
+		strings.Split(envString("ATTACHMENT_TYPES", "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain"), ","))
+	ms.Subscribe(ats.OnMessageEvent)
+	att := transport.NewAttachmentController(ats, as, maxAttachmentSize)
+	go ats.Run(context.Background())
+
+	// Draft Module (drafts and scheduled messages)
+	scheduleInterval, err := time.ParseDuration(envString("SCHEDULE_INTERVAL", "15s"))
+
+	if err != nil || scheduleInterval <= 0 {
+		log.Fatal("SCHEDULE_INTERVAL: invalid duration ", envString("SCHEDULE_INTERVAL", "15s"))
+	}
+
+	ds := service.NewDraftService(persistence.NewDraftPersistor(db.Collection("draft")), ms, scheduleInterval)
+	dft := transport.NewDraftController(ds, as)
+	go ds.Run(context.Background())
+
+	// Link Preview Module (Open Graph metadata of links in messages)
+	previewTTL, err := time.ParseDuration(envString("LINK_PREVIEW_TTL", "24h"))
+
+	if err != nil || previewTTL <= 0 {
+		log.Fatal("LINK_PREVIEW_TTL: invalid duration ", envString("LINK_PREVIEW_TTL", "24h"))
+	}
+
+	if maxLinks := envInt("LINK_PREVIEW_MAX_LINKS", 3); maxLinks > 0 {
+		uns := service.NewUnfurlService(persistence.NewPreviewPersistor(db.Collection("preview")), ms, previewTTL, maxLinks)
+		ms.Subscribe(uns.OnMessageEvent)
+		go uns.Run(context.Background())
+	}
+
+	// Relation Module (blocked and muted users)
+	rs := service.NewRelationService(rr, us)
+	rt := transport.NewRelationController(rs, as)
+
+	// Moderation Module (reports and review of messages held by the content policy)
+	rp := persistence.NewReportPersistor(db.Collection("report"), db.Collection("audit"))
+	mos := service.NewModerationService(rp, ms, us, envInt("REPORT_AUTO_HIDE_THRESHOLD", 5))
+	mot := transport.NewModerationController(ms, mos, as)
+
+	// Federation Module (ActivityPub)
+	fp := persistence.NewFederationPersistor(db.Collection("actorkey"), db.Collection("follower"), db.Collection("like"))
+	fs := service.NewFederationService(fp, us, ms, service.NewPublicClient(10*time.Second))
+	ms.Subscribe(fs.OnMessageEvent)
+	at := transport.NewActivityPubController(fs)
+	at.RegisterRoutes(router)
+
+	// Profile Module
+	prs := service.NewProfileService(us, mr, fp)
+	prt := transport.NewProfileController(prs, as, rc, int64(envInt("BANNER_MAX_SIZE", 10<<20)))
+	// profiles count the posts of their user
+	ms.Subscribe(func(e service.MessageEvent) {
+		if e.Type == service.EventMessageCreated || e.Type == service.EventMessageDeleted {
+			rc.Invalidate("user")
+		}
+	})
+
+	// Webhook Module
+	wp := persistence.NewWebhookPersistor(db.Collection("webhook"), db.Collection("delivery"))
+	ws := service.NewWebhookService(wp, &http.Client{Timeout: 10 * time.Second})
+	ms.Subscribe(ws.OnMessageEvent)
+	us.Subscribe(ws.OnUserEvent)
+	wt := transport.NewWebhookController(ws, as)
+	go ws.Run(context.Background())
+
+	// Feed Module (RSS, Atom & JSON Feed)
+	ft := transport.NewFeedController(ms, us, rc)
+
+	// GraphQL Module
+	gt := transport.NewGraphQLController(ms, us, as, rl)
+	gt.RegisterRoutes(router)
+
+	// gRPC Module (separate port)
+	grpcServer := transport.NewGRPCController(ms, us, as, rl).NewServer()
+	go serveGRPC(grpcServer)
+
+	// Versioned REST API, the unversioned paths are aliases for v1 (for v2
+	// after the sunset of v1)
+	api := []transport.RouteRegistrar{ut, prt, it, mt, pt, plt, rpt, bmt, att, dft, rt, mot, wt, ft}
+	v1 := transport.APIVersion{Name: "v1", Successor: "v2", Deprecation: envDate("API_V1_DEPRECATION"), Sunset: envDate("API_V1_SUNSET")}
+	v2 := transport.APIVersion{Name: "v2"}
+	v1.Mount(router, "/v1", api...)
+	v2.Mount(router, "/v2", api...)
+	v1.Mount(router, "", api...)
+
+	// Batch Module (sub-requests are dispatched through the router)
+	batchConcurrency := envInt("BATCH_CONCURRENCY", 4)
+	if batchConcurrency < 1 {
+		log.Fatal("BATCH_CONCURRENCY: must be at least 1")
+	}
+
+	bt := transport.NewBatchController(persistence.NewTransactor(db.Client()), envInt("BATCH_MAX_REQUESTS", 20), batchConcurrency)
+	bt.RegisterRoutes(router)
+
+	// API Docs (OpenAPI)
+	dt := transport.NewDocsController()
+	dt.RegisterRoutes(router)
 
 	// Enable CORs
 	handler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedHeaders: []string{"Authorization", "Content-Type", "Origin"},
-		AllowedMethods: []string{"POST", "GET", "DELETE", "PATCH", "OPTIONS"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Origin", "If-Match", "If-None-Match", "If-Modified-Since"},
+		AllowedMethods: []string{"POST", "GET", "PUT", "DELETE", "PATCH", "OPTIONS"},
+		ExposedHeaders: []string{"ETag", "Last-Modified", "API-Version", "Deprecation", "Sunset", "Link", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After"},
 	}).Handler(router)
 
 	// Configure server
@@ -97,6 +254,137 @@ func routerMw(next http.Handler) http.Handler {
 	})
 }
 
+func serveGRPC(server *grpc.Server) {
+	lis, err := net.Listen("tcp", os.ExpandEnv("${host}:")+strconv.Itoa(envInt("GRPC_PORT", 3001)))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(server.Serve(lis))
+}
+
+// contentPolicy builds the rules new and updated messages have to pass.
+// Every rule is configured with a limit and an action (reject, hold or shadow-hide).
+func contentPolicy(mr *persistence.MessagePersistor, ur *persistence.UserPersistor, rr *persistence.RelationPersistor) *service.ContentPolicy {
+	rules := []service.PolicyRule{
+		service.NewSuspensionRule(ur),
+		service.NewBlockRule(rr, mr),
+		service.MaxLengthRule{Max: envInt("POLICY_MAX_LENGTH", 1000), Action: envAction("POLICY_MAX_LENGTH_ACTION", service.ActionReject)},
+		service.LinkLimitRule{Max: envInt("POLICY_MAX_LINKS", 5), Action: envAction("POLICY_MAX_LINKS_ACTION", service.ActionHold)},
+	}
+
+	words := strings.Split(os.Getenv("POLICY_BANNED_WORDS"), ",")
+
+	if file := os.Getenv("POLICY_BANNED_WORDS_FILE"); file != "" {
+		content, err := os.ReadFile(file)
+
+		if err != nil {
+			log.Fatal("POLICY_BANNED_WORDS_FILE: ", err)
+		}
+
+		words = append(words, strings.Split(string(content), "\n")...)
+	}
+
+	rules = append(rules, service.NewBannedWordsRule(words, envAction("POLICY_BANNED_WORDS_ACTION", service.ActionHold)))
+
+	window, err := time.ParseDuration(envString("POLICY_DUPLICATE_WINDOW", "10m"))
+
+	if err != nil {
+		log.Fatal("POLICY_DUPLICATE_WINDOW: ", err)
+	}
+
+	if window > 0 {
+		rules = append(rules, service.NewDuplicateRule(mr, window, envAction("POLICY_DUPLICATE_ACTION", service.ActionReject)))
+	}
+
+	return service.NewContentPolicy(rules...)
+}
+
+// blobStore creates the store for uploads configured by BLOB_STORE (local or s3)
+func blobStore() service.BlobStore {
+	switch store := envString("BLOB_STORE", "local"); store {
+	case "local":
+		return service.NewLocalBlobStore(envString("BLOB_DIR", "data/blobs"))
+	case "s3":
+		s3, err := service.NewS3BlobStore(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET"), envString("S3_REGION", "us-east-1"),
+			os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), &http.Client{Timeout: 5 * time.Minute})
+
+		if err != nil {
+			log.Fatal("S3_ENDPOINT: ", err)
+		}
+
+		return s3
+	default:
+		log.Fatalf("BLOB_STORE: unknown store %q, expected local or s3", store)
+		return nil
+	}
+}
+
+// envAction reads the action of a content policy rule
+func envAction(key string, def string) string {
+	action, err := service.ParseAction(envString(key, def))
+
+	if err != nil {
+		log.Fatal(key, ": ", err)
+	}
+
+	return action
+}
+
+// envDate reads a date (2006-01-02) env variable, it's zero if the variable isn't set
+func envDate(key string) time.Time {
+	v := os.Getenv(key)
+
+	if v == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse("2006-01-02", v)
+
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+
+	return t
+}
+
+// envString reads an env variable, falling back to def if it isn't set
+func envString(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer env variable, falling back to def if it isn't set
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// ensureIndexes creates the indexes of a collection, the app doesn't start
+// without them. Unique indexes can't be created while there are duplicates,
+// which are left to the admins: the app starts anyway and retries on the next
+// start, the writes check for existing documents themselves.
+func ensureIndexes(collection string, create func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := create(ctx)
+
+	if mongo.IsDuplicateKeyError(err) {
+		log.Printf("%s: couldn't create unique indexes, remove the duplicates and restart: %v", collection, err)
+		return
+	}
+
+	if err != nil {
+		log.Fatalf("%s: couldn't create indexes: %v", collection, err)
+	}
+}
+
 func conntectToDB() *mongo.Database {
 
 	clientOptions := options.Client().ApplyURI(os.Getenv("MONGO_URI"))
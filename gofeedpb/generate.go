@@ -0,0 +1,4 @@
+// Package gofeedpb contains the protobuf messages and gRPC services of GoFeed.
+package gofeedpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gofeed.proto
@@ -0,0 +1,179 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AttachmentPersistor stores the metadata of uploaded files, the files
+// themselves are kept in a blob store.
+type AttachmentPersistor struct {
+	c *mongo.Collection
+
+	// messages is joined to find attachments of deleted messages, drafts to
+	// keep the attachments of drafts
+	messages *mongo.Collection
+	drafts   *mongo.Collection
+}
+
+// Attachment is an uploaded file. Messages embed the attachments they
+// reference, owner and message are only stored in the attachment collection.
+type Attachment struct {
+	AttachmentID primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	OwnerID      primitive.ObjectID  `json:"-" bson:"ownerId,omitempty"`
+	MessageID    *primitive.ObjectID `json:"-" bson:"messageId,omitempty"`
+	Name         string              `json:"name,omitempty" bson:"name"`
+	ContentType  string              `json:"contentType,omitempty" bson:"contentType"`
+	Size         int64               `json:"size,omitempty" bson:"size"`
+	Created      int64               `json:"-" bson:"created,omitempty"`
+}
+
+var ErrInvalidAttachment = errors.New("attachment doesn't exist or is already in use")
+
+func NewAttachmentPersistor(c *mongo.Collection, messages *mongo.Collection, drafts *mongo.Collection) *AttachmentPersistor {
+	return &AttachmentPersistor{c, messages, drafts}
+}
+
+func (p *AttachmentPersistor) Create(ctx context.Context, attachment Attachment) (*Attachment, error) {
+	res, err := p.c.InsertOne(ctx, attachment)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		attachment.AttachmentID = oid
+		return &attachment, nil
+	}
+
+	return nil, ErrInsertError
+}
+
+func (p *AttachmentPersistor) FindById(ctx context.Context, id string) (*Attachment, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	res := p.c.FindOne(ctx, bson.M{"_id": oid})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var attachment Attachment
+	err = res.Decode(&attachment)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment, nil
+}
+
+// FindUnattached returns the attachments of owner, which aren't used by a
+// message yet. Unknown ids are skipped.
+func (p *AttachmentPersistor) FindUnattached(ctx context.Context, owner primitive.ObjectID, ids []primitive.ObjectID) (*[]Attachment, error) {
+	cursor, err := p.c.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "ownerId": owner, "messageId": nil})
+
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []Attachment{}
+	err = cursor.All(ctx, &attachments)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachments, nil
+}
+
+// Attach marks unattached attachments as used by message. It returns
+// ErrInvalidAttachment, if one of them has been attached in the meantime.
+func (p *AttachmentPersistor) Attach(ctx context.Context, ids []primitive.ObjectID, message primitive.ObjectID) error {
+	res, err := p.c.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "messageId": nil},
+		bson.M{"$set": bson.M{"messageId": message}})
+
+	if err != nil {
+		return err
+	}
+
+	if res.ModifiedCount != int64(len(ids)) {
+		return ErrInvalidAttachment
+	}
+
+	return nil
+}
+
+// FindOrphans returns attachments, which are no longer needed: attachments
+// used by neither a message nor a draft, which have been uploaded before
+// unattachedBefore, and the attachments of deleted messages.
+func (p *AttachmentPersistor) FindOrphans(ctx context.Context, unattachedBefore int64, limit int64) (*[]Attachment, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from":         p.messages.Name(),
+			"localField":   "messageId",
+			"foreignField": "_id",
+			"as":           "message",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         p.drafts.Name(),
+			"localField":   "_id",
+			"foreignField": "attachments._id",
+			"as":           "drafts",
+		}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"messageId": nil, "drafts": bson.M{"$size": 0}, "created": bson.M{"$lt": unattachedBefore}},
+			bson.M{"messageId": bson.M{"$ne": nil}, "message": bson.M{"$size": 0}},
+		}}}},
+		{{Key: "$project", Value: bson.M{"message": 0, "drafts": 0}}},
+		{{Key: "$limit", Value: limit}},
+	}
+
+	cursor, err := p.c.Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []Attachment{}
+	err = cursor.All(ctx, &attachments)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachments, nil
+}
+
+// FindByMessage returns the attachments used by a message.
+func (p *AttachmentPersistor) FindByMessage(ctx context.Context, message primitive.ObjectID) (*[]Attachment, error) {
+	cursor, err := p.c.Find(ctx, bson.M{"messageId": message}, options.Find())
+
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []Attachment{}
+	err = cursor.All(ctx, &attachments)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachments, nil
+}
+
+func (p *AttachmentPersistor) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := p.c.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
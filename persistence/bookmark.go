@@ -0,0 +1,156 @@
+package persistence
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BookmarkPersistor stores the messages users have saved for later. Bookmarks
+// are private, a user only ever sees their own.
+type BookmarkPersistor struct {
+	c *mongo.Collection
+}
+
+type Bookmark struct {
+	BookmarkID primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `json:"-" bson:"userId"`
+	MessageID  primitive.ObjectID `json:"messageId" bson:"messageId"`
+	Collection string             `json:"collection,omitempty" bson:"collection,omitempty"`
+	Created    int64              `json:"created" bson:"created"`
+
+	// Message is nil, if the message isn't available to the user anymore
+	Message *Message `json:"message" bson:"-"`
+}
+
+// BookmarkCollection is a named collection of bookmarks
+type BookmarkCollection struct {
+	Name  string `json:"name" bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+func NewBookmarkPersistor(c *mongo.Collection) *BookmarkPersistor {
+	return &BookmarkPersistor{c}
+}
+
+// EnsureIndexes creates the unique index, which allows a single bookmark of
+// a message per user.
+func (p *BookmarkPersistor) EnsureIndexes(ctx context.Context) error {
+	_, err := p.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "messageId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	return err
+}
+
+// Put bookmarks a message. Bookmarking a message again only moves it to
+// another collection ("" for none), it keeps its place in the bookmarks.
+func (p *BookmarkPersistor) Put(ctx context.Context, bookmark Bookmark) (*Bookmark, error) {
+	update := bson.M{"$setOnInsert": bson.M{"created": bookmark.Created}}
+
+	if bookmark.Collection == "" {
+		update["$unset"] = bson.M{"collection": nil}
+	} else {
+		update["$set"] = bson.M{"collection": bookmark.Collection}
+	}
+
+	filter := bson.M{"userId": bookmark.UserID, "messageId": bookmark.MessageID}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	res := p.c.FindOneAndUpdate(ctx, filter, update, opts)
+
+	// inserted by a concurrent request, now it's updated
+	if mongo.IsDuplicateKeyError(res.Err()) {
+		res = p.c.FindOneAndUpdate(ctx, filter, update, opts)
+	}
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var put Bookmark
+	err := res.Decode(&put)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &put, nil
+}
+
+func (p *BookmarkPersistor) Remove(ctx context.Context, user primitive.ObjectID, message primitive.ObjectID) error {
+	res, err := p.c.DeleteOne(ctx, bson.M{"userId": user, "messageId": message})
+
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNothingDeleted
+	}
+
+	return nil
+}
+
+// FindByUser returns up to limit bookmarks of user, the newest first. A nil
+// collection returns the bookmarks of every collection. Pages are continued
+// after the bookmark with the id after (nil for the first page).
+func (p *BookmarkPersistor) FindByUser(ctx context.Context, user primitive.ObjectID, collection *string, after *primitive.ObjectID, limit int64) (*[]Bookmark, error) {
+	filter := bson.M{"userId": user}
+
+	if collection != nil && *collection == "" {
+		filter["collection"] = bson.M{"$exists": false}
+	} else if collection != nil {
+		filter["collection"] = *collection
+	}
+
+	if after != nil {
+		filter["_id"] = bson.M{"$lt": *after}
+	}
+
+	cursor, err := p.c.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit))
+
+	if err != nil {
+		return nil, err
+	}
+
+	bookmarks := []Bookmark{}
+	err = cursor.All(ctx, &bookmarks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &bookmarks, nil
+}
+
+// Collections returns the named collections of user with their number of bookmarks.
+func (p *BookmarkPersistor) Collections(ctx context.Context, user primitive.ObjectID) (*[]BookmarkCollection, error) {
+	cursor, err := p.c.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": user, "collection": bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$collection", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	collections := []BookmarkCollection{}
+	err = cursor.All(ctx, &collections)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &collections, nil
+}
+
+// DeleteByMessage removes every bookmark of a message.
+func (p *BookmarkPersistor) DeleteByMessage(ctx context.Context, message primitive.ObjectID) error {
+	_, err := p.c.DeleteMany(ctx, bson.M{"messageId": message})
+	return err
+}
@@ -0,0 +1,282 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DraftPersistor stores drafts and scheduled messages. Scheduled drafts are
+// published by whichever instance holds their lease.
+type DraftPersistor struct {
+	c *mongo.Collection
+}
+
+// Draft is a message, which hasn't been published yet. It is scheduled, if
+// PublishAt is set.
+type Draft struct {
+	DraftID     primitive.ObjectID  `json:"id,omitempty" bson:"_id,omitempty"`
+	AuthorID    primitive.ObjectID  `json:"authorId" bson:"authorId"`
+	Content     string              `json:"content" bson:"content" validate:"required,gt=0"`
+	ReplyTo     *primitive.ObjectID `json:"replyTo,omitempty" bson:"replyTo,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty" bson:"attachments,omitempty"`
+	PublishAt   *int64              `json:"publishAt,omitempty" bson:"publishAt,omitempty"`
+	Created     int64               `json:"created" bson:"created"`
+	Updated     int64               `json:"updated" bson:"updated"`
+	Version     int64               `json:"version" bson:"version"`
+
+	// Error tells why the draft couldn't be published, it isn't scheduled anymore then
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+
+	// MessageID is reserved for the message before it is published, so a
+	// publication interrupted by a crash isn't repeated
+	MessageID  *primitive.ObjectID `json:"-" bson:"messageId,omitempty"`
+	LeaseOwner string              `json:"-" bson:"leaseOwner,omitempty"`
+	LeaseUntil int64               `json:"-" bson:"leaseUntil,omitempty"`
+}
+
+var (
+	ErrMissingDraftContent = errors.New("Dein Entwurf ist leer!")
+	ErrDraftLocked         = errors.New("draft is being published")
+)
+
+func NewDraftPersistor(c *mongo.Collection) *DraftPersistor {
+	return &DraftPersistor{c}
+}
+
+func (p *DraftPersistor) Create(ctx context.Context, draft Draft) (*Draft, error) {
+	err := validate.Struct(draft)
+	if err != nil {
+		return nil, ErrMissingDraftContent
+	}
+
+	res, err := p.c.InsertOne(ctx, draft)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		draft.DraftID = oid
+		return &draft, nil
+	}
+
+	return nil, ErrInsertError
+}
+
+// FindById returns a draft of author.
+func (p *DraftPersistor) FindById(ctx context.Context, id string, author primitive.ObjectID) (*Draft, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	res := p.c.FindOne(ctx, bson.M{"_id": oid, "authorId": author})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var draft Draft
+	err = res.Decode(&draft)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &draft, nil
+}
+
+// FindByAuthor lists the drafts of author. Scheduled drafts come first, in
+// the order they are published, followed by the most recently edited drafts.
+// If scheduled isn't nil, only scheduled drafts or only unscheduled ones are
+// returned.
+func (p *DraftPersistor) FindByAuthor(ctx context.Context, author primitive.ObjectID, scheduled *bool, limit int64, skip int64) (*[]Draft, error) {
+	filter := bson.M{"authorId": author}
+
+	if scheduled != nil {
+		filter["publishAt"] = bson.M{"$exists": *scheduled}
+	}
+
+	// null sorts before numbers, the descending order of the negated time
+	// lists the scheduled drafts first, the next one at the top
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$addFields", Value: bson.M{"order": bson.M{"$multiply": bson.A{"$publishAt", -1}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "order", Value: -1}, {Key: "updated", Value: -1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.M{"order": 0}}},
+	}
+
+	cursor, err := p.c.Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	drafts := []Draft{}
+	err = cursor.All(ctx, &drafts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &drafts, nil
+}
+
+// Update changes a draft of author, unless it is being published
+// (ErrDraftLocked). Fields set to nil in unset are removed.
+func (p *DraftPersistor) Update(ctx context.Context, id string, author primitive.ObjectID, set bson.M, unset bson.M, now int64) (*Draft, error) {
+	filter, err := unlockedDraftFilter(id, author, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	res := p.c.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, p.explainLocked(ctx, filter)
+	}
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var draft Draft
+	err = res.Decode(&draft)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &draft, nil
+}
+
+// Delete removes a draft of author, unless it is being published (ErrDraftLocked).
+func (p *DraftPersistor) Delete(ctx context.Context, id string, author primitive.ObjectID, now int64) error {
+	filter, err := unlockedDraftFilter(id, author, now)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := p.c.DeleteOne(ctx, filter)
+
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return p.explainLocked(ctx, filter)
+	}
+
+	return nil
+}
+
+// Claim acquires the lease of a scheduled draft, which is due or, if filter
+// is given, of the draft matching filter. The lease keeps other instances
+// from publishing the draft until it expires. ErrNoDocuments is returned if
+// there is nothing to claim.
+func (p *DraftPersistor) Claim(ctx context.Context, filter bson.M, owner string, now int64, until int64) (*Draft, error) {
+	if filter == nil {
+		filter = bson.M{"publishAt": bson.M{"$lte": now}}
+	}
+
+	filter = bson.M{"$and": bson.A{filter, leaseExpired(now)}}
+
+	res := p.c.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"leaseOwner": owner, "leaseUntil": until}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "publishAt", Value: 1}}).SetReturnDocument(options.After))
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var draft Draft
+	err := res.Decode(&draft)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &draft, nil
+}
+
+// ReserveMessageID stores the id of the message a claimed draft is published
+// as. It fails with ErrDraftLocked, if owner has lost the lease.
+func (p *DraftPersistor) ReserveMessageID(ctx context.Context, id primitive.ObjectID, owner string, message primitive.ObjectID) error {
+	res, err := p.c.UpdateOne(ctx,
+		bson.M{"_id": id, "leaseOwner": owner, "messageId": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"messageId": message}})
+
+	if err != nil {
+		return err
+	}
+
+	if res.ModifiedCount == 0 {
+		return ErrDraftLocked
+	}
+
+	return nil
+}
+
+// Complete removes a published draft.
+func (p *DraftPersistor) Complete(ctx context.Context, id primitive.ObjectID, owner string) error {
+	_, err := p.c.DeleteOne(ctx, bson.M{"_id": id, "leaseOwner": owner})
+	return err
+}
+
+// Fail releases the lease of a draft, which can't be published, and turns it
+// back into an unscheduled draft with the reason.
+func (p *DraftPersistor) Fail(ctx context.Context, id primitive.ObjectID, owner string, reason string) error {
+	_, err := p.c.UpdateOne(ctx,
+		bson.M{"_id": id, "leaseOwner": owner},
+		bson.M{
+			"$set":   bson.M{"error": reason},
+			"$unset": bson.M{"publishAt": nil, "leaseOwner": nil, "leaseUntil": nil, "messageId": nil},
+			"$inc":   bson.M{"version": 1},
+		})
+
+	return err
+}
+
+func unlockedDraftFilter(id string, author primitive.ObjectID, now int64) (bson.M, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	return bson.M{"$and": bson.A{bson.M{"_id": oid, "authorId": author}, leaseExpired(now)}}, nil
+}
+
+func leaseExpired(now int64) bson.M {
+	return bson.M{"$or": bson.A{bson.M{"leaseUntil": bson.M{"$exists": false}}, bson.M{"leaseUntil": bson.M{"$lt": now}}}}
+}
+
+// explainLocked tells a missing draft (ErrNoDocuments) from a locked one
+func (p *DraftPersistor) explainLocked(ctx context.Context, filter bson.M) error {
+	n, err := p.c.CountDocuments(ctx, filter["$and"].(bson.A)[0])
+
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return ErrDraftLocked
+	}
+
+	return mongo.ErrNoDocuments
+}
@@ -0,0 +1,134 @@
+package persistence
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FederationPersistor stores everything needed to federate users via ActivityPub:
+// signing keys of local actors, remote followers and likes of remote actors.
+type FederationPersistor struct {
+	keys      *mongo.Collection
+	followers *mongo.Collection
+	likes     *mongo.Collection
+}
+
+// ActorKey is the RSA key pair used to sign requests on behalf of a user.
+type ActorKey struct {
+	UserID     primitive.ObjectID `json:"id" bson:"_id"`
+	PublicKey  string             `json:"publicKey" bson:"publicKey"`
+	PrivateKey string             `json:"-" bson:"privateKey"`
+}
+
+// Follower is a remote actor following a local user.
+type Follower struct {
+	UserID      primitive.ObjectID `json:"userId" bson:"userId"`
+	Actor       string             `json:"actor" bson:"actor"`
+	Inbox       string             `json:"inbox" bson:"inbox"`
+	SharedInbox string             `json:"sharedInbox,omitempty" bson:"sharedInbox,omitempty"`
+	Created     int64              `json:"created" bson:"created"`
+}
+
+// Like is a like of a message by a remote actor.
+type Like struct {
+	ActivityID string             `json:"id" bson:"_id"`
+	MessageID  primitive.ObjectID `json:"messageId" bson:"messageId"`
+	Actor      string             `json:"actor" bson:"actor"`
+	Created    int64              `json:"created" bson:"created"`
+}
+
+func NewFederationPersistor(keys *mongo.Collection, followers *mongo.Collection, likes *mongo.Collection) *FederationPersistor {
+	return &FederationPersistor{keys, followers, likes}
+}
+
+func (p *FederationPersistor) FindKey(ctx context.Context, user primitive.ObjectID) (*ActorKey, error) {
+	res := p.keys.FindOne(ctx, bson.M{"_id": user})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var key ActorKey
+	err := res.Decode(&key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// CreateKey stores key, unless the user already has one. The stored key is returned.
+func (p *FederationPersistor) CreateKey(ctx context.Context, key ActorKey) (*ActorKey, error) {
+	_, err := p.keys.InsertOne(ctx, key)
+
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	return p.FindKey(ctx, key.UserID)
+}
+
+// AddFollower stores a follower, an existing follow of the same actor is replaced.
+func (p *FederationPersistor) AddFollower(ctx context.Context, follower Follower) error {
+	_, err := p.followers.ReplaceOne(ctx, bson.M{"userId": follower.UserID, "actor": follower.Actor}, follower, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (p *FederationPersistor) RemoveFollower(ctx context.Context, user primitive.ObjectID, actor string) error {
+	_, err := p.followers.DeleteOne(ctx, bson.M{"userId": user, "actor": actor})
+	return err
+}
+
+func (p *FederationPersistor) FindFollowers(ctx context.Context, user primitive.ObjectID) (*[]Follower, error) {
+	cursor, err := p.followers.Find(ctx, bson.M{"userId": user})
+
+	if err != nil {
+		return nil, err
+	}
+
+	followers := []Follower{}
+	err = cursor.All(ctx, &followers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &followers, nil
+}
+
+func (p *FederationPersistor) CountFollowers(ctx context.Context, user primitive.ObjectID) (int64, error) {
+	return p.followers.CountDocuments(ctx, bson.M{"userId": user})
+}
+
+// AddLike stores a like, liking the same message twice is ignored.
+func (p *FederationPersistor) AddLike(ctx context.Context, like Like) error {
+	_, err := p.likes.UpdateOne(ctx, bson.M{"messageId": like.MessageID, "actor": like.Actor}, bson.M{"$setOnInsert": like}, options.Update().SetUpsert(true))
+	return err
+}
+
+// RemoveLike removes the like with the given activity id or, if the id is
+// unknown, the like of actor on message.
+func (p *FederationPersistor) RemoveLike(ctx context.Context, activityID string, actor string, message primitive.ObjectID) error {
+	res, err := p.likes.DeleteOne(ctx, bson.M{"_id": activityID, "actor": actor})
+
+	if err != nil || res.DeletedCount > 0 || message.IsZero() {
+		return err
+	}
+
+	_, err = p.likes.DeleteOne(ctx, bson.M{"messageId": message, "actor": actor})
+	return err
+}
+
+func (p *FederationPersistor) CountLikes(ctx context.Context, message primitive.ObjectID) (int64, error) {
+	return p.likes.CountDocuments(ctx, bson.M{"messageId": message})
+}
+
+func (p *FederationPersistor) DeleteLikes(ctx context.Context, message primitive.ObjectID) error {
+	_, err := p.likes.DeleteMany(ctx, bson.M{"messageId": message})
+	return err
+}
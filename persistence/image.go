@@ -0,0 +1,18 @@
+package persistence
+
+// Image is a processed image uploaded by a user, e.g. an avatar. Only the
+// variants are stored, the original (including its metadata) is dropped.
+type Image struct {
+	ImageID  string         `json:"id" bson:"id"`
+	Width    int            `json:"width" bson:"width"`
+	Height   int            `json:"height" bson:"height"`
+	Blurhash string         `json:"blurhash" bson:"blurhash"`
+	Variants []ImageVariant `json:"variants" bson:"variants"`
+}
+
+// ImageVariant is a resized version of an image, stored as File (e.g. 96.jpg).
+type ImageVariant struct {
+	Width  int    `json:"width" bson:"width"`
+	Height int    `json:"height" bson:"height"`
+	File   string `json:"file" bson:"file"`
+}
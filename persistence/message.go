@@ -17,18 +17,51 @@ type MessagePersistor struct {
 }
 
 type Message struct {
-	MessageID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty" gofeed:"remUpdate,remInsert"`
-	AuthorID  primitive.ObjectID `json:"authorId,omitempty" bson:"authorId,omitempty" gofeed:"remUpdate"`
-	Created   int64              `json:"created,omitempty" bson:"created,omitempty" gofeed:"remUpdate"`
-	Updated   int64              `json:"updated,omitempty" bson:"updated,omitempty"`
-	Content   string             `json:"content,omitempty" bson:"content,omitempty" validate:"required,gt=0"`
+	MessageID   primitive.ObjectID  `json:"id,omitempty" bson:"_id,omitempty" gofeed:"remUpdate,remInsert"`
+	AuthorID    primitive.ObjectID  `json:"authorId,omitempty" bson:"authorId,omitempty" gofeed:"remUpdate"`
+	Created     int64               `json:"created,omitempty" bson:"created,omitempty" gofeed:"remUpdate"`
+	Updated     int64               `json:"updated,omitempty" bson:"updated,omitempty"`
+	Content     string              `json:"content,omitempty" bson:"content,omitempty" validate:"required,gt=0"`
+	ContentHTML string              `json:"contentHtml,omitempty" bson:"contentHtml,omitempty"`
+	Tags        []string            `json:"tags,omitempty" bson:"tags,omitempty"`
+	Version     int64               `json:"version" bson:"version" gofeed:"remUpdate"`
+	ReplyTo     *primitive.ObjectID `json:"replyTo,omitempty" bson:"replyTo,omitempty" gofeed:"remUpdate"`
+	Attachments []Attachment        `json:"attachments,omitempty" bson:"attachments,omitempty" gofeed:"remUpdate"`
+	Previews    []LinkPreview       `json:"previews,omitempty" bson:"previews,omitempty" gofeed:"remUpdate"`
+	Poll        *Poll               `json:"poll,omitempty" bson:"poll,omitempty" gofeed:"remUpdate"`
+
+	// A repost has no content of its own, a quote embeds the quoted message
+	RepostOf *primitive.ObjectID `json:"repostOf,omitempty" bson:"repostOf,omitempty" gofeed:"remUpdate"`
+	QuoteOf  *primitive.ObjectID `json:"quoteOf,omitempty" bson:"quoteOf,omitempty" gofeed:"remUpdate"`
+	Reposts  int64               `json:"reposts" bson:"reposts" gofeed:"remUpdate"`
+
+	// Original is the reposted or quoted message as the reader sees it, it
+	// isn't stored. OriginalUnavailable tells why it's missing.
+	Original            *Message `json:"original,omitempty" bson:"-" gofeed:"remUpdate,remInsert"`
+	OriginalUnavailable string   `json:"originalUnavailable,omitempty" bson:"-" gofeed:"remUpdate,remInsert"`
+
+	// Pinned marks pinned messages ahead of a timeline, it isn't stored
+	Pinned bool `json:"pinned,omitempty" bson:"-" gofeed:"remUpdate,remInsert"`
+
+	// Status is empty for published messages, see MessageHeld etc.
+	Status       string `json:"status,omitempty" bson:"status" gofeed:"remUpdate"`
+	PolicyReason string `json:"policyReason,omitempty" bson:"policyReason" gofeed:"remUpdate"`
 }
 
+// Messages, which aren't published, are only visible to their author and admins
+const (
+	MessageHeld     = "held"     // waiting for review
+	MessageHidden   = "hidden"   // shadow-hidden, the author isn't told
+	MessageRejected = "rejected" // rejected by a moderator
+)
+
 var (
 	ErrInsertError     = errors.New("something ubiquitous happened")
 	ErrInvalidObjectID = errors.New("invalid ObjectID")
 	ErrNothingDeleted  = errors.New("nothing has been deleted")
 	ErrMissingContent  = errors.New("Dein Beitrag ist zu kurz!")
+	ErrNotAuthor       = errors.New("not the author of this message")
+	ErrVersionMismatch = errors.New("message has been modified in the meantime")
 	validate           = validator.New()
 )
 
@@ -59,31 +92,90 @@ func (p *MessagePersistor) FindById(ctx context.Context, id string) (*Message, e
 	return &message, nil
 }
 
-func (p *MessagePersistor) UpdateById(ctx context.Context, id string, update Message) (*Message, error) {
+// UpdateById updates the message with the given id, if it has been written by
+// author. If versions is not empty, the message is only updated if its current
+// version is one of them. Author check, version check and update are performed
+// as a single compare-and-set operation; the version is incremented on success.
+//
+// The status of update (set by the content policy) only escalates: it's
+// written if the message is published, a held, hidden or rejected message
+// keeps its status. The updated message is returned with its previous status.
+func (p *MessagePersistor) UpdateById(ctx context.Context, id string, author string, versions []int64, update Message) (*Message, string, error) {
 
-	oid, err := primitive.ObjectIDFromHex(id)
+	filter, err := ownedMessageFilter(id, author, versions)
 
 	if err != nil {
-		return nil, ErrInvalidObjectID
+		return nil, "", err
 	}
 
+	filter["repostOf"] = nil
+
 	// validate struct (validation defined in message/types.go (validate:"..."))
 	// for additional information, check out: https://github.com/go-playground/validator
 	err = validate.Struct(update)
 	if err != nil {
-		return nil, ErrMissingContent
+		return nil, "", ErrMissingContent
+	}
+
+	// the update is a pipeline, values are literals so content like
+	// "$version" isn't read as a field path. Messages created before
+	// versioning was introduced have no version field.
+	set := bson.M{"version": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}}}
+	for field, value := range *helper.CleanUpdateBody(update) {
+		set[field] = bson.M{"$literal": value}
+	}
+
+	if update.Status == "" {
+		message, err := p.updateOne(ctx, filter, set)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		return message, message.Status, nil
+	}
+
+	// a published message gets the status, others keep theirs. The status is
+	// part of the filter, so the previous one is known from the attempt, which
+	// matched.
+	published := bson.A{nil, ""}
+
+	escalated := bson.M{"status": bson.M{"$literal": update.Status}, "policyReason": bson.M{"$literal": update.PolicyReason}}
+	for field, value := range set {
+		escalated[field] = value
+	}
+
+	message, err := p.updateOne(ctx, withFilter(filter, "status", bson.M{"$in": published}), escalated)
+
+	if err != ErrVersionMismatch {
+		return message, "", err
+	}
+
+	message, err = p.updateOne(ctx, withFilter(filter, "status", bson.M{"$nin": published}), set)
+
+	if err != nil {
+		return nil, "", err
 	}
 
-	updateClaned := helper.CleanUpdateBody(update)
+	return message, message.Status, nil
+}
+
+// updateOne applies the pipeline stage $set to the message matching filter
+// and returns the updated message. If none matches, the reason is returned,
+// see explainMismatch.
+func (p *MessagePersistor) updateOne(ctx context.Context, filter bson.M, set bson.M) (*Message, error) {
+	res := p.c.FindOneAndUpdate(ctx, filter, bson.A{bson.M{"$set": set}}, options.FindOneAndUpdate().SetReturnDocument(options.After))
 
-	res := p.c.FindOneAndUpdate(ctx, bson.M{"_id": oid}, bson.M{"$set": updateClaned}, options.FindOneAndUpdate().SetReturnDocument(options.After))
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, p.explainMismatch(ctx, filter)
+	}
 
 	if res.Err() != nil {
 		return nil, res.Err()
 	}
 
 	var message Message
-	err = res.Decode(&message)
+	err := res.Decode(&message)
 
 	if err != nil {
 		return nil, err
@@ -92,6 +184,16 @@ func (p *MessagePersistor) UpdateById(ctx context.Context, id string, update Mes
 	return &message, nil
 }
 
+// withFilter returns a copy of filter, which also requires field to match value
+func withFilter(filter bson.M, field string, value interface{}) bson.M {
+	copied := bson.M{field: value}
+	for k, v := range filter {
+		copied[k] = v
+	}
+
+	return copied
+}
+
 func (p *MessagePersistor) Create(ctx context.Context, create Message) (*Message, error) {
 	// validate struct (validation defined in message/types.go (validate:"..."))
 	// for additional information, check out: https://github.com/go-playground/validator
@@ -102,6 +204,11 @@ func (p *MessagePersistor) Create(ctx context.Context, create Message) (*Message
 
 	createCleaned := helper.CleanCreateBody(create)
 
+	// the id of scheduled messages is reserved in advance
+	if !create.MessageID.IsZero() {
+		(*createCleaned)["_id"] = create.MessageID
+	}
+
 	res, err := p.c.InsertOne(ctx, createCleaned)
 
 	if err != nil {
@@ -144,40 +251,182 @@ func (p *MessagePersistor) Find(ctx context.Context, filter bson.M, options *opt
 	return &messages, nil
 }
 
-func (p *MessagePersistor) Delete(ctx context.Context, id string) (bool, error) {
+// Delete removes the message with the given id, if it has been written by
+// author and (if versions is not empty) its current version is one of them.
+// The deleted message is returned.
+func (p *MessagePersistor) Delete(ctx context.Context, id string, author string, versions []int64) (*Message, error) {
+	filter, err := ownedMessageFilter(id, author, versions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := p.c.FindOneAndDelete(ctx, filter)
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, p.explainMismatch(ctx, filter)
+	}
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var message Message
+	err = res.Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// CountByAuthor counts the published messages of a user, reposts aren't
+// counted.
+func (p *MessagePersistor) CountByAuthor(ctx context.Context, author primitive.ObjectID) (int64, error) {
+	return p.c.CountDocuments(ctx, bson.M{"authorId": author, "repostOf": nil, "status": bson.M{"$in": bson.A{nil, ""}}})
+}
+
+// SetStatus changes the status of a message regardless of its author and
+// returns the message as it was before. The reason replaces the one given by
+// the content policy.
+func (p *MessagePersistor) SetStatus(ctx context.Context, id string, status string, reason string) (*Message, error) {
+	return p.setStatus(ctx, id, bson.M{}, status, reason)
+}
+
+// Unhide publishes a message, if it has been hidden for reason. Otherwise
+// mongo.ErrNoDocuments is returned.
+func (p *MessagePersistor) Unhide(ctx context.Context, id string, reason string) (*Message, error) {
+	return p.setStatus(ctx, id, bson.M{"status": MessageHidden, "policyReason": reason}, "", "")
+}
+
+func (p *MessagePersistor) setStatus(ctx context.Context, id string, filter bson.M, status string, reason string) (*Message, error) {
 	oid, err := primitive.ObjectIDFromHex(id)
 
 	if err != nil {
-		return false, err
+		return nil, ErrInvalidObjectID
 	}
 
-	res, err := p.c.DeleteOne(ctx, bson.M{"_id": oid})
+	filter["_id"] = oid
+
+	res := p.c.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"status": status, "policyReason": reason}, "$inc": bson.M{"version": 1}})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var message Message
+	err = res.Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// DeleteById removes a message regardless of its author and returns it.
+func (p *MessagePersistor) DeleteById(ctx context.Context, id string) (*Message, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
 
 	if err != nil {
-		return false, err
+		return nil, ErrInvalidObjectID
+	}
+
+	res := p.c.FindOneAndDelete(ctx, bson.M{"_id": oid})
+
+	if res.Err() != nil {
+		return nil, res.Err()
 	}
 
-	if res.DeletedCount == 0 {
-		return false, ErrNothingDeleted
+	var message Message
+	err = res.Decode(&message)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return true, nil
+	return &message, nil
 }
 
-func (p *MessagePersistor) IsAuthor(ctx context.Context, id string, author string) bool {
+// SetPreviews stores the link previews of a message, unless its content has
+// been changed in the meantime (ErrNoDocuments). Previews are derived from the
+// content, so the version stays the same.
+func (p *MessagePersistor) SetPreviews(ctx context.Context, id primitive.ObjectID, content string, previews []LinkPreview) (*Message, error) {
+	res := p.c.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "content": content},
+		bson.M{"$set": bson.M{"previews": previews}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var message Message
+	err := res.Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// ownedMessageFilter builds the filter used for conditional writes on a message.
+func ownedMessageFilter(id string, author string, versions []int64) (bson.M, error) {
 	mid, err := primitive.ObjectIDFromHex(id)
 
 	if err != nil {
-		return false
+		return nil, ErrInvalidObjectID
 	}
 
 	aid, err := primitive.ObjectIDFromHex(author)
 
 	if err != nil {
-		return false
+		return nil, ErrInvalidObjectID
 	}
 
-	res := p.c.FindOne(ctx, bson.M{"_id": mid, "authorId": aid})
+	filter := bson.M{"_id": mid, "authorId": aid}
+
+	if len(versions) > 0 {
+		in := bson.A{}
+		for _, v := range versions {
+			in = append(in, v)
+
+			// messages created before versioning was introduced have no version field
+			if v == 0 {
+				in = append(in, nil)
+			}
+		}
+		filter["version"] = bson.M{"$in": in}
+	}
+
+	return filter, nil
+}
+
+// explainMismatch is called after a conditional write didn't match any document
+// and finds out which part of the filter caused it.
+func (p *MessagePersistor) explainMismatch(ctx context.Context, filter bson.M) error {
+	res := p.c.FindOne(ctx, bson.M{"_id": filter["_id"]})
+
+	if res.Err() != nil {
+		return res.Err()
+	}
+
+	var message Message
+	err := res.Decode(&message)
+
+	if err != nil {
+		return err
+	}
+
+	if message.AuthorID != filter["authorId"] {
+		return ErrNotAuthor
+	}
+
+	if _, ok := filter["repostOf"]; ok && message.RepostOf != nil {
+		return ErrIsRepost
+	}
 
-	return res.Err() == nil
+	return ErrVersionMismatch
 }
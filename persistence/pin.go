@@ -0,0 +1,206 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PinPersistor stores pinned messages. Global pins (announcements) have no
+// user, profile pins belong to the user who pinned them.
+type PinPersistor struct {
+	c *mongo.Collection
+}
+
+type Pin struct {
+	PinID     primitive.ObjectID  `json:"-" bson:"_id,omitempty"`
+	UserID    *primitive.ObjectID `json:"-" bson:"userId"`
+	MessageID primitive.ObjectID  `json:"messageId" bson:"messageId"`
+	Position  int                 `json:"position" bson:"position"`
+	Created   int64               `json:"pinned" bson:"created"`
+	Expires   *int64              `json:"expires,omitempty" bson:"expires,omitempty"`
+
+	// Slot is unique per user, there are as many slots as messages can be pinned
+	Slot int `json:"-" bson:"slot"`
+}
+
+var ErrTooManyPins = errors.New("pin limit reached")
+
+func NewPinPersistor(c *mongo.Collection) *PinPersistor {
+	return &PinPersistor{c}
+}
+
+// EnsureIndexes creates the unique indexes, which keep concurrent requests
+// from pinning a message twice or more messages than allowed.
+func (p *PinPersistor) EnsureIndexes(ctx context.Context) error {
+	_, err := p.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "messageId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "slot", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"slot": bson.M{"$exists": true}})},
+	})
+
+	return err
+}
+
+// Add pins a message behind the other pins of user (nil for global pins). At
+// most max messages can be pinned, expired pins don't count. Pinning a
+// message again only changes its expiry.
+//
+// Every pin takes one of max slots, the unique indexes make sure that
+// concurrent requests neither exceed the limit nor pin a message twice.
+func (p *PinPersistor) Add(ctx context.Context, pin Pin, max int, now int64) (*Pin, error) {
+	_, err := p.c.DeleteMany(ctx, bson.M{"userId": pin.UserID, "expires": bson.M{"$lte": now}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := p.Find(ctx, pin.UserID, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[int]bool{}
+
+	for _, e := range *existing {
+		if e.MessageID == pin.MessageID {
+			return p.setExpires(ctx, e, pin.Expires)
+		}
+
+		if e.Position >= pin.Position {
+			pin.Position = e.Position + 1
+		}
+
+		taken[e.Slot] = true
+	}
+
+	if len(*existing) >= max {
+		return nil, ErrTooManyPins
+	}
+
+	for slot := 0; slot < max; slot++ {
+		if taken[slot] {
+			continue
+		}
+
+		pin.Slot = slot
+		res, err := p.c.InsertOne(ctx, pin)
+
+		if mongo.IsDuplicateKeyError(err) {
+			// the message has been pinned in the meantime, or another one took the slot
+			if e, err := p.findOne(ctx, pin.UserID, pin.MessageID); err == nil {
+				return p.setExpires(ctx, *e, pin.Expires)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+			pin.PinID = oid
+			return &pin, nil
+		}
+
+		return nil, ErrInsertError
+	}
+
+	return nil, ErrTooManyPins
+}
+
+func (p *PinPersistor) findOne(ctx context.Context, user *primitive.ObjectID, message primitive.ObjectID) (*Pin, error) {
+	res := p.c.FindOne(ctx, bson.M{"userId": user, "messageId": message})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var pin Pin
+	err := res.Decode(&pin)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pin, nil
+}
+
+func (p *PinPersistor) setExpires(ctx context.Context, pin Pin, expires *int64) (*Pin, error) {
+	update := bson.M{"$unset": bson.M{"expires": nil}}
+	if expires != nil {
+		update = bson.M{"$set": bson.M{"expires": *expires}}
+	}
+
+	_, err := p.c.UpdateOne(ctx, bson.M{"_id": pin.PinID}, update)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pin.Expires = expires
+	return &pin, nil
+}
+
+// Find returns the pins of user (nil for global pins), which haven't expired, in their order.
+func (p *PinPersistor) Find(ctx context.Context, user *primitive.ObjectID, now int64) (*[]Pin, error) {
+	filter := bson.M{"userId": user, "$or": bson.A{bson.M{"expires": bson.M{"$exists": false}}, bson.M{"expires": bson.M{"$gt": now}}}}
+	cursor, err := p.c.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "position", Value: 1}, {Key: "created", Value: 1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	pins := []Pin{}
+	err = cursor.All(ctx, &pins)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pins, nil
+}
+
+// Remove unpins a message of user (nil for global pins).
+func (p *PinPersistor) Remove(ctx context.Context, user *primitive.ObjectID, message primitive.ObjectID) error {
+	res, err := p.c.DeleteOne(ctx, bson.M{"userId": user, "messageId": message})
+
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNothingDeleted
+	}
+
+	return nil
+}
+
+// Reorder sets the position of the pinned messages of user to their index in messages.
+func (p *PinPersistor) Reorder(ctx context.Context, user *primitive.ObjectID, messages []primitive.ObjectID) error {
+	models := make([]mongo.WriteModel, len(messages))
+
+	for i, message := range messages {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"userId": user, "messageId": message}).
+			SetUpdate(bson.M{"$set": bson.M{"position": i}})
+	}
+
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := p.c.BulkWrite(ctx, models)
+	return err
+}
+
+// DeleteByMessage removes every pin of a message.
+func (p *PinPersistor) DeleteByMessage(ctx context.Context, message primitive.ObjectID) error {
+	_, err := p.c.DeleteMany(ctx, bson.M{"messageId": message})
+	return err
+}
@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Poll is a question attached to a message. The votes are stored in the
+// message, so a vote and the tallies are written in a single atomic update.
+type Poll struct {
+	Options  []PollOption `json:"options" bson:"options"`
+	Multiple bool         `json:"multiple" bson:"multiple"`
+	Closes   int64        `json:"closes" bson:"closes"`
+
+	// Voters and the votes of the options are missing, while the results are hidden
+	Voters *int64 `json:"voters,omitempty" bson:"voters"`
+
+	// Votes are the choices (option indices) by user id
+	Votes map[string][]int `json:"-" bson:"votes"`
+
+	// Voted and Closed are set for the user reading the poll
+	Voted  []int `json:"voted,omitempty" bson:"-"`
+	Closed bool  `json:"closed" bson:"-"`
+}
+
+type PollOption struct {
+	Text  string `json:"text" bson:"text"`
+	Votes *int64 `json:"votes,omitempty" bson:"votes"`
+}
+
+var (
+	ErrNoPoll       = errors.New("message has no poll")
+	ErrPollClosed   = errors.New("poll is closed")
+	ErrAlreadyVoted = errors.New("already voted")
+)
+
+// Vote records the choices of user, unless the user has already voted or the
+// poll has closed. The message is returned with the new tallies.
+func (p *MessagePersistor) Vote(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, choices []int, now int64) (*Message, error) {
+	key := "poll.votes." + user.Hex()
+	filter := bson.M{"_id": id, "poll": bson.M{"$ne": nil}, "poll.closes": bson.M{"$gt": now}, key: bson.M{"$exists": false}}
+
+	inc := bson.M{"poll.voters": 1}
+	for _, choice := range choices {
+		inc["poll.options."+strconv.Itoa(choice)+".votes"] = 1
+	}
+
+	res := p.c.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{key: choices}, "$inc": inc},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, p.explainVote(ctx, id, now)
+	}
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var message Message
+	err := res.Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// explainVote tells why a vote hasn't been recorded
+func (p *MessagePersistor) explainVote(ctx context.Context, id primitive.ObjectID, now int64) error {
+	message, err := p.FindById(ctx, id.Hex())
+
+	switch {
+	case err != nil:
+		return err
+	case message.Poll == nil:
+		return ErrNoPoll
+	case message.Poll.Closes <= now:
+		return ErrPollClosed
+	default:
+		return ErrAlreadyVoted
+	}
+}
@@ -0,0 +1,69 @@
+package persistence
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PreviewPersistor caches link previews by URL.
+type PreviewPersistor struct {
+	c *mongo.Collection
+}
+
+// LinkPreview is the Open Graph (or Twitter card) metadata of a linked page.
+type LinkPreview struct {
+	URL         string `json:"url" bson:"url"`
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	Image       string `json:"image,omitempty" bson:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty" bson:"siteName,omitempty"`
+}
+
+// CachedPreview is a cache entry. Preview is nil, if the page couldn't be
+// fetched or has no metadata, so it isn't requested again until it expires.
+type CachedPreview struct {
+	URL     string       `bson:"_id"`
+	Preview *LinkPreview `bson:"preview"`
+	Fetched int64        `bson:"fetched"`
+}
+
+func NewPreviewPersistor(c *mongo.Collection) *PreviewPersistor {
+	return &PreviewPersistor{c}
+}
+
+func (p *PreviewPersistor) Find(ctx context.Context, url string) (*CachedPreview, error) {
+	res := p.c.FindOne(ctx, bson.M{"_id": url})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var cached CachedPreview
+	err := res.Decode(&cached)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cached, nil
+}
+
+// Store adds or replaces a cache entry.
+func (p *PreviewPersistor) Store(ctx context.Context, cached CachedPreview) error {
+	_, err := p.c.ReplaceOne(ctx, bson.M{"_id": cached.URL}, cached, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteExpired removes the entries fetched before fetchedBefore.
+func (p *PreviewPersistor) DeleteExpired(ctx context.Context, fetchedBefore int64) (int64, error) {
+	res, err := p.c.DeleteMany(ctx, bson.M{"fetched": bson.M{"$lt": fetchedBefore}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.DeletedCount, nil
+}
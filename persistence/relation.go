@@ -0,0 +1,179 @@
+package persistence
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RelationPersistor stores the users a user has blocked or muted.
+type RelationPersistor struct {
+	c *mongo.Collection
+}
+
+type Relation struct {
+	RelationID primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `json:"-" bson:"userId"`
+	TargetID   primitive.ObjectID `json:"userId" bson:"targetId"`
+	Type       string             `json:"-" bson:"type"`
+	Created    int64              `json:"since" bson:"created"`
+}
+
+const (
+	RelationBlock = "block" // neither sees the other's messages, the target can't reply to or mention the user
+	RelationMute  = "mute"  // the user doesn't see the target's messages
+)
+
+func NewRelationPersistor(c *mongo.Collection) *RelationPersistor {
+	return &RelationPersistor{c}
+}
+
+// EnsureIndexes creates the unique index, which allows a single block and
+// mute of a user per user.
+func (p *RelationPersistor) EnsureIndexes(ctx context.Context) error {
+	_, err := p.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "targetId", Value: 1}, {Key: "type", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	return err
+}
+
+// Add stores a relation. Adding an existing relation keeps the original one.
+func (p *RelationPersistor) Add(ctx context.Context, relation Relation) (*Relation, error) {
+	filter := bson.M{"userId": relation.UserID, "targetId": relation.TargetID, "type": relation.Type}
+	update := bson.M{"$setOnInsert": bson.M{"created": relation.Created}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	res := p.c.FindOneAndUpdate(ctx, filter, update, opts)
+
+	// inserted by a concurrent request, now it's found
+	if mongo.IsDuplicateKeyError(res.Err()) {
+		res = p.c.FindOneAndUpdate(ctx, filter, update, opts)
+	}
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var added Relation
+	err := res.Decode(&added)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &added, nil
+}
+
+func (p *RelationPersistor) Remove(ctx context.Context, user primitive.ObjectID, target primitive.ObjectID, relationType string) error {
+	res, err := p.c.DeleteOne(ctx, bson.M{"userId": user, "targetId": target, "type": relationType})
+
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNothingDeleted
+	}
+
+	return nil
+}
+
+// FindByUser returns the relations of a type of a user, the newest first.
+func (p *RelationPersistor) FindByUser(ctx context.Context, user primitive.ObjectID, relationType string) (*[]Relation, error) {
+	cursor, err := p.c.Find(ctx, bson.M{"userId": user, "type": relationType}, options.Find().SetSort(bson.D{{Key: "created", Value: -1}}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	relations := []Relation{}
+	err = cursor.All(ctx, &relations)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &relations, nil
+}
+
+// HiddenAuthors returns the users whose messages user doesn't see: the users
+// user has blocked or muted and the users who have blocked user.
+func (p *RelationPersistor) HiddenAuthors(ctx context.Context, user primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := p.c.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"userId": user},
+		bson.M{"targetId": user, "type": RelationBlock},
+	}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	relations := []Relation{}
+	err = cursor.All(ctx, &relations)
+
+	if err != nil {
+		return nil, err
+	}
+
+	authors := []primitive.ObjectID{}
+	for _, r := range relations {
+		if r.UserID == user {
+			authors = append(authors, r.TargetID)
+		} else {
+			authors = append(authors, r.UserID)
+		}
+	}
+
+	return authors, nil
+}
+
+// IsBlocked reports whether one of the users in by has blocked user.
+func (p *RelationPersistor) IsBlocked(ctx context.Context, user primitive.ObjectID, by []primitive.ObjectID) (bool, error) {
+	if len(by) == 0 {
+		return false, nil
+	}
+
+	count, err := p.c.CountDocuments(ctx, bson.M{"userId": bson.M{"$in": by}, "targetId": user, "type": RelationBlock})
+
+	return count > 0, err
+}
+
+// Blocks returns the users among others, who have blocked user or have been
+// blocked by user.
+func (p *RelationPersistor) Blocks(ctx context.Context, user primitive.ObjectID, others []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	blocks := map[primitive.ObjectID]bool{}
+
+	if len(others) == 0 {
+		return blocks, nil
+	}
+
+	cursor, err := p.c.Find(ctx, bson.M{"type": RelationBlock, "$or": bson.A{
+		bson.M{"userId": user, "targetId": bson.M{"$in": others}},
+		bson.M{"userId": bson.M{"$in": others}, "targetId": user},
+	}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	relations := []Relation{}
+	err = cursor.All(ctx, &relations)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range relations {
+		if r.UserID == user {
+			blocks[r.TargetID] = true
+		} else {
+			blocks[r.UserID] = true
+		}
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,174 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReportPersistor stores reports of messages and the audit trail of the
+// actions moderators have taken.
+type ReportPersistor struct {
+	reports *mongo.Collection
+	audit   *mongo.Collection
+}
+
+type Report struct {
+	ReportID   primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	MessageID  primitive.ObjectID `json:"messageId" bson:"messageId"`
+	ReporterID primitive.ObjectID `json:"reporterId" bson:"reporterId"`
+	Reason     string             `json:"reason" bson:"reason" validate:"required,oneof=spam abuse harassment misinformation other"`
+	Comment    string             `json:"comment,omitempty" bson:"comment" validate:"max=500"`
+	Status     string             `json:"status" bson:"status"`
+	Resolution string             `json:"resolution,omitempty" bson:"resolution,omitempty"`
+	Created    int64              `json:"created" bson:"created"`
+}
+
+const (
+	ReportOpen     = "open"
+	ReportResolved = "resolved"
+)
+
+var ErrInvalidReport = errors.New("Bitte gib einen Grund an: spam, abuse, harassment, misinformation oder other (Kommentar max. 500 Zeichen).")
+
+// ReportSummary groups the open reports of a message.
+type ReportSummary struct {
+	MessageID     primitive.ObjectID `json:"messageId" bson:"_id"`
+	Count         int                `json:"count" bson:"count"`
+	Reasons       []ReasonCount      `json:"reasons" bson:"reasons"`
+	FirstReported int64              `json:"firstReported" bson:"first"`
+	LastReported  int64              `json:"lastReported" bson:"last"`
+}
+
+type ReasonCount struct {
+	Reason string `json:"reason" bson:"reason"`
+	Count  int    `json:"count" bson:"count"`
+}
+
+// AuditEntry records an action taken by a moderator. Actions taken
+// automatically have no moderator.
+type AuditEntry struct {
+	EntryID     primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Action      string             `json:"action" bson:"action"`
+	ModeratorID primitive.ObjectID `json:"moderatorId,omitempty" bson:"moderatorId,omitempty"`
+	MessageID   primitive.ObjectID `json:"messageId,omitempty" bson:"messageId,omitempty"`
+	UserID      primitive.ObjectID `json:"userId,omitempty" bson:"userId,omitempty"`
+	Reports     int64              `json:"reports,omitempty" bson:"reports,omitempty"`
+	Note        string             `json:"note,omitempty" bson:"note,omitempty"`
+	Created     int64              `json:"created" bson:"created"`
+}
+
+func NewReportPersistor(reports *mongo.Collection, audit *mongo.Collection) *ReportPersistor {
+	return &ReportPersistor{reports, audit}
+}
+
+// Create stores a report. A user has at most one open report per message,
+// reporting it again keeps the first one. The number of open reports of the
+// message is returned.
+func (p *ReportPersistor) Create(ctx context.Context, report Report) (int64, error) {
+	err := validate.Struct(report)
+	if err != nil {
+		return 0, ErrInvalidReport
+	}
+
+	report.Status = ReportOpen
+
+	_, err = p.reports.UpdateOne(ctx,
+		bson.M{"messageId": report.MessageID, "reporterId": report.ReporterID, "status": ReportOpen},
+		bson.M{"$setOnInsert": report},
+		options.Update().SetUpsert(true))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return p.reports.CountDocuments(ctx, bson.M{"messageId": report.MessageID, "status": ReportOpen})
+}
+
+// Queue returns the messages with open reports, the most reported first.
+func (p *ReportPersistor) Queue(ctx context.Context, limit int64, skip int64) (*[]ReportSummary, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": ReportOpen}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"messageId": "$messageId", "reason": "$reason"},
+			"count": bson.M{"$sum": 1},
+			"first": bson.M{"$min": "$created"},
+			"last":  bson.M{"$max": "$created"},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     "$_id.messageId",
+			"count":   bson.M{"$sum": "$count"},
+			"reasons": bson.M{"$push": bson.M{"reason": "$_id.reason", "count": "$count"}},
+			"first":   bson.M{"$min": "$first"},
+			"last":    bson.M{"$max": "$last"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "last", Value: -1}}}},
+		{{Key: "$skip", Value: skip}},
+		{{Key: "$limit", Value: limit}},
+	}
+
+	cursor, err := p.reports.Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []ReportSummary{}
+	err = cursor.All(ctx, &summaries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &summaries, nil
+}
+
+// Resolve closes the open reports of a message and returns their number.
+func (p *ReportPersistor) Resolve(ctx context.Context, message primitive.ObjectID, resolution string) (int64, error) {
+	res, err := p.reports.UpdateMany(ctx,
+		bson.M{"messageId": message, "status": ReportOpen},
+		bson.M{"$set": bson.M{"status": ReportResolved, "resolution": resolution}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+func (p *ReportPersistor) AddAuditEntry(ctx context.Context, entry AuditEntry) (*AuditEntry, error) {
+	res, err := p.audit.InsertOne(ctx, entry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		entry.EntryID = oid
+		return &entry, nil
+	}
+
+	return nil, ErrInsertError
+}
+
+// FindAuditEntries returns the audit trail, newest first.
+func (p *ReportPersistor) FindAuditEntries(ctx context.Context, filter bson.M, limit int64, skip int64) (*[]AuditEntry, error) {
+	cursor, err := p.audit.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created", Value: -1}}).SetLimit(limit).SetSkip(skip))
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	err = cursor.All(ctx, &entries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &entries, nil
+}
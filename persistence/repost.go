@@ -0,0 +1,111 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"gofeed-go/helper"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrIsRepost = errors.New("reposts can't be edited")
+
+// EnsureIndexes creates the unique index, which allows a single repost of a
+// message per user. Messages, which aren't reposts, store null as repostOf.
+func (p *MessagePersistor) EnsureIndexes(ctx context.Context) error {
+	_, err := p.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "authorId", Value: 1}, {Key: "repostOf", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"repostOf": bson.M{"$type": "objectId"}}),
+	})
+
+	return err
+}
+
+// Repost stores a repost (a message without content referencing the original
+// in RepostOf), unless the author has already reposted the original. The
+// repost is returned, created tells whether it's new.
+func (p *MessagePersistor) Repost(ctx context.Context, repost Message) (*Message, bool, error) {
+	filter := bson.M{"authorId": repost.AuthorID, "repostOf": repost.RepostOf}
+
+	res, err := p.c.UpdateOne(ctx, filter, bson.M{"$setOnInsert": helper.CleanCreateBody(repost)}, options.Update().SetUpsert(true))
+	created := false
+
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		// reposted by a concurrent request, the unique index refused this one
+	case err != nil:
+		return nil, false, err
+	default:
+		created = res.UpsertedID != nil
+	}
+
+	found := p.c.FindOne(ctx, filter)
+
+	if found.Err() != nil {
+		return nil, false, found.Err()
+	}
+
+	var message Message
+	err = found.Decode(&message)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &message, created, nil
+}
+
+// Unrepost removes the repost of original by author and returns it.
+func (p *MessagePersistor) Unrepost(ctx context.Context, author primitive.ObjectID, original primitive.ObjectID) (*Message, error) {
+	res := p.c.FindOneAndDelete(ctx, bson.M{"authorId": author, "repostOf": original})
+
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, ErrNothingDeleted
+	}
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var message Message
+	err := res.Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// CountReposts changes the number of reposts of a message by delta. The
+// version isn't changed, so If-Match keeps working for the author, but the
+// ETag of the message changes with the count.
+func (p *MessagePersistor) CountReposts(ctx context.Context, id primitive.ObjectID, delta int64) error {
+	_, err := p.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"reposts": delta}})
+	return err
+}
+
+// DeleteReposts removes the reposts of a message and returns them.
+func (p *MessagePersistor) DeleteReposts(ctx context.Context, original primitive.ObjectID) (*[]Message, error) {
+	reposts, err := p.Find(ctx, bson.M{"repostOf": original}, options.Find())
+
+	if err != nil || len(*reposts) == 0 {
+		return reposts, err
+	}
+
+	ids := make(bson.A, len(*reposts))
+	for i, r := range *reposts {
+		ids[i] = r.MessageID
+	}
+
+	_, err = p.c.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reposts, nil
+}
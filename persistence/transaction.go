@@ -0,0 +1,46 @@
+package persistence
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transactor runs functions in MongoDB transactions. Transactions require
+// MongoDB to run as replica set.
+type Transactor struct {
+	c *mongo.Client
+}
+
+func NewTransactor(c *mongo.Client) *Transactor {
+	return &Transactor{c}
+}
+
+// WithTransaction runs fn in a transaction, which is committed if fn returns
+// nil and aborted otherwise. Every operation using the context passed to fn
+// takes part in the transaction. The context must not be used concurrently.
+func (t *Transactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := t.c.StartSession()
+
+	if err != nil {
+		return err
+	}
+
+	defer session.EndSession(ctx)
+
+	err = session.StartTransaction()
+
+	if err != nil {
+		return err
+	}
+
+	sc := mongo.NewSessionContext(ctx, session)
+	err = fn(sc)
+
+	if err != nil {
+		session.AbortTransaction(sc)
+		return err
+	}
+
+	return session.CommitTransaction(sc)
+}
@@ -23,6 +23,25 @@ type User struct {
 	Group       string             `json:"group" bson:"group"`
 	MemberSince int64              `json:"member_since" bson:"member_since" gofeed:"remUpdate"`
 	LastLogin   int64              `json:"last_login" bson:"last_login"`
+
+	// set by moderators, see AddWarning and SetSuspended
+	Warnings  int  `json:"warnings,omitempty" bson:"warnings" gofeed:"remUpdate"`
+	Suspended bool `json:"suspended,omitempty" bson:"suspended" gofeed:"remUpdate"`
+
+	// custom avatar replacing the one of the provider, see SetAvatarImage
+	AvatarImage *Image `json:"-" bson:"avatarImage,omitempty" gofeed:"remUpdate"`
+
+	// Updated is the time the profile was last changed by the user
+	Updated int64 `json:"updated,omitempty" bson:"updated" gofeed:"remUpdate"`
+
+	// profile edited by the user, they aren't part of the JWT
+	Bio         string `json:"-" bson:"bio,omitempty" gofeed:"remUpdate"`
+	Website     string `json:"-" bson:"website,omitempty" gofeed:"remUpdate"`
+	Location    string `json:"-" bson:"location,omitempty" gofeed:"remUpdate"`
+	BannerImage *Image `json:"-" bson:"bannerImage,omitempty" gofeed:"remUpdate"`
+
+	// KeepProfile stops the sign in from overwriting name and avatar with the provider's
+	KeepProfile bool `json:"-" bson:"keepProfile" gofeed:"remUpdate"`
 }
 
 func NewUserPersistor(c *mongo.Collection) *UserPersistor {
@@ -52,6 +71,24 @@ func (p *UserPersistor) FindById(ctx context.Context, id string) (*User, error)
 	return &user, nil
 }
 
+// FindByIds loads several users in a single query. Unknown ids are skipped.
+func (p *UserPersistor) FindByIds(ctx context.Context, ids []primitive.ObjectID) (*[]User, error) {
+	cursor, err := p.c.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	err = cursor.All(ctx, &users)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &users, nil
+}
+
 func (p *UserPersistor) FindByProvider(ctx context.Context, provider string, providerId string) (*User, error) {
 	res := p.c.FindOne(ctx, bson.M{"provider": provider, "providerId": providerId})
 
@@ -81,24 +118,86 @@ func (p *UserPersistor) Create(ctx context.Context, user User) (*User, error) {
 	return nil, ErrInsertError
 
 }
-func (p *UserPersistor) Update(ctx context.Context, id string, update User) (*User, error) {
 
-	oid, err := primitive.ObjectIDFromHex(id)
+// Update sets and unsets fields of a user and returns the updated user. Only
+// the given fields are written, the others (e.g. group) are left alone.
+func (p *UserPersistor) Update(ctx context.Context, id primitive.ObjectID, set bson.M, unset bson.M) (*User, error) {
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	res := p.c.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var user User
+	err := res.Decode(&user)
 
 	if err != nil {
 		return nil, err
 	}
 
-	userCleaned := helper.CleanUpdateBody(update)
+	return &user, nil
+}
+
+// AddWarning increments the number of warnings a user has received.
+func (p *UserPersistor) AddWarning(ctx context.Context, id primitive.ObjectID) error {
+	res, err := p.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"warnings": 1}})
+
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
 
-	res := p.c.FindOneAndUpdate(ctx, bson.M{"_id": oid}, bson.M{"$set": userCleaned}, options.FindOneAndUpdate().SetReturnDocument(options.After))
+func (p *UserPersistor) SetSuspended(ctx context.Context, id primitive.ObjectID, suspended bool) error {
+	res, err := p.c.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"suspended": suspended}})
+
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// SetAvatarImage replaces the custom avatar of a user, nil removes it. The
+// user is returned as it was before.
+func (p *UserPersistor) SetAvatarImage(ctx context.Context, id primitive.ObjectID, image *Image, updated int64) (*User, error) {
+	return p.setImage(ctx, id, "avatarImage", image, updated)
+}
+
+// SetBannerImage replaces the profile banner of a user like SetAvatarImage.
+func (p *UserPersistor) SetBannerImage(ctx context.Context, id primitive.ObjectID, image *Image, updated int64) (*User, error) {
+	return p.setImage(ctx, id, "bannerImage", image, updated)
+}
+
+func (p *UserPersistor) setImage(ctx context.Context, id primitive.ObjectID, field string, image *Image, updated int64) (*User, error) {
+	update := bson.M{"$set": bson.M{field: image, "updated": updated}}
+
+	if image == nil {
+		update = bson.M{"$unset": bson.M{field: ""}, "$set": bson.M{"updated": updated}}
+	}
+
+	res := p.c.FindOneAndUpdate(ctx, bson.M{"_id": id}, update)
 
 	if res.Err() != nil {
 		return nil, res.Err()
 	}
 
 	var user User
-	err = res.Decode(&user)
+	err := res.Decode(&user)
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,241 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookPersistor stores webhook subscriptions and their deliveries. The
+// deliveries collection doubles as persistent delivery queue.
+type WebhookPersistor struct {
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+}
+
+type Webhook struct {
+	WebhookID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	URL       string             `json:"url" bson:"url" validate:"required,url"`
+	Secret    string             `json:"secret,omitempty" bson:"secret"`
+	Events    []string           `json:"events" bson:"events" validate:"required,gt=0"`
+	CreatedBy primitive.ObjectID `json:"createdBy" bson:"createdBy"`
+	Created   int64              `json:"created" bson:"created"`
+}
+
+var ErrInvalidWebhook = errors.New("invalid webhook: url and events are required")
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+type Delivery struct {
+	DeliveryID     primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	WebhookID      primitive.ObjectID `json:"webhookId" bson:"webhookId"`
+	Event          string             `json:"event" bson:"event"`
+	Payload        string             `json:"payload" bson:"payload"`
+	Status         string             `json:"status" bson:"status"`
+	Attempts       int                `json:"attempts" bson:"attempts"`
+	NextAttempt    int64              `json:"nextAttempt,omitempty" bson:"nextAttempt"`
+	LastAttempt    int64              `json:"lastAttempt,omitempty" bson:"lastAttempt"`
+	ResponseStatus int                `json:"responseStatus,omitempty" bson:"responseStatus"`
+	Error          string             `json:"error,omitempty" bson:"error"`
+	RedeliveryOf   primitive.ObjectID `json:"redeliveryOf,omitempty" bson:"redeliveryOf,omitempty"`
+	LockedUntil    int64              `json:"-" bson:"lockedUntil"`
+	Created        int64              `json:"created" bson:"created"`
+}
+
+func NewWebhookPersistor(webhooks *mongo.Collection, deliveries *mongo.Collection) *WebhookPersistor {
+	return &WebhookPersistor{webhooks, deliveries}
+}
+
+func (p *WebhookPersistor) Create(ctx context.Context, webhook Webhook) (*Webhook, error) {
+	err := validate.Struct(webhook)
+	if err != nil {
+		return nil, ErrInvalidWebhook
+	}
+
+	res, err := p.webhooks.InsertOne(ctx, webhook)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		webhook.WebhookID = oid
+		return &webhook, nil
+	}
+
+	return nil, ErrInsertError
+}
+
+func (p *WebhookPersistor) FindById(ctx context.Context, id string) (*Webhook, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	res := p.webhooks.FindOne(ctx, bson.M{"_id": oid})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var webhook Webhook
+	err = res.Decode(&webhook)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhook, nil
+}
+
+func (p *WebhookPersistor) Find(ctx context.Context, filter bson.M) (*[]Webhook, error) {
+	cursor, err := p.webhooks.Find(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []Webhook{}
+	err = cursor.All(ctx, &webhooks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhooks, nil
+}
+
+// Delete removes a webhook, including its delivery log.
+func (p *WebhookPersistor) Delete(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return ErrInvalidObjectID
+	}
+
+	res, err := p.webhooks.DeleteOne(ctx, bson.M{"_id": oid})
+
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNothingDeleted
+	}
+
+	_, err = p.deliveries.DeleteMany(ctx, bson.M{"webhookId": oid})
+	return err
+}
+
+func (p *WebhookPersistor) Enqueue(ctx context.Context, delivery Delivery) (*Delivery, error) {
+	res, err := p.deliveries.InsertOne(ctx, delivery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		delivery.DeliveryID = oid
+		return &delivery, nil
+	}
+
+	return nil, ErrInsertError
+}
+
+// ClaimDue locks the oldest due delivery until lockUntil, so no other instance
+// picks it up in the meantime. It returns mongo.ErrNoDocuments if nothing is due.
+func (p *WebhookPersistor) ClaimDue(ctx context.Context, now int64, lockUntil int64) (*Delivery, error) {
+	res := p.deliveries.FindOneAndUpdate(ctx,
+		bson.M{"status": DeliveryPending, "nextAttempt": bson.M{"$lte": now}, "lockedUntil": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"lockedUntil": lockUntil}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextAttempt", Value: 1}}).SetReturnDocument(options.After))
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var delivery Delivery
+	err := res.Decode(&delivery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// SaveAttempt stores the outcome of a delivery attempt and releases the lock.
+func (p *WebhookPersistor) SaveAttempt(ctx context.Context, delivery Delivery) error {
+	_, err := p.deliveries.UpdateOne(ctx, bson.M{"_id": delivery.DeliveryID}, bson.M{"$set": bson.M{
+		"status":         delivery.Status,
+		"attempts":       delivery.Attempts,
+		"nextAttempt":    delivery.NextAttempt,
+		"lastAttempt":    delivery.LastAttempt,
+		"responseStatus": delivery.ResponseStatus,
+		"error":          delivery.Error,
+		"lockedUntil":    0,
+	}})
+	return err
+}
+
+func (p *WebhookPersistor) FindDelivery(ctx context.Context, webhook string, id string) (*Delivery, error) {
+	wid, err := primitive.ObjectIDFromHex(webhook)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	did, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	res := p.deliveries.FindOne(ctx, bson.M{"_id": did, "webhookId": wid})
+
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var delivery Delivery
+	err = res.Decode(&delivery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// FindDeliveries returns the delivery log of a webhook, newest first.
+func (p *WebhookPersistor) FindDeliveries(ctx context.Context, webhook string, limit int64) (*[]Delivery, error) {
+	wid, err := primitive.ObjectIDFromHex(webhook)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	cursor, err := p.deliveries.Find(ctx, bson.M{"webhookId": wid}, options.Find().SetSort(bson.D{{Key: "created", Value: -1}}).SetLimit(limit))
+
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []Delivery{}
+	err = cursor.All(ctx, &deliveries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &deliveries, nil
+}
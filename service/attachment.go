@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AttachmentService stores files uploaded by users, which can be attached to
+// new messages. Uploads are kept in a BlobStore, their metadata in mongo.
+type AttachmentService struct {
+	p       *persistence.AttachmentPersistor
+	blobs   BlobStore
+	ms      *MessageService
+	maxSize int64
+	types   map[string]bool
+}
+
+var (
+	ErrAttachmentTooLarge  = errors.New("Die Datei ist zu groß.")
+	ErrUnsupportedFileType = errors.New("Dieser Dateityp wird nicht unterstützt.")
+)
+
+const (
+	// orphanAge is the time uploads may remain unused before they are removed
+	orphanAge = 24 * time.Hour
+
+	attachmentSweepInterval = time.Hour
+	attachmentSweepBatch    = 100
+	attachmentCleanupTime   = time.Minute
+)
+
+// NewAttachmentService creates the service. Uploads larger than maxSize bytes
+// or of another type than types (e.g. image/png) are refused. The type is
+// sniffed from the content, the type claimed by the client is ignored.
+func NewAttachmentService(p *persistence.AttachmentPersistor, blobs BlobStore, ms *MessageService, maxSize int64, types []string) *AttachmentService {
+	allowed := map[string]bool{}
+	for _, t := range types {
+		if t = strings.TrimSpace(t); t != "" {
+			allowed[t] = true
+		}
+	}
+
+	return &AttachmentService{p, blobs, ms, maxSize, allowed}
+}
+
+// Upload stores a file of the user in ctx.
+func (s *AttachmentService) Upload(ctx context.Context, name string, r io.ReadSeeker, size int64) (*persistence.Attachment, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if size > s.maxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	contentType, err := sniff(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.types[contentType] {
+		return nil, ErrUnsupportedFileType
+	}
+
+	// the metadata is written first, so the sweep removes blobs of failed uploads
+	attachment, err := s.p.Create(ctx, persistence.Attachment{
+		OwnerID:     user.UserID,
+		Name:        cleanFileName(name),
+		ContentType: contentType,
+		Size:        size,
+		Created:     helper.GetCurrentTimeMillies(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.blobs.Put(ctx, attachmentKey(attachment), r, size, contentType)
+
+	if err != nil {
+		s.p.Delete(ctx, attachment.AttachmentID)
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// Open returns an attachment and its content. Attachments of messages are
+// available to everybody, who can see the message, unused uploads only to
+// their owner.
+func (s *AttachmentService) Open(ctx context.Context, id string) (*persistence.Attachment, io.ReadCloser, error) {
+	attachment, err := s.p.FindById(ctx, id)
+
+	if err != nil {
+		return nil, nil, translateError(err)
+	}
+
+	if attachment.MessageID != nil {
+		_, err = s.ms.GetMessageById(ctx, attachment.MessageID.Hex())
+	} else if user, uerr := userFromContext(ctx); uerr != nil || user.UserID != attachment.OwnerID {
+		err = mongo.ErrNoDocuments
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := s.blobs.Get(ctx, attachmentKey(attachment))
+
+	if err == ErrBlobNotFound {
+		return nil, nil, mongo.ErrNoDocuments
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return attachment, content, nil
+}
+
+// OnMessageEvent removes the attachments of deleted messages.
+// It's meant to be registered with MessageService.Subscribe.
+func (s *AttachmentService) OnMessageEvent(e MessageEvent) {
+	if e.Type != EventMessageDeleted || len(e.Message.Attachments) == 0 {
+		return
+	}
+
+	go s.removeMessageAttachments(e.Message)
+}
+
+func (s *AttachmentService) removeMessageAttachments(message *persistence.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), attachmentCleanupTime)
+	defer cancel()
+
+	// messages, which aren't public anymore, are reported as deleted as well
+	_, err := s.ms.p.FindById(ctx, message.MessageID.Hex())
+
+	if err != mongo.ErrNoDocuments {
+		return
+	}
+
+	attachments, err := s.p.FindByMessage(ctx, message.MessageID)
+
+	if err != nil {
+		log.Println("attachment: couldn't load attachments:", err)
+		return
+	}
+
+	s.removeAll(ctx, attachments)
+}
+
+// Run removes orphaned attachments until ctx is cancelled: unused uploads and
+// attachments of messages, which have been deleted while the cleanup failed.
+func (s *AttachmentService) Run(ctx context.Context) {
+	ticker := time.NewTicker(attachmentSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		for s.sweep(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep removes a batch of orphans and reports whether there may be more
+func (s *AttachmentService) sweep(ctx context.Context) bool {
+	before := helper.GetCurrentTimeMillies() - orphanAge.Milliseconds()
+	orphans, err := s.p.FindOrphans(ctx, before, attachmentSweepBatch)
+
+	if err != nil {
+		log.Println("attachment: couldn't find orphans:", err)
+		return false
+	}
+
+	return s.removeAll(ctx, orphans) == attachmentSweepBatch
+}
+
+// removeAll deletes attachments and their blobs and returns the number removed
+func (s *AttachmentService) removeAll(ctx context.Context, attachments *[]persistence.Attachment) int {
+	removed := 0
+
+	for _, a := range *attachments {
+		// the blob is deleted first, the metadata is needed to retry
+		err := s.blobs.Delete(ctx, attachmentKey(&a))
+
+		if err == nil {
+			err = s.p.Delete(ctx, a.AttachmentID)
+		}
+
+		if err != nil {
+			log.Printf("attachment: couldn't remove %s: %v\n", a.AttachmentID.Hex(), err)
+			continue
+		}
+
+		removed++
+	}
+
+	return removed
+}
+
+func attachmentKey(a *persistence.Attachment) string {
+	return "attachments/" + a.AttachmentID.Hex()
+}
+
+// sniff detects the media type of the content of r and rewinds it
+func sniff(r io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnsupportedFileType, err)
+	}
+
+	return mediaType, nil
+}
+
+// cleanFileName removes directories and control characters from a file name
+// provided by the client
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[len(runes)-255:])
+	}
+
+	return name
+}
@@ -3,15 +3,14 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strings"
 
 	"github.com/brianvoe/sjwt"
 	"github.com/gorilla/sessions"
-	"github.com/joho/godotenv"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"github.com/markbates/goth/providers/github"
@@ -22,10 +21,6 @@ import (
 
 type AuthService struct{}
 
-func NewAuthService() *AuthService {
-	return &AuthService{}
-}
-
 type Exception struct {
 	Message string `json:"message"`
 }
@@ -41,16 +36,29 @@ type User struct {
 	LastLogin   int64              `json:"last_login" bson:"last_login"`
 }
 
-type userKey struct{}
+// IsModerator reports whether the user may moderate content, admins may as well.
+func (u *User) IsModerator() bool {
+	return u.Group == GroupModerator || u.Group == GroupAdmin
+}
 
-func init() {
+type userKey struct{}
 
-	godotenv.Load(".env")
+var (
+	ErrNotAuthenticated = errors.New("not authenticated")
+	ErrNoAuthHeader     = errors.New("No authorization header set")
+	ErrNoBearerToken    = errors.New("No bearer token set")
+	ErrInvalidJWT       = errors.New("Invalid JWT")
+)
 
-	if len(os.Getenv("JWT_SECRET")) < 10 {
-		log.Fatal("No env set")
-	}
+const (
+	GroupUser      = "user"
+	GroupModerator = "moderator"
+	GroupAdmin     = "admin"
+)
 
+// NewAuthService registers the OAuth providers used for GoFeed. The env
+// variables have to be loaded at this point.
+func NewAuthService() *AuthService {
 	fmt.Println("Register OAuth")
 
 	store := sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
@@ -66,11 +74,28 @@ func init() {
 		google.New(os.Getenv("GOOGLE_KEY"), os.Getenv("GOOGLE_SECRET"), os.ExpandEnv("${CALLBACK}/auth/google/callback"), "profile"),
 		github.New(os.Getenv("GITHUB_KEY"), os.Getenv("GITHUB_SECRET"), os.ExpandEnv("${CALLBACK}/auth/github/callback"), "user:name"),
 	)
+
+	return &AuthService{}
 }
 
 func (a *AuthService) ExtractUser(req *http.Request) (*User, error) {
+	return a.UserFromContext(req.Context())
+}
+
+// UserFromContext returns the user authenticated by Middleware.
+func (a *AuthService) UserFromContext(ctx context.Context) (*User, error) {
+	return userFromContext(ctx)
+}
+
+func userFromContext(ctx context.Context) (*User, error) {
+	value := ctx.Value(&userKey{})
+
+	if value == nil {
+		return nil, ErrNotAuthenticated
+	}
+
 	var user User
-	err := mapstructure.Decode(req.Context().Value(&userKey{}), &user)
+	err := mapstructure.Decode(value, &user)
 
 	if err != nil {
 		return nil, err
@@ -81,46 +106,108 @@ func (a *AuthService) ExtractUser(req *http.Request) (*User, error) {
 
 func (a *AuthService) Middleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		authHeader := req.Header.Get("Authorization")
-		if authHeader == "" {
-			unauthorized(w, "No authorization header set")
+		user, err := a.Authenticate(req.Header.Get("Authorization"))
+
+		if err != nil {
+			unauthorized(w, err.Error())
 			return
 		}
 
-		bearerToken := strings.Split(authHeader, " ")
-		if len(bearerToken) != 2 {
-			unauthorized(w, "No bearer token set")
-			return
+		if next != nil {
+			next(w, req.WithContext(a.WithUser(req.Context(), user)))
 		}
+	})
+}
+
+// Authenticate verifies the JWT of an authorization header ("bearer <jwt>")
+// and returns the user it has been issued for.
+func (a *AuthService) Authenticate(authHeader string) (*User, error) {
+	if authHeader == "" {
+		return nil, ErrNoAuthHeader
+	}
+
+	bearerToken := strings.Split(authHeader, " ")
+	if len(bearerToken) != 2 {
+		return nil, ErrNoBearerToken
+	}
 
-		jwt := bearerToken[1]
-		verified := sjwt.Verify(jwt, []byte(os.Getenv("JWT_SECRET")))
+	jwt := bearerToken[1]
+	verified := sjwt.Verify(jwt, []byte(os.Getenv("JWT_SECRET")))
 
-		if !verified {
-			unauthorized(w, "Invalid JWT")
+	if !verified {
+		return nil, ErrInvalidJWT
+	}
+
+	claims, err := sjwt.Parse(jwt)
+	if err == nil {
+		err = claims.Validate()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	claims.ToStruct(&user)
+
+	return &user, nil
+}
+
+// WithUser returns a copy of ctx carrying the authenticated user.
+func (a *AuthService) WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, &userKey{}, *user)
+}
+
+// OptionalMiddleware authenticates the user like Middleware, if an
+// authorization header is sent. Requests without are passed on anonymously.
+func (a *AuthService) OptionalMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := a.Middleware(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			next(w, req)
 			return
 		}
 
-		claims, err := sjwt.Parse(jwt)
-		if err == nil {
-			err = claims.Validate()
-		}
+		authenticated(w, req)
+	})
+}
 
-		if err != nil {
-			unauthorized(w, err.Error())
+// AdminMiddleware authenticates the user like Middleware and additionally
+// requires the user to be in the admin group.
+func (a *AuthService) AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return a.Middleware(func(w http.ResponseWriter, req *http.Request) {
+		user, err := a.ExtractUser(req)
+
+		if err != nil || user.Group != GroupAdmin {
+			forbidden(w, "Admin permissions required")
 			return
 		}
 
-		var user User
-		claims.ToStruct(&user)
+		next(w, req)
+	})
+}
 
-		if next != nil {
-			ctx := context.WithValue(req.Context(), &userKey{}, user)
-			next(w, req.WithContext(ctx))
+// ModeratorMiddleware authenticates the user like Middleware and additionally
+// requires the user to be a moderator or admin.
+func (a *AuthService) ModeratorMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return a.Middleware(func(w http.ResponseWriter, req *http.Request) {
+		user, err := a.ExtractUser(req)
+
+		if err != nil || !user.IsModerator() {
+			forbidden(w, "Moderator permissions required")
+			return
 		}
+
+		next(w, req)
 	})
 }
 
+func forbidden(w http.ResponseWriter, reason string) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(Exception{reason})
+}
+
 func unauthorized(w http.ResponseWriter, reason string) {
 	w.WriteHeader(http.StatusUnauthorized)
 	w.Header().Add("content-type", "application/json")
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlobStore runs put, get and delete against store
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	key := "attachments/60d3024837289a35c65874b0/original.png"
+
+	err := store.Put(ctx, key, strings.NewReader("first"), 5, "image/png")
+	if err != nil {
+		t.Fatal("put:", err)
+	}
+
+	// putting again replaces the blob
+	err = store.Put(ctx, key, strings.NewReader("second"), 6, "image/png")
+	if err != nil {
+		t.Fatal("put again:", err)
+	}
+
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal("get:", err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+
+	if err != nil || string(data) != "second" {
+		t.Fatalf("get: got %q, %v, want %q", data, err, "second")
+	}
+
+	err = store.Delete(ctx, key)
+	if err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	if _, err := store.Get(ctx, key); err != ErrBlobNotFound {
+		t.Fatalf("get after delete: got %v, want ErrBlobNotFound", err)
+	}
+
+	// deleting a missing blob isn't an error
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal("delete again:", err)
+	}
+
+	for _, key := range []string{"", "../x", "a/../../x", "..", "/"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err != ErrInvalidBlobKey {
+			t.Errorf("put %q: got %v, want ErrInvalidBlobKey", key, err)
+		}
+
+		if _, err := store.Get(ctx, key); err != ErrInvalidBlobKey {
+			t.Errorf("get %q: got %v, want ErrInvalidBlobKey", key, err)
+		}
+
+		if err := store.Delete(ctx, key); err != ErrInvalidBlobKey {
+			t.Errorf("delete %q: got %v, want ErrInvalidBlobKey", key, err)
+		}
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "store")
+	testBlobStore(t, NewLocalBlobStore(dir))
+
+	// nothing has been written next to the store
+	entries, err := ioutil.ReadDir(root)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "store" {
+		t.Errorf("files outside the store: %v, %v", entries, err)
+	}
+}
+
+// s3StandIn is a minimal S3 server keeping objects in memory. It refuses
+// requests, which aren't signed for its credentials.
+type s3StandIn struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	prefix := "AWS4-HMAC-SHA256 Credential=AKID/" + time.Now().UTC().Format("20060102") + "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+
+	if !strings.HasPrefix(auth, prefix) || req.Header.Get("X-Amz-Content-Sha256") != unsignedPayload || req.Header.Get("X-Amz-Date") == "" {
+		s.t.Errorf("%s %s: unexpected signature headers %q", req.Method, req.URL, auth)
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	// the path is sent encoded like in the canonical request
+	if req.URL.EscapedPath() != s3EscapePath(req.URL.Path) {
+		s.t.Errorf("path %q isn't canonically encoded", req.URL.EscapedPath())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.ContentLength != int64(len(body)) || req.Header.Get("Content-Type") == "" {
+			s.t.Errorf("put %s: content length %d for %d bytes, type %q", req.URL.Path, req.ContentLength, len(body), req.Header.Get("Content-Type"))
+		}
+		s.objects[req.URL.Path] = string(body)
+	case http.MethodGet:
+		body, ok := s.objects[req.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	case http.MethodDelete:
+		delete(s.objects, req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	standIn := &s3StandIn{t: t, objects: map[string]string{}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	store, err := NewS3BlobStore(server.URL, "gofeed", "us-east-1", "AKID", "SECRET", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBlobStore(t, store)
+
+	// objects are stored in the bucket
+	store.Put(context.Background(), "a b.png", strings.NewReader("x"), 1, "image/png")
+	if _, ok := standIn.objects["/gofeed/a b.png"]; !ok {
+		t.Errorf("object not stored in bucket: %v", standIn.objects)
+	}
+}
+
+func TestS3Sign(t *testing.T) {
+	store, err := NewS3BlobStore("http://localhost:9000", "gofeed", "us-east-1", "AKID", "SECRET", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost:9000/gofeed/attachments/a%20b.png", nil)
+	store.sign(req, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	// computed independently from the AWS Signature Version 4 documentation
+	want := "AWS4-HMAC-SHA256 Credential=AKID/20210601/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=65543440416bc1801c1afb1289b1e8c52bef6e64b9cf3ed172d85f9af31d020a"
+
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	if got := req.Header.Get("X-Amz-Date"); got != "20210601T120000Z" {
+		t.Errorf("X-Amz-Date: got %s", got)
+	}
+}
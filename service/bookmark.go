@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BookmarkService lets users save messages for later, optionally sorted into
+// named collections. Bookmarks are private.
+type BookmarkService struct {
+	p  *persistence.BookmarkPersistor
+	ms *MessageService
+}
+
+// BookmarkPage is a page of bookmarks. Next is the cursor of the following
+// page, it's empty on the last page.
+type BookmarkPage struct {
+	Bookmarks []persistence.Bookmark `json:"bookmarks"`
+	Next      string                 `json:"next,omitempty"`
+}
+
+const (
+	maxCollectionLength = 50
+	maxBookmarkPage     = 100
+)
+
+var (
+	ErrBookmarkUnpublished = errors.New("Nur veröffentlichte Beiträge können gespeichert werden.")
+	ErrInvalidCollection   = fmt.Errorf("Der Name einer Sammlung darf höchstens %d Zeichen lang sein.", maxCollectionLength)
+	ErrInvalidCursor       = errors.New("invalid cursor")
+)
+
+func NewBookmarkService(p *persistence.BookmarkPersistor, ms *MessageService) *BookmarkService {
+	return &BookmarkService{p, ms}
+}
+
+// Bookmark saves a message for the user in ctx in a collection ("" for none).
+// Bookmarking a message again moves it to the collection.
+func (s *BookmarkService) Bookmark(ctx context.Context, id string, collection string) (*persistence.Bookmark, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection = strings.TrimSpace(collection)
+
+	if utf8.RuneCountInString(collection) > maxCollectionLength {
+		return nil, ErrInvalidCollection
+	}
+
+	message, err := s.ms.GetMessageById(ctx, id)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if message.Status != "" {
+		return nil, ErrBookmarkUnpublished
+	}
+
+	bookmark, err := s.p.Put(ctx, persistence.Bookmark{
+		UserID:     user.UserID,
+		MessageID:  message.MessageID,
+		Collection: collection,
+		Created:    helper.GetCurrentTimeMillies(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	bookmark.Message = message
+	return bookmark, nil
+}
+
+// RemoveBookmark removes a bookmark of the user in ctx.
+func (s *BookmarkService) RemoveBookmark(ctx context.Context, id string) error {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return ErrInvalidObjectID
+	}
+
+	return s.p.Remove(ctx, user.UserID, oid)
+}
+
+// GetBookmarks returns a page of the bookmarks of the user in ctx, the newest
+// first. A nil collection returns the bookmarks of every collection, "" those
+// without collection. Bookmarks of messages, which aren't available to the
+// user anymore (e.g. held by moderation or written by a user who has blocked
+// them), are returned without message, so they can still be removed.
+func (s *BookmarkService) GetBookmarks(ctx context.Context, collection *string, cursor string, limit int64) (*BookmarkPage, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var after *primitive.ObjectID
+
+	if cursor != "" {
+		oid, err := primitive.ObjectIDFromHex(cursor)
+
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		after = &oid
+	}
+
+	if limit <= 0 || limit > maxBookmarkPage {
+		limit = maxBookmarkPage
+	}
+
+	bookmarks, err := s.p.FindByUser(ctx, user.UserID, collection, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page := &BookmarkPage{Bookmarks: *bookmarks}
+
+	if len(page.Bookmarks) == 0 {
+		return page, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(page.Bookmarks))
+	for i, b := range page.Bookmarks {
+		ids[i] = b.MessageID
+	}
+
+	messages, err := s.ms.GetMessagesByIds(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[primitive.ObjectID]*persistence.Message{}
+	for i := range messages {
+		byId[messages[i].MessageID] = &messages[i]
+	}
+
+	for i := range page.Bookmarks {
+		page.Bookmarks[i].Message = byId[page.Bookmarks[i].MessageID]
+	}
+
+	if int64(len(page.Bookmarks)) == limit {
+		page.Next = page.Bookmarks[len(page.Bookmarks)-1].BookmarkID.Hex()
+	}
+
+	return page, nil
+}
+
+// GetCollections returns the named collections of the user in ctx.
+func (s *BookmarkService) GetCollections(ctx context.Context) (*[]persistence.BookmarkCollection, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.p.Collections(ctx, user.UserID)
+}
+
+// OnMessageEvent removes the bookmarks of deleted messages. Messages, which
+// only aren't public anymore, keep their bookmarks, they may be published again.
+// It's meant to be registered with MessageService.Subscribe.
+func (s *BookmarkService) OnMessageEvent(e MessageEvent) {
+	if e.Type != EventMessageDeleted {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		_, err := s.ms.p.FindById(ctx, e.Message.MessageID.Hex())
+
+		if err != mongo.ErrNoDocuments {
+			return
+		}
+
+		err = s.p.DeleteByMessage(ctx, e.Message.MessageID)
+
+		if err != nil {
+			log.Println("bookmark: couldn't remove bookmarks of deleted message:", err)
+		}
+	}()
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DraftService manages the drafts of the user in ctx and publishes scheduled
+// drafts once they are due. Every instance runs the scheduler, a lease in the
+// draft makes sure only one of them publishes it.
+type DraftService struct {
+	p        *persistence.DraftPersistor
+	ms       *MessageService
+	owner    string
+	interval time.Duration
+}
+
+// DraftUpdate creates or changes a draft, fields left nil aren't changed.
+// A PublishAt of 0 turns a scheduled draft back into a draft.
+type DraftUpdate struct {
+	Content     *string                   `json:"content"`
+	ReplyTo     *primitive.ObjectID       `json:"replyTo"`
+	Attachments *[]persistence.Attachment `json:"attachments"`
+	PublishAt   *int64                    `json:"publishAt"`
+}
+
+const (
+	// draftLease is how long an instance may take to publish a draft before
+	// another one takes over
+	draftLease = 2 * time.Minute
+
+	// maxScheduleAhead limits how far in advance messages can be scheduled
+	maxScheduleAhead = 365 * 24 * time.Hour
+)
+
+var (
+	ErrDraftLocked     = errors.New("Dieser Beitrag wird gerade veröffentlicht.")
+	ErrPublishAtPast   = errors.New("Der Zeitpunkt der Veröffentlichung muss in der Zukunft liegen.")
+	ErrPublishAtFuture = fmt.Errorf("Beiträge können höchstens %d Tage im Voraus geplant werden.", int(maxScheduleAhead.Hours()/24))
+)
+
+// NewDraftService creates the service, due drafts are looked for every interval.
+func NewDraftService(p *persistence.DraftPersistor, ms *MessageService, interval time.Duration) *DraftService {
+	return &DraftService{p, ms, leaseOwner(), interval}
+}
+
+// leaseOwner identifies this instance
+func leaseOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 6)
+	rand.Read(b)
+
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// GetDrafts lists the drafts of the user in ctx, see DraftPersistor.FindByAuthor.
+func (s *DraftService) GetDrafts(ctx context.Context, scheduled *bool, limit int64, skip int64) (*[]persistence.Draft, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.p.FindByAuthor(ctx, user.UserID, scheduled, limit, skip)
+}
+
+func (s *DraftService) GetDraft(ctx context.Context, id string) (*persistence.Draft, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	draft, err := s.p.FindById(ctx, id, user.UserID)
+	return draft, translateError(err)
+}
+
+// CreateDraft stores a draft, which is scheduled if update has a PublishAt.
+func (s *DraftService) CreateDraft(ctx context.Context, update DraftUpdate) (*persistence.Draft, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := helper.GetCurrentTimeMillies()
+	draft := persistence.Draft{AuthorID: user.UserID, Created: now, Updated: now, Version: 1}
+
+	err = s.apply(ctx, &draft, update, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.p.Create(ctx, draft)
+}
+
+// UpdateDraft changes a draft, unless it is being published. An error of an
+// earlier attempt to publish it is removed.
+func (s *DraftService) UpdateDraft(ctx context.Context, id string, update DraftUpdate) (*persistence.Draft, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	draft, err := s.p.FindById(ctx, id, user.UserID)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	now := helper.GetCurrentTimeMillies()
+	err = s.apply(ctx, draft, update, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{"content": draft.Content, "attachments": draft.Attachments, "updated": now}
+	unset := bson.M{"error": nil}
+
+	if draft.ReplyTo != nil {
+		set["replyTo"] = draft.ReplyTo
+	}
+
+	if draft.PublishAt != nil {
+		set["publishAt"] = draft.PublishAt
+	} else {
+		unset["publishAt"] = nil
+	}
+
+	draft, err = s.p.Update(ctx, id, user.UserID, set, unset, now)
+	return draft, translateError(err)
+}
+
+// apply validates update and applies it to draft
+func (s *DraftService) apply(ctx context.Context, draft *persistence.Draft, update DraftUpdate, now int64) error {
+	if update.Content != nil {
+		draft.Content = *update.Content
+	}
+
+	if update.ReplyTo != nil {
+		// only visible messages can be replied to
+		_, err := s.ms.GetMessageById(ctx, update.ReplyTo.Hex())
+
+		if err == mongo.ErrNoDocuments {
+			return ErrReplyNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		draft.ReplyTo = update.ReplyTo
+	}
+
+	if update.Attachments != nil {
+		message := persistence.Message{AuthorID: draft.AuthorID, Attachments: *update.Attachments}
+		_, err := s.ms.resolveAttachments(ctx, &message)
+
+		if err != nil {
+			return translateError(err)
+		}
+
+		draft.Attachments = message.Attachments
+	}
+
+	if update.PublishAt != nil {
+		switch publishAt := *update.PublishAt; {
+		case publishAt == 0:
+			draft.PublishAt = nil
+		case publishAt <= now:
+			return ErrPublishAtPast
+		case publishAt > now+maxScheduleAhead.Milliseconds():
+			return ErrPublishAtFuture
+		default:
+			draft.PublishAt = &publishAt
+		}
+	}
+
+	return nil
+}
+
+// DeleteDraft removes a draft or cancels a scheduled one, unless it is being
+// published.
+func (s *DraftService) DeleteDraft(ctx context.Context, id string) error {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return translateError(s.p.Delete(ctx, id, user.UserID, helper.GetCurrentTimeMillies()))
+}
+
+// PublishDraft publishes a draft of the user in ctx immediately.
+func (s *DraftService) PublishDraft(ctx context.Context, id string) (*persistence.Message, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	now := helper.GetCurrentTimeMillies()
+	draft, err := s.p.Claim(ctx, bson.M{"_id": oid, "authorId": user.UserID}, s.owner, now, now+draftLease.Milliseconds())
+
+	if err == mongo.ErrNoDocuments {
+		// the draft doesn't exist or is locked by another instance
+		if _, err := s.p.FindById(ctx, id, user.UserID); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrDraftLocked
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.publish(ctx, draft)
+}
+
+// Run publishes due drafts until ctx is cancelled.
+func (s *DraftService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		for s.publishNext(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishNext publishes the next due draft and reports whether there may be more
+func (s *DraftService) publishNext(ctx context.Context) bool {
+	now := helper.GetCurrentTimeMillies()
+	draft, err := s.p.Claim(ctx, nil, s.owner, now, now+draftLease.Milliseconds())
+
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+
+	if err != nil {
+		log.Println("draft: couldn't claim due drafts:", err)
+		return false
+	}
+
+	_, err = s.publish(ctx, draft)
+
+	if err != nil {
+		log.Printf("draft: couldn't publish %s: %v\n", draft.DraftID.Hex(), err)
+	}
+
+	// a failed draft doesn't keep the others waiting
+	return true
+}
+
+// publish creates the message of a claimed draft and removes the draft. The
+// id of the message is reserved first, so a draft, which has been published
+// by an instance that crashed before removing it, isn't published twice.
+// Drafts, which can't be published, are turned back into drafts with the
+// reason, the lease of others expires and they are tried again.
+func (s *DraftService) publish(ctx context.Context, draft *persistence.Draft) (*persistence.Message, error) {
+	if draft.MessageID == nil {
+		mid := primitive.NewObjectID()
+		err := s.p.ReserveMessageID(ctx, draft.DraftID, s.owner, mid)
+
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		draft.MessageID = &mid
+	} else {
+		published, err := s.ms.findByIds(ctx, []primitive.ObjectID{*draft.MessageID})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if message, ok := published[*draft.MessageID]; ok {
+			return message, s.p.Complete(ctx, draft.DraftID, s.owner)
+		}
+	}
+
+	message, err := s.ms.CreateMessage(ctx, persistence.Message{
+		MessageID:   *draft.MessageID,
+		AuthorID:    draft.AuthorID,
+		Content:     draft.Content,
+		ReplyTo:     draft.ReplyTo,
+		Attachments: draft.Attachments,
+	})
+
+	if isPermanent(err) {
+		if failErr := s.p.Fail(ctx, draft.DraftID, s.owner, err.Error()); failErr != nil {
+			log.Printf("draft: couldn't mark %s as failed: %v\n", draft.DraftID.Hex(), failErr)
+		}
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return message, s.p.Complete(ctx, draft.DraftID, s.owner)
+}
+
+// isPermanent reports whether publishing a draft has failed for a reason,
+// which doesn't go away by trying again
+func isPermanent(err error) bool {
+	var violation *PolicyViolation
+
+	switch {
+	case err == ErrReplyNotFound, err == ErrInvalidAttachment, err == ErrTooManyAttachments, err == persistence.ErrMissingContent:
+		return true
+	default:
+		return errors.As(err, &violation)
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// deferredEvents collects the events emitted within a transaction
+type deferredEvents struct {
+	mu     sync.Mutex
+	notify []func()
+}
+
+type deferredEventsKey struct{}
+
+// DeferEvents returns a context in which events aren't passed to listeners
+// immediately. They are held back until release is called, which passes them
+// on if publish is true and drops them otherwise. This keeps listeners from
+// acting on writes of a transaction, which is rolled back afterwards.
+func DeferEvents(ctx context.Context) (context.Context, func(publish bool)) {
+	d := &deferredEvents{}
+
+	release := func(publish bool) {
+		d.mu.Lock()
+		notify := d.notify
+		d.notify = nil
+		d.mu.Unlock()
+
+		if !publish {
+			return
+		}
+
+		for _, n := range notify {
+			n()
+		}
+	}
+
+	return context.WithValue(ctx, deferredEventsKey{}, d), release
+}
+
+// dispatch calls notify now, or when the events of ctx are released, see DeferEvents
+func dispatch(ctx context.Context, notify func()) {
+	d, ok := ctx.Value(deferredEventsKey{}).(*deferredEvents)
+
+	if !ok {
+		notify()
+		return
+	}
+
+	d.mu.Lock()
+	d.notify = append(d.notify, notify)
+	d.mu.Unlock()
+}
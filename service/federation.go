@@ -0,0 +1,753 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// FederationService makes users followable from ActivityPub servers (e.g. Mastodon).
+// Every user is published as a Person actor, messages are published as Notes.
+type FederationService struct {
+	p      *persistence.FederationPersistor
+	us     *UserService
+	ms     *MessageService
+	client *http.Client
+}
+
+const (
+	ActivityContentType = "application/activity+json"
+	activityStreamsNS   = "https://www.w3.org/ns/activitystreams"
+	securityNS          = "https://w3id.org/security/v1"
+	publicCollection    = "https://www.w3.org/ns/activitystreams#Public"
+	outboxSize          = 20
+	maxRemoteDocument   = 1 << 20
+	deliveryTimeout     = 30 * time.Second
+)
+
+var (
+	ErrUnknownResource = errors.New("unknown resource")
+	ErrActorMismatch   = errors.New("activity actor doesn't match signature")
+	ErrInvalidActivity = errors.New("invalid activity")
+	ErrUnverified      = errors.New("signature couldn't be verified")
+)
+
+// Actor is an ActivityPub actor, used for local as well as remote actors.
+type Actor struct {
+	Context           []string        `json:"@context,omitempty"`
+	ID                string          `json:"id"`
+	Type              string          `json:"type"`
+	PreferredUsername string          `json:"preferredUsername,omitempty"`
+	Name              string          `json:"name,omitempty"`
+	URL               string          `json:"url,omitempty"`
+	Inbox             string          `json:"inbox"`
+	Outbox            string          `json:"outbox,omitempty"`
+	Followers         string          `json:"followers,omitempty"`
+	Icon              *ActivityImage  `json:"icon,omitempty"`
+	PublicKey         ActorPublicKey  `json:"publicKey"`
+	Endpoints         *ActorEndpoints `json:"endpoints,omitempty"`
+}
+
+type ActorPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type ActorEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type ActivityImage struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// Note is the ActivityPub representation of a message.
+type Note struct {
+	Context      string              `json:"@context,omitempty"`
+	ID           string              `json:"id"`
+	Type         string              `json:"type"`
+	AttributedTo string              `json:"attributedTo,omitempty"`
+	Content      string              `json:"content,omitempty"`
+	Published    string              `json:"published,omitempty"`
+	Updated      string              `json:"updated,omitempty"`
+	To           []string            `json:"to,omitempty"`
+	Cc           []string            `json:"cc,omitempty"`
+	Likes        *ActivityCollection `json:"likes,omitempty"`
+
+	// QuoteURL is the quoted note, as understood by Misskey and Pleroma
+	QuoteURL string `json:"quoteUrl,omitempty"`
+}
+
+// Activity is an outgoing activity.
+type Activity struct {
+	Context string      `json:"@context,omitempty"`
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Actor   string      `json:"actor"`
+	Object  interface{} `json:"object"`
+	To      []string    `json:"to,omitempty"`
+	Cc      []string    `json:"cc,omitempty"`
+}
+
+// ActivityCollection is used for outboxes, followers and likes.
+type ActivityCollection struct {
+	Context      string        `json:"@context,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	TotalItems   int64         `json:"totalItems"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// incomingActivity is an activity received in an inbox. The object can be an
+// id or an embedded object, therefore it's decoded lazily.
+type incomingActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// NewFederationService creates the service. Actors and inboxes are given by
+// remote servers, client should only connect to public addresses, see
+// NewPublicClient.
+func NewFederationService(p *persistence.FederationPersistor, us *UserService, ms *MessageService, client *http.Client) *FederationService {
+	return &FederationService{p, us, ms, client}
+}
+
+// --- local actors and objects ---
+
+func baseURL() string {
+	return strings.TrimSuffix(os.Getenv("CALLBACK"), "/")
+}
+
+func ActorURL(user string) string {
+	return baseURL() + "/ap/users/" + user
+}
+
+func NoteURL(message string) string {
+	return baseURL() + "/ap/notes/" + message
+}
+
+func (s *FederationService) GetActor(ctx context.Context, id string) (*Actor, error) {
+	user, err := s.us.GetUserInfo(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.actorKey(ctx, user.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	actorURL := ActorURL(user.UserID.Hex())
+
+	actor := &Actor{
+		Context:           []string{activityStreamsNS, securityNS},
+		ID:                actorURL,
+		Type:              "Person",
+		PreferredUsername: user.UserID.Hex(),
+		Name:              user.Name,
+		URL:               baseURL() + "/user/" + user.UserID.Hex(),
+		Inbox:             actorURL + "/inbox",
+		Outbox:            actorURL + "/outbox",
+		Followers:         actorURL + "/followers",
+		PublicKey:         ActorPublicKey{actorURL + "#main-key", actorURL, key.PublicKey},
+	}
+
+	if user.Avatar != "" {
+		actor.Icon = &ActivityImage{"Image", user.Avatar}
+	}
+
+	return actor, nil
+}
+
+// GetOutbox returns the latest Create activities of a user.
+func (s *FederationService) GetOutbox(ctx context.Context, id string) (*ActivityCollection, error) {
+	user, err := s.us.GetUserInfo(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := s.ms.GetLatestMessages(ctx, user.UserID.Hex(), outboxSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	outbox := &ActivityCollection{
+		Context:      activityStreamsNS,
+		ID:           ActorURL(user.UserID.Hex()) + "/outbox",
+		Type:         "OrderedCollection",
+		TotalItems:   int64(len(*messages)),
+		OrderedItems: []interface{}{},
+	}
+
+	for i := range *messages {
+		activity := s.createActivity(&(*messages)[i])
+		activity.Context = ""
+		outbox.OrderedItems = append(outbox.OrderedItems, activity)
+	}
+
+	return outbox, nil
+}
+
+// GetFollowers only exposes the number of followers, not who they are.
+func (s *FederationService) GetFollowers(ctx context.Context, id string) (*ActivityCollection, error) {
+	user, err := s.us.GetUserInfo(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := s.p.CountFollowers(ctx, user.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ActivityCollection{
+		Context:    activityStreamsNS,
+		ID:         ActorURL(user.UserID.Hex()) + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: count,
+	}, nil
+}
+
+func (s *FederationService) GetNote(ctx context.Context, id string) (*Note, error) {
+	message, err := s.ms.GetMessageById(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	likes, err := s.p.CountLikes(ctx, message.MessageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	note := toNote(message)
+	note.Context = activityStreamsNS
+	note.Likes = &ActivityCollection{ID: note.ID + "/likes", Type: "Collection", TotalItems: likes}
+
+	return note, nil
+}
+
+// WebFinger resolves acct:{userId}@{host} or an actor URL to the actor.
+func (s *FederationService) WebFinger(ctx context.Context, resource string) (*WebFinger, error) {
+	base, err := url.Parse(baseURL())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+
+	switch {
+	case strings.HasPrefix(resource, "acct:"):
+		parts := strings.SplitN(strings.TrimPrefix(resource, "acct:"), "@", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[1], base.Host) {
+			return nil, ErrUnknownResource
+		}
+		id = parts[0]
+	case strings.HasPrefix(resource, ActorURL("")):
+		id = strings.TrimPrefix(resource, ActorURL(""))
+	default:
+		return nil, ErrUnknownResource
+	}
+
+	user, err := s.us.GetUserInfo(ctx, id)
+
+	if err != nil {
+		return nil, ErrUnknownResource
+	}
+
+	actorURL := ActorURL(user.UserID.Hex())
+
+	return &WebFinger{
+		Subject: "acct:" + user.UserID.Hex() + "@" + base.Host,
+		Aliases: []string{actorURL},
+		Links: []WebFingerLink{
+			{Rel: "self", Type: ActivityContentType, Href: actorURL},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: baseURL() + "/user/" + user.UserID.Hex()},
+		},
+	}, nil
+}
+
+func toNote(message *persistence.Message) *Note {
+	actorURL := ActorURL(message.AuthorID.Hex())
+
+	return &Note{
+		ID:           NoteURL(message.MessageID.Hex()),
+		Type:         "Note",
+		AttributedTo: actorURL,
+		Content:      MessageHTML(message),
+		Published:    millisToRFC3339(message.Created),
+		Updated:      millisToRFC3339(message.Updated),
+		To:           []string{publicCollection},
+		Cc:           []string{actorURL + "/followers"},
+		QuoteURL:     quoteURL(message),
+	}
+}
+
+func quoteURL(message *persistence.Message) string {
+	if message.QuoteOf == nil {
+		return ""
+	}
+
+	return NoteURL(message.QuoteOf.Hex())
+}
+
+// createActivity announces reposts and creates the note of other messages
+func (s *FederationService) createActivity(message *persistence.Message) *Activity {
+	if message.RepostOf == nil {
+		return s.noteActivity("Create", message)
+	}
+
+	actorURL := ActorURL(message.AuthorID.Hex())
+
+	return &Activity{
+		Context: activityStreamsNS,
+		ID:      NoteURL(message.MessageID.Hex()) + "/activity",
+		Type:    "Announce",
+		Actor:   actorURL,
+		Object:  NoteURL(message.RepostOf.Hex()),
+		To:      []string{publicCollection},
+		Cc:      []string{actorURL + "/followers"},
+	}
+}
+
+func (s *FederationService) noteActivity(activityType string, message *persistence.Message) *Activity {
+	note := toNote(message)
+
+	id := note.ID + "/activity"
+	if activityType != "Create" {
+		id = fmt.Sprintf("%s#%s-%d", note.ID, strings.ToLower(activityType), message.Version)
+	}
+
+	return &Activity{
+		Context: activityStreamsNS,
+		ID:      id,
+		Type:    activityType,
+		Actor:   note.AttributedTo,
+		Object:  note,
+		To:      note.To,
+		Cc:      note.Cc,
+	}
+}
+
+func millisToRFC3339(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+// actorKey returns the key pair of a user, it's generated on first use.
+func (s *FederationService) actorKey(ctx context.Context, user primitive.ObjectID) (*persistence.ActorKey, error) {
+	key, err := s.p.FindKey(ctx, user)
+
+	if err != mongo.ErrNoDocuments {
+		return key, err
+	}
+
+	public, private, err := GenerateKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.p.CreateKey(ctx, persistence.ActorKey{UserID: user, PublicKey: public, PrivateKey: private})
+}
+
+// --- outgoing activities ---
+
+// OnMessageEvent publishes message events to the followers of the author.
+// It's meant to be registered with MessageService.Subscribe.
+func (s *FederationService) OnMessageEvent(e MessageEvent) {
+	var activity *Activity
+
+	switch e.Type {
+	case EventMessageCreated:
+		activity = s.createActivity(e.Message)
+	case EventMessageUpdated:
+		activity = s.noteActivity("Update", e.Message)
+	case EventMessageDeleted:
+		activity = s.deleteActivity(e.Message)
+	default:
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		defer cancel()
+
+		if e.Type == EventMessageDeleted {
+			if err := s.p.DeleteLikes(ctx, e.Message.MessageID); err != nil {
+				log.Println("federation: couldn't delete likes:", err)
+			}
+		}
+
+		s.deliverToFollowers(ctx, e.Message.AuthorID, activity)
+	}()
+}
+
+// deleteActivity undoes the announcement of reposts and deletes the note of other messages
+func (s *FederationService) deleteActivity(message *persistence.Message) *Activity {
+	if message.RepostOf != nil {
+		announce := s.createActivity(message)
+		announce.Context = ""
+
+		return &Activity{
+			Context: activityStreamsNS,
+			ID:      announce.ID + "#undo",
+			Type:    "Undo",
+			Actor:   announce.Actor,
+			Object:  announce,
+			To:      announce.To,
+			Cc:      announce.Cc,
+		}
+	}
+
+	note := toNote(message)
+
+	return &Activity{
+		Context: activityStreamsNS,
+		ID:      note.ID + "#delete",
+		Type:    "Delete",
+		Actor:   note.AttributedTo,
+		Object:  Note{ID: note.ID, Type: "Tombstone"},
+		To:      note.To,
+		Cc:      note.Cc,
+	}
+}
+
+func (s *FederationService) deliverToFollowers(ctx context.Context, user primitive.ObjectID, activity interface{}) {
+	followers, err := s.p.FindFollowers(ctx, user)
+
+	if err != nil {
+		log.Println("federation: couldn't load followers:", err)
+		return
+	}
+
+	// servers with a shared inbox only get the activity once
+	inboxes := map[string]bool{}
+	for _, f := range *followers {
+		if f.SharedInbox != "" {
+			inboxes[f.SharedInbox] = true
+		} else {
+			inboxes[f.Inbox] = true
+		}
+	}
+
+	for inbox := range inboxes {
+		if err := s.deliver(ctx, user, inbox, activity); err != nil {
+			log.Printf("federation: delivery to %s failed: %v\n", inbox, err)
+		}
+	}
+}
+
+// deliver posts an activity to an inbox, signed with the key of user.
+func (s *FederationService) deliver(ctx context.Context, user primitive.ObjectID, inbox string, activity interface{}) error {
+	key, err := s.actorKey(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	private, err := ParsePrivateKey(key.PrivateKey)
+
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(activity)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", ActivityContentType)
+
+	err = SignRequest(req, body, ActorURL(user.Hex())+"#main-key", private)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := s.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// --- incoming activities ---
+
+// HandleInbox verifies and processes an activity posted to the inbox of a user.
+// Follow, Undo (of Follow and Like) and Like are supported, other activities are ignored.
+func (s *FederationService) HandleInbox(ctx context.Context, id string, req *http.Request, body []byte) error {
+	user, err := s.us.GetUserInfo(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	var activity incomingActivity
+	if json.Unmarshal(body, &activity) != nil || activity.Actor == "" {
+		return ErrInvalidActivity
+	}
+
+	remote, err := s.verify(ctx, req, body)
+
+	if err != nil {
+		return err
+	}
+
+	if remote.ID != activity.Actor {
+		return ErrActorMismatch
+	}
+
+	switch activity.Type {
+	case "Follow":
+		return s.handleFollow(ctx, user, remote, activity, body)
+	case "Like":
+		return s.handleLike(ctx, remote, activity.ID, objectID(activity.Object))
+	case "Undo":
+		var undone incomingActivity
+		if json.Unmarshal(activity.Object, &undone) != nil {
+			// only the id has been sent, the type is unknown
+			return s.p.RemoveLike(ctx, objectID(activity.Object), remote.ID, primitive.NilObjectID)
+		}
+
+		if undone.Actor != "" && undone.Actor != remote.ID {
+			return ErrActorMismatch
+		}
+
+		switch undone.Type {
+		case "Follow":
+			return s.p.RemoveFollower(ctx, user.UserID, remote.ID)
+		case "Like":
+			mid, _ := messageIDFromNote(objectID(undone.Object))
+			return s.p.RemoveLike(ctx, undone.ID, remote.ID, mid)
+		}
+	}
+
+	return nil
+}
+
+func (s *FederationService) handleFollow(ctx context.Context, user *UserInfo, remote *Actor, activity incomingActivity, body []byte) error {
+	actorURL := ActorURL(user.UserID.Hex())
+
+	if objectID(activity.Object) != actorURL {
+		return ErrInvalidActivity
+	}
+
+	follower := persistence.Follower{
+		UserID:  user.UserID,
+		Actor:   remote.ID,
+		Inbox:   remote.Inbox,
+		Created: helper.GetCurrentTimeMillies(),
+	}
+
+	if remote.Endpoints != nil {
+		follower.SharedInbox = remote.Endpoints.SharedInbox
+	}
+
+	err := s.p.AddFollower(ctx, follower)
+
+	if err != nil {
+		return err
+	}
+
+	accept := &Activity{
+		Context: activityStreamsNS,
+		ID:      fmt.Sprintf("%s#accept-%d", actorURL, helper.GetCurrentTimeMillies()),
+		Type:    "Accept",
+		Actor:   actorURL,
+		Object:  json.RawMessage(body),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		defer cancel()
+
+		if err := s.deliver(ctx, user.UserID, remote.Inbox, accept); err != nil {
+			log.Printf("federation: accept to %s failed: %v\n", remote.Inbox, err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *FederationService) handleLike(ctx context.Context, remote *Actor, activityID string, object string) error {
+	mid, ok := messageIDFromNote(object)
+
+	if !ok || activityID == "" {
+		return ErrInvalidActivity
+	}
+
+	if _, err := s.ms.GetMessageById(ctx, mid.Hex()); err != nil {
+		return err
+	}
+
+	return s.p.AddLike(ctx, persistence.Like{
+		ActivityID: activityID,
+		MessageID:  mid,
+		Actor:      remote.ID,
+		Created:    helper.GetCurrentTimeMillies(),
+	})
+}
+
+// verify checks the HTTP signature of an inbox request and returns the signing actor.
+func (s *FederationService) verify(ctx context.Context, req *http.Request, body []byte) (*Actor, error) {
+	var remote *Actor
+
+	_, err := VerifyRequest(req, body, func(keyID string) (*rsa.PublicKey, error) {
+		actor, err := s.fetchActor(ctx, keyID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if actor.PublicKey.ID != keyID {
+			return nil, ErrInvalidKey
+		}
+
+		remote = actor
+		return ParsePublicKey(actor.PublicKey.PublicKeyPem)
+	})
+
+	// the reason stays in the log, it may tell about our network
+	if err != nil {
+		log.Println("federation: couldn't verify inbox request:", err)
+		return nil, ErrUnverified
+	}
+
+	return remote, nil
+}
+
+// fetchActor loads a remote actor. Key ids usually point to the actor document
+// with a fragment, which isn't sent to the server. The actor has to be hosted
+// on the server it was fetched from, otherwise anybody could claim others'
+// actors for their own key.
+func (s *FederationService) fetchActor(ctx context.Context, id string) (*Actor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", ActivityContentType)
+
+	res, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching actor %s: unexpected status %s", id, res.Status)
+	}
+
+	var actor Actor
+	err = json.NewDecoder(io.LimitReader(res.Body, maxRemoteDocument)).Decode(&actor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if actor.ID == "" || actor.Inbox == "" || actor.PublicKey.Owner != actor.ID || !sameOrigin(actor.ID, id) {
+		return nil, ErrInvalidKey
+	}
+
+	return &actor, nil
+}
+
+// sameOrigin tells whether both URLs have the same scheme, host and port.
+func sameOrigin(a string, b string) bool {
+	ua, err := url.Parse(a)
+
+	if err != nil {
+		return false
+	}
+
+	ub, err := url.Parse(b)
+
+	if err != nil {
+		return false
+	}
+
+	return ua.Host != "" && strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// objectID returns the id of an object, which may be embedded or referenced.
+func objectID(raw json.RawMessage) string {
+	var id string
+	if json.Unmarshal(raw, &id) == nil {
+		return id
+	}
+
+	var object struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(raw, &object)
+
+	return object.ID
+}
+
+func messageIDFromNote(note string) (primitive.ObjectID, bool) {
+	if !strings.HasPrefix(note, NoteURL("")) {
+		return primitive.NilObjectID, false
+	}
+
+	mid, err := primitive.ObjectIDFromHex(strings.TrimPrefix(note, NoteURL("")))
+	return mid, err == nil
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP Signatures (draft-cavage-http-signatures-12) as used by ActivityPub servers.
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidDigest    = errors.New("digest doesn't match body")
+	ErrSignatureExpired = errors.New("signature date out of range")
+	ErrInvalidKey       = errors.New("invalid key")
+)
+
+// signedHeaders are the headers covered by outgoing signatures
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// maxSignatureAge is the tolerated clock skew of signed requests
+const maxSignatureAge = time.Hour
+
+// SignRequest signs req with key. Date and Digest headers are set as well.
+func SignRequest(req *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", bodyDigest(body))
+
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(req, signedHeaders)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+
+	return nil
+}
+
+// VerifyRequest checks the signature of req. lookup resolves the keyId of the
+// signature to a public key. The verified keyId is returned.
+func VerifyRequest(req *http.Request, body []byte, lookup func(keyID string) (*rsa.PublicKey, error)) (string, error) {
+	params := parseSignatureHeader(req.Header.Get("Signature"))
+
+	keyID, sig := params["keyId"], params["signature"]
+	if keyID == "" || sig == "" {
+		return "", ErrMissingSignature
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	// request target, host, date and digest have to be covered by the signature
+	// to prevent replays (to other inboxes as well) and tampering
+	for _, h := range []string{"(request-target)", "host", "date"} {
+		if !contains(headers, h) {
+			return "", ErrInvalidSignature
+		}
+	}
+
+	if len(body) > 0 && !contains(headers, "digest") {
+		return "", ErrInvalidSignature
+	}
+
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil || time.Since(date) > maxSignatureAge || time.Until(date) > maxSignatureAge {
+		return "", ErrSignatureExpired
+	}
+
+	if contains(headers, "digest") && req.Header.Get("Digest") != bodyDigest(body) {
+		return "", ErrInvalidDigest
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	key, err := lookup(keyID)
+	if err != nil {
+		return "", err
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], decoded) != nil {
+		return "", ErrInvalidSignature
+	}
+
+	return keyID, nil
+}
+
+func signingString(req *http.Request, headers []string) string {
+	var b bytes.Buffer
+
+	for i, h := range headers {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		switch h {
+		case "(request-target)":
+			fmt.Fprintf(&b, "(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI())
+		case "host":
+			fmt.Fprintf(&b, "host: %s", req.Host)
+		default:
+			fmt.Fprintf(&b, "%s: %s", h, strings.Join(req.Header.Values(h), ", "))
+		}
+	}
+
+	return b.String()
+}
+
+func parseSignatureHeader(header string) map[string]string {
+	params := map[string]string{}
+
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	return params
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateKeyPair creates a new RSA key pair, PEM encoded.
+func GenerateKeyPair() (public string, private string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	public = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	private = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+
+	return public, private, nil
+}
+
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+
+	// PKCS1 keys are still used by some servers
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+func ParsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
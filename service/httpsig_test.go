@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeyID = "https://remote.example/users/alice#main-key"
+
+// signTest signs req like SignRequest, but with the given headers and date
+func signTest(t *testing.T, req *http.Request, body []byte, key *rsa.PrivateKey, headers []string, date time.Time) {
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", bodyDigest(body))
+
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		testKeyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"type":"Follow"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		headers []string
+		date    time.Time
+
+		// change modifies the request after signing it
+		change func(req *http.Request)
+		want   error
+	}{
+		{name: "valid", want: nil},
+		{name: "valid date skew", date: now.Add(-maxSignatureAge + time.Minute), want: nil},
+		{name: "other key", key: other, want: ErrInvalidSignature},
+		{name: "stale date", date: now.Add(-maxSignatureAge - time.Minute), want: ErrSignatureExpired},
+		{name: "future date", date: now.Add(maxSignatureAge + time.Minute), want: ErrSignatureExpired},
+		{name: "missing (request-target)", headers: []string{"host", "date", "digest"}, want: ErrInvalidSignature},
+		{name: "missing host", headers: []string{"(request-target)", "date", "digest"}, want: ErrInvalidSignature},
+		{name: "missing date", headers: []string{"(request-target)", "host", "digest"}, want: ErrInvalidSignature},
+		{name: "missing digest", headers: []string{"(request-target)", "host", "date"}, want: ErrInvalidSignature},
+		{
+			name:   "bad digest",
+			change: func(req *http.Request) { req.Header.Set("Digest", bodyDigest([]byte(`{"type":"Undo"}`))) },
+			want:   ErrInvalidDigest,
+		},
+		{
+			name:   "other inbox",
+			change: func(req *http.Request) { req.URL.Path = "/user/bob/inbox" },
+			want:   ErrInvalidSignature,
+		},
+		{
+			name:   "other host",
+			change: func(req *http.Request) { req.Host = "other.example" },
+			want:   ErrInvalidSignature,
+		},
+		{
+			name:   "missing signature",
+			change: func(req *http.Request) { req.Header.Del("Signature") },
+			want:   ErrMissingSignature,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, headers, date := test.key, test.headers, test.date
+
+			if signer == nil {
+				signer = key
+			}
+
+			if headers == nil {
+				headers = signedHeaders
+			}
+
+			if date.IsZero() {
+				date = now
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "https://local.example/user/alice/inbox", nil)
+			signTest(t, req, body, signer, headers, date)
+
+			if test.change != nil {
+				test.change(req)
+			}
+
+			keyID, err := VerifyRequest(req, body, func(keyID string) (*rsa.PublicKey, error) {
+				if keyID != testKeyID {
+					t.Errorf("lookup: got %q, want %q", keyID, testKeyID)
+				}
+
+				return &key.PublicKey, nil
+			})
+
+			if err != test.want {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+
+			if err == nil && keyID != testKeyID {
+				t.Errorf("key id: got %q, want %q", keyID, testKeyID)
+			}
+		})
+	}
+
+	// requests signed by SignRequest are accepted
+	req := httptest.NewRequest(http.MethodPost, "https://local.example/user/alice/inbox", nil)
+	if err := SignRequest(req, body, testKeyID, key); err != nil {
+		t.Fatal(err)
+	}
+
+	lookupErr := errors.New("unknown key")
+
+	if _, err := VerifyRequest(req, body, func(string) (*rsa.PublicKey, error) { return &key.PublicKey, nil }); err != nil {
+		t.Errorf("SignRequest: got %v, want nil", err)
+	}
+
+	if _, err := VerifyRequest(req, body, func(string) (*rsa.PublicKey, error) { return nil, lookupErr }); err != lookupErr {
+		t.Errorf("lookup error: got %v, want %v", err, lookupErr)
+	}
+}
+
+func TestFetchActorOrigin(t *testing.T) {
+	var actorID string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(Actor{
+			ID:        actorID,
+			Inbox:     actorID + "/inbox",
+			PublicKey: ActorPublicKey{ID: actorID + "#main-key", Owner: actorID},
+		})
+	}))
+
+	defer srv.Close()
+
+	s := &FederationService{client: srv.Client()}
+
+	tests := []struct {
+		name string
+		id   string
+		want error
+	}{
+		{"same document", srv.URL + "/users/alice", nil},
+		{"same host", srv.URL + "/actors/alice", nil},
+		{"other host", "https://victim.example/users/bob", ErrInvalidKey},
+		{"other scheme", strings.Replace(srv.URL, "http://", "https://", 1) + "/users/alice", ErrInvalidKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actorID = test.id
+
+			actor, err := s.fetchActor(context.Background(), srv.URL+"/users/alice#main-key")
+
+			if err != test.want {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+
+			if err == nil && actor.ID != test.id {
+				t.Errorf("id: got %q, want %q", actor.ID, test.id)
+			}
+		})
+	}
+}
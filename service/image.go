@@ -0,0 +1,408 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gofeed-go/persistence"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImageService processes images uploaded by users: it validates and decodes
+// them, applies and strips their metadata (EXIF, GPS, ...), and stores
+// resized variants and a blurhash placeholder. Variants are served from the
+// BlobStore, the original is never stored.
+type ImageService struct {
+	blobs     BlobStore
+	maxPixels int
+}
+
+// ImageInfo describes an image and its variants for clients, e.g. to build
+// an srcset.
+type ImageInfo struct {
+	Width    int            `json:"width"`
+	Height   int            `json:"height"`
+	Blurhash string         `json:"blurhash"`
+	Variants []ImageVariant `json:"variants"`
+	Srcset   string         `json:"srcset"`
+}
+
+type ImageVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// AvatarSizes are the edge lengths of the (square) avatar variants
+var AvatarSizes = []int{48, 96, 192, 400}
+
+// BannerSizes are the widths of the profile banner variants
+var BannerSizes = []int{600, 1200, 1500}
+
+var (
+	ErrInvalidImage  = errors.New("Das Bild konnte nicht gelesen werden (JPEG, PNG oder GIF).")
+	ErrImageTooLarge = errors.New("Das Bild hat zu viele Pixel.")
+)
+
+// jpegQuality is used for the variants of opaque images, others are stored as PNG
+const jpegQuality = 85
+
+// variantFile matches the file names of variants, e.g. 96.jpg
+var variantFile = regexp.MustCompile(`^[0-9]+\.(jpg|png)$`)
+
+// NewImageService creates the service. Images with more than maxPixels are
+// refused before they are decoded.
+func NewImageService(blobs BlobStore, maxPixels int) *ImageService {
+	return &ImageService{blobs, maxPixels}
+}
+
+// Store processes an image and stores a variant for each of sizes. Square
+// variants are cropped to the center, sizes are their edge length, otherwise
+// sizes are widths. Sizes larger than the image are skipped, images are never
+// enlarged.
+func (s *ImageService) Store(ctx context.Context, data []byte, sizes []int, square bool) (*persistence.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+
+	if config.Width*config.Height > s.maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	decoded, format, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	// drawing into a new image drops everything but the pixels
+	src := image.NewRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+
+	if format == "jpeg" {
+		src = orient(src, exifOrientation(data))
+	}
+
+	result := &persistence.Image{
+		ImageID: primitive.NewObjectID().Hex(),
+		Width:   src.Bounds().Dx(),
+		Height:  src.Bounds().Dy(),
+	}
+
+	if square {
+		src = cropSquare(src)
+	}
+
+	ext, contentType, encode := "png", "image/png", encodePNG
+	if src.Opaque() {
+		ext, contentType, encode = "jpg", "image/jpeg", encodeJPEG
+	}
+
+	for _, size := range variantSizes(sizes, src.Bounds().Dx()) {
+		variant := resize(src, size, size*src.Bounds().Dy()/src.Bounds().Dx())
+
+		var buf bytes.Buffer
+		err = encode(&buf, variant)
+
+		if err != nil {
+			return nil, err
+		}
+
+		file := strconv.Itoa(size) + "." + ext
+		err = s.blobs.Put(ctx, imageKey(result.ImageID, file), &buf, int64(buf.Len()), contentType)
+
+		if err != nil {
+			// don't leave the variants stored so far behind
+			s.Delete(ctx, result)
+			return nil, err
+		}
+
+		result.Variants = append(result.Variants, persistence.ImageVariant{Width: variant.Bounds().Dx(), Height: variant.Bounds().Dy(), File: file})
+
+		if result.Blurhash == "" {
+			result.Blurhash = blurhash(resize(variant, 32, max(1, 32*variant.Bounds().Dy()/variant.Bounds().Dx())), 4, 3)
+		}
+	}
+
+	return result, nil
+}
+
+// Open returns a variant of an image and its content type.
+func (s *ImageService) Open(ctx context.Context, id string, file string) (io.ReadCloser, string, error) {
+	if !primitive.IsValidObjectID(id) || !variantFile.MatchString(file) {
+		return nil, "", mongo.ErrNoDocuments
+	}
+
+	content, err := s.blobs.Get(ctx, imageKey(id, file))
+
+	if err == ErrBlobNotFound {
+		return nil, "", mongo.ErrNoDocuments
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.HasSuffix(file, ".png") {
+		return content, "image/png", nil
+	}
+
+	return content, "image/jpeg", nil
+}
+
+// Delete removes the variants of an image.
+func (s *ImageService) Delete(ctx context.Context, img *persistence.Image) error {
+	var failed error
+
+	for _, v := range img.Variants {
+		if err := s.blobs.Delete(ctx, imageKey(img.ImageID, v.File)); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
+
+// toImageInfo adds the URLs of the variants, which are served by the
+// ImageController
+func toImageInfo(img *persistence.Image) *ImageInfo {
+	if img == nil {
+		return nil
+	}
+
+	info := &ImageInfo{Width: img.Width, Height: img.Height, Blurhash: img.Blurhash, Variants: []ImageVariant{}}
+	srcset := []string{}
+
+	for _, v := range img.Variants {
+		url := fmt.Sprintf("/image/%s/%s", img.ImageID, v.File)
+		info.Variants = append(info.Variants, ImageVariant{v.Width, v.Height, url})
+		srcset = append(srcset, fmt.Sprintf("%s %dw", url, v.Width))
+	}
+
+	info.Srcset = strings.Join(srcset, ", ")
+
+	return info
+}
+
+func imageKey(id string, file string) string {
+	return "images/" + id + "/" + file
+}
+
+// variantSizes returns the sizes, which don't enlarge an image of width,
+// ascending. Images smaller than every size are stored in their own size.
+func variantSizes(sizes []int, width int) []int {
+	result := []int{}
+
+	for _, size := range sizes {
+		if size <= width {
+			result = append(result, size)
+		}
+	}
+
+	if len(result) == 0 {
+		result = append(result, width)
+	}
+
+	sort.Ints(result)
+
+	return result
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+}
+
+func encodePNG(w io.Writer, img image.Image) error {
+	return png.Encode(w, img)
+}
+
+func cropSquare(img *image.RGBA) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	size := min(w, h)
+	x, y := (w-size)/2, (h-size)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), img, image.Pt(x, y), draw.Src)
+
+	return dst
+}
+
+// resize scales img down to w x h by averaging the pixels covered by each
+// target pixel (box filter). Colors are premultiplied, so transparent pixels
+// don't darken the result.
+func resize(img *image.RGBA, w int, h int) *image.RGBA {
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := img.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += int(img.Pix[i])
+					sum[1] += int(img.Pix[i+1])
+					sum[2] += int(img.Pix[i+2])
+					sum[3] += int(img.Pix[i+3])
+					i += 4
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+
+	return dst
+}
+
+// orient rotates and flips img according to an EXIF orientation (1 - 8), so
+// it's displayed correctly once the metadata has been stripped
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated by 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated by 90° counterclockwise
+				sx, sy = w-1-y, x
+			}
+
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(sx, sy):img.PixOffset(sx, sy)+4])
+		}
+	}
+
+	return dst
+}
+
+// exifOrientation reads the orientation tag of a JPEG, 1 (normal) if it has
+// none
+func exifOrientation(data []byte) int {
+	const orientationTag = 0x0112
+
+	// JPEG segments: 0xFF marker, 2 byte length (including itself), payload
+	for i := 2; i+4 <= len(data) && data[0] == 0xFF && data[1] == 0xD8; {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+
+		// start of scan, the metadata precedes the image data
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+
+		payload := data[i+4 : i+2+length]
+
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			tiff := payload[6:]
+
+			if len(tiff) < 8 {
+				return 1
+			}
+
+			var order binary.ByteOrder
+			switch string(tiff[:2]) {
+			case "II":
+				order = binary.LittleEndian
+			case "MM":
+				order = binary.BigEndian
+			default:
+				return 1
+			}
+
+			ifd := int(order.Uint32(tiff[4:]))
+
+			if ifd+2 > len(tiff) {
+				return 1
+			}
+
+			entries := int(order.Uint16(tiff[ifd:]))
+
+			for e := 0; e < entries; e++ {
+				entry := ifd + 2 + e*12
+
+				if entry+12 > len(tiff) {
+					return 1
+				}
+
+				if order.Uint16(tiff[entry:]) == orientationTag {
+					return int(order.Uint16(tiff[entry+8:]))
+				}
+			}
+
+			return 1
+		}
+
+		i += 2 + length
+	}
+
+	return 1
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"gofeed-go/persistence"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Messages are written in a restricted Markdown dialect:
+//
+//	**bold**, __bold__, *italic*, _italic_, ~~strike~~, `code`
+//	[text](https://…), bare links, @<user id> mentions and #hashtags
+//	paragraphs, > quotes, - lists, 1. lists and ``` code blocks
+//
+// Raw HTML isn't supported, it is escaped like any other text. The output is
+// built from the allow-listed tags p, br, strong, em, del, code, pre,
+// blockquote, ul, ol, li and a, links only get the attributes href, class and
+// rel, and only point to http(s) and mailto URLs.
+
+// linkRel is set on every link to an external page
+const linkRel = "nofollow noopener noreferrer ugc"
+
+var (
+	// hashtagPattern matches hashtags, which contain at least one letter (#1 isn't a hashtag)
+	hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_]*\p{L}[\p{L}\p{N}_]*)`)
+
+	inlineLinkPattern   = regexp.MustCompile(`^\[([^\]\n]+)\]\(([^()\s]+)\)`)
+	linkStartPattern    = regexp.MustCompile(`^(?i)(?:https?://|www\.)\S+`)
+	mentionStartPattern = regexp.MustCompile(`^@([0-9a-f]{24})\b`)
+	hashtagStartPattern = regexp.MustCompile(`^` + hashtagPattern.String())
+	orderedItemPattern  = regexp.MustCompile(`^\d{1,9}[.)] `)
+)
+
+// maxHashtag is the length of the longest hashtag
+const maxHashtag = 64
+
+// renderMarkdown renders content as sanitised HTML and returns the hashtags
+// found in it (lower case, without #).
+func renderMarkdown(content string) (string, []string) {
+	r := &markdownRenderer{}
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+
+	r.blocks(lines)
+
+	return r.b.String(), r.tags
+}
+
+// MessageHTML returns the rendered content of a message. It is rendered when
+// the message is written, messages written before that are rendered on the fly.
+func MessageHTML(message *persistence.Message) string {
+	if message.ContentHTML != "" || message.Content == "" {
+		return message.ContentHTML
+	}
+
+	rendered, _ := renderMarkdown(message.Content)
+	return rendered
+}
+
+type markdownRenderer struct {
+	b    strings.Builder
+	tags []string
+}
+
+// blocks renders code blocks, quotes, lists and paragraphs
+func (r *markdownRenderer) blocks(lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			i++
+
+		case strings.HasPrefix(trimmed, "```"):
+			// a code block ends with the next fence or the content
+			code := []string{}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			i++
+
+			r.b.WriteString("<pre><code>")
+			r.b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			r.b.WriteString("</code></pre>")
+
+		case strings.HasPrefix(trimmed, ">"):
+			quoted := []string{}
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				l := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(l, " "))
+			}
+
+			r.b.WriteString("<blockquote>")
+			r.blocks(quoted)
+			r.b.WriteString("</blockquote>")
+
+		case listItem(trimmed, false) != "":
+			i = r.list(lines, i, false)
+
+		case listItem(trimmed, true) != "":
+			i = r.list(lines, i, true)
+
+		default:
+			// a paragraph ends with an empty line or another block
+			r.b.WriteString("<p>")
+			for first := true; i < len(lines) && !startsBlock(lines[i]); i++ {
+				if !first {
+					r.b.WriteString("<br>")
+				}
+				first = false
+
+				r.inline(strings.TrimSpace(lines[i]), true)
+			}
+			r.b.WriteString("</p>")
+		}
+	}
+}
+
+// list renders the list starting at lines[i] and returns the index of the
+// line following it
+func (r *markdownRenderer) list(lines []string, i int, ordered bool) int {
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+
+	r.b.WriteString("<" + tag + ">")
+
+	for ; i < len(lines); i++ {
+		item := listItem(strings.TrimSpace(lines[i]), ordered)
+
+		if item == "" {
+			break
+		}
+
+		r.b.WriteString("<li>")
+		r.inline(item, true)
+		r.b.WriteString("</li>")
+	}
+
+	r.b.WriteString("</" + tag + ">")
+
+	return i
+}
+
+// listItem returns the text of a list item, "" if line isn't one
+func listItem(line string, ordered bool) string {
+	if ordered {
+		if marker := orderedItemPattern.FindString(line); marker != "" {
+			return strings.TrimSpace(line[len(marker):])
+		}
+		return ""
+	}
+
+	for _, marker := range []string{"- ", "* ", "+ "} {
+		if strings.HasPrefix(line, marker) {
+			return strings.TrimSpace(line[len(marker):])
+		}
+	}
+
+	return ""
+}
+
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+
+	return trimmed == "" || strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, ">") ||
+		listItem(trimmed, false) != "" || listItem(trimmed, true) != ""
+}
+
+// inline renders emphasis, code, links, mentions and hashtags. Link texts
+// don't contain further links (links is false).
+func (r *markdownRenderer) inline(s string, links bool) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		wordBefore := i > 0 && isWordByte(s[i-1])
+
+		switch {
+		case c == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			r.b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+				r.b.WriteString("<code>")
+				r.b.WriteString(html.EscapeString(s[i+1 : i+1+end]))
+				r.b.WriteString("</code>")
+				i += end + 2
+				continue
+			}
+
+		case c == '[' && links:
+			if m := inlineLinkPattern.FindStringSubmatch(s[i:]); m != nil {
+				if href := safeURL(m[2]); href != "" {
+					r.b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="` + linkRel + `">`)
+					r.inline(m[1], false)
+					r.b.WriteString("</a>")
+					i += len(m[0])
+					continue
+				}
+			}
+
+		case (c == 'h' || c == 'H' || c == 'w' || c == 'W') && links && !wordBefore:
+			if m := linkStartPattern.FindString(s[i:]); m != "" {
+				m = trimLink(m)
+				target := m
+				if strings.HasPrefix(strings.ToLower(m), "www.") {
+					target = "https://" + m
+				}
+
+				if href := safeURL(target); href != "" {
+					r.b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="` + linkRel + `">`)
+					r.b.WriteString(html.EscapeString(m))
+					r.b.WriteString("</a>")
+					i += len(m)
+					continue
+				}
+			}
+
+		case c == '@' && links && !wordBefore:
+			if m := mentionStartPattern.FindStringSubmatch(s[i:]); m != nil {
+				r.b.WriteString(`<a href="` + html.EscapeString(baseURL()+"/user/"+m[1]) + `" class="mention">`)
+				r.b.WriteString("@" + m[1])
+				r.b.WriteString("</a>")
+				i += len(m[0])
+				continue
+			}
+
+		case c == '#' && links && !wordBefore && (i == 0 || s[i-1] != '&'):
+			if m := hashtagStartPattern.FindStringSubmatch(s[i:]); m != nil && utf8.RuneCountInString(m[1]) <= maxHashtag {
+				tag := strings.ToLower(m[1])
+				r.addTag(tag)
+
+				r.b.WriteString(`<a href="` + html.EscapeString(baseURL()+"/message?tag="+url.QueryEscape(tag)) + `" class="hashtag">`)
+				r.b.WriteString(html.EscapeString(m[0]))
+				r.b.WriteString("</a>")
+				i += len(m[0])
+				continue
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			if n := r.emphasis(s, i, links); n > 0 {
+				i += n
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		r.b.WriteString(html.EscapeString(s[i : i+size]))
+		i += size
+	}
+}
+
+// emphasis renders the emphasis opened at s[i] and returns the number of
+// bytes consumed, 0 if s[i] doesn't open an emphasis.
+func (r *markdownRenderer) emphasis(s string, i int, links bool) int {
+	tags := map[string]string{"**": "strong", "__": "strong", "~~": "del", "*": "em", "_": "em"}
+
+	delim := s[i:min(i+2, len(s))]
+	if _, ok := tags[delim]; !ok {
+		delim = s[i : i+1]
+	}
+
+	tag, ok := tags[delim]
+	start := i + len(delim)
+
+	// the delimiter has to be followed by text, _ must not be inside a word
+	if !ok || start >= len(s) || s[start] == ' ' || (delim[0] == '_' && i > 0 && isWordByte(s[i-1])) {
+		return 0
+	}
+
+	for j := start + 1; j+len(delim) <= len(s); j++ {
+		if s[j:j+len(delim)] != delim || s[j-1] == ' ' {
+			continue
+		}
+
+		// a single * doesn't close at a **
+		if len(delim) == 1 && (s[j-1] == delim[0] || j+1 < len(s) && s[j+1] == delim[0]) {
+			j++
+			continue
+		}
+
+		if delim[0] == '_' && j+len(delim) < len(s) && isWordByte(s[j+len(delim)]) {
+			continue
+		}
+
+		r.b.WriteString("<" + tag + ">")
+		r.inline(s[start:j], links)
+		r.b.WriteString("</" + tag + ">")
+
+		return j + len(delim) - i
+	}
+
+	// an unclosed ** isn't taken for two *
+	if len(delim) == 2 {
+		r.b.WriteString(delim)
+		return 2
+	}
+
+	return 0
+}
+
+func (r *markdownRenderer) addTag(tag string) {
+	if !contains(r.tags, tag) {
+		r.tags = append(r.tags, tag)
+	}
+}
+
+// safeURL returns the normalised URL, "" if it isn't an absolute http(s) or
+// mailto URL
+func safeURL(raw string) string {
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		return ""
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return ""
+		}
+	case "mailto":
+		if u.Opaque == "" {
+			return ""
+		}
+	default:
+		return ""
+	}
+
+	return u.String()
+}
+
+// trimLink removes punctuation following a link, which isn't part of it
+func trimLink(link string) string {
+	return strings.TrimRight(link, ".,;:!?'\")]}>*_~`")
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= utf8.RuneSelf || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("`~^|+<=>$", c) >= 0
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testRel = `rel="nofollow noopener noreferrer ugc"`
+
+func TestRenderMarkdown(t *testing.T) {
+	callback := os.Getenv("CALLBACK")
+	os.Setenv("CALLBACK", "https://gofeed.example")
+	defer os.Setenv("CALLBACK", callback)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+		tags []string
+	}{
+		// raw HTML is escaped like any other text
+		{"script", `<script>alert(1)</script>`, `<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>`, nil},
+		{"event handler", `<img src=x onerror=alert(1)>`, `<p>&lt;img src=x onerror=alert(1)&gt;</p>`, nil},
+		{"code span", "`<b>` \\<b>", `<p><code>&lt;b&gt;</code> &lt;b&gt;</p>`, nil},
+		{"code block", "```\n<script>\n```", `<pre><code>&lt;script&gt;</code></pre>`, nil},
+
+		// only http(s) and mailto links
+		{"javascript link", `[x](javascript:alert(1))`, `<p>[x](javascript:alert(1))</p>`, nil},
+		{"javascript link mixed case", `[x](JaVaScRiPt:alert(1))`, `<p>[x](JaVaScRiPt:alert(1))</p>`, nil},
+		{"javascript bare", `javascript:alert(1)`, `<p>javascript:alert(1)</p>`, nil},
+		{"data link", `[x](data:text/html;base64,PHNjcmlwdD4=)`, `<p>[x](data:text/html;base64,PHNjcmlwdD4=)</p>`, nil},
+		{"relative link", `[x](//evil.example)`, `<p>[x](//evil.example)</p>`, nil},
+		{"empty mailto", `[m](mailto:)`, `<p>[m](mailto:)</p>`, nil},
+		{"mailto", `[m](mailto:a@b.example)`, `<p><a href="mailto:a@b.example" ` + testRel + `>m</a></p>`, nil},
+
+		// quotes in URLs can't leave the attribute
+		{"quote in link", `[x](https://a.example/"onmouseover="alert)`,
+			`<p><a href="https://a.example/%22onmouseover=%22alert" ` + testRel + `>x</a></p>`, nil},
+		{"apostrophe in link", `[x](https://a.example/'onmouseover='alert)`,
+			`<p><a href="https://a.example/&#39;onmouseover=&#39;alert" ` + testRel + `>x</a></p>`, nil},
+		{"quote in bare link", `https://a.example/"><script>alert(1)</script>`,
+			`<p><a href="https://a.example/%22%3E%3Cscript%3Ealert%281%29%3C/script" ` + testRel + `>https://a.example/&#34;&gt;&lt;script&gt;alert(1)&lt;/script</a>&gt;</p>`, nil},
+
+		// link texts contain emphasis, but no further links, mentions or hashtags
+		{"emphasis in link", `[*em* and **strong**](https://a.example)`,
+			`<p><a href="https://a.example" ` + testRel + `><em>em</em> and <strong>strong</strong></a></p>`, nil},
+		{"link in link", `[see https://b.example](https://a.example)`,
+			`<p><a href="https://a.example" ` + testRel + `>see https://b.example</a></p>`, nil},
+		{"mention and hashtag in link", `[@60d3024837289a35c65874b0 #tag](https://a.example)`,
+			`<p><a href="https://a.example" ` + testRel + `>@60d3024837289a35c65874b0 #tag</a></p>`, nil},
+		{"link in emphasis", `**[x](https://a.example)**`,
+			`<p><strong><a href="https://a.example" ` + testRel + `>x</a></strong></p>`, nil},
+		{"javascript link in emphasis", `*[x](javascript:alert(1))*`, `<p><em>[x](javascript:alert(1))</em></p>`, nil},
+
+		// character references aren't hashtags
+		{"decimal reference", `&#35;tag`, `<p>&amp;#35;tag</p>`, nil},
+		{"hex reference", `&#x3C;script&#x3E;`, `<p>&amp;#x3C;script&amp;#x3E;</p>`, nil},
+		{"ampersand before hashtag", `a&#tag`, `<p>a&amp;#tag</p>`, nil},
+		{"escaped ampersand", `&amp;#tag`,
+			`<p>&amp;amp;<a href="https://gofeed.example/message?tag=tag" class="hashtag">#tag</a></p>`, []string{"tag"}},
+		{"hashtags", `#1 #tag1 #Tag`,
+			`<p>#1 <a href="https://gofeed.example/message?tag=tag1" class="hashtag">#tag1</a> <a href="https://gofeed.example/message?tag=tag" class="hashtag">#Tag</a></p>`,
+			[]string{"tag1", "tag"}},
+	}
+
+	for _, test := range tests {
+		got, tags := renderMarkdown(test.in)
+
+		if got != test.want {
+			t.Errorf("%s: renderMarkdown(%q)\n got  %s\n want %s", test.name, test.in, got, test.want)
+		}
+
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%s: tags %q, want %q", test.name, tags, test.tags)
+		}
+
+		checkSanitised(t, test.in, got)
+	}
+}
+
+var (
+	tagPattern  = regexp.MustCompile(`<(/?)([a-z]*)([^>]*)>`)
+	attrPattern = regexp.MustCompile(`^(?: (href|class|rel)="[^"<>]*")*$`)
+	allowedTags = map[string]bool{"p": true, "br": true, "strong": true, "em": true, "del": true, "code": true,
+		"pre": true, "blockquote": true, "ul": true, "ol": true, "li": true, "a": true}
+)
+
+// checkSanitised checks that html only contains allow-listed tags with
+// allow-listed attributes and that links point to http(s) or mailto URLs
+func checkSanitised(t *testing.T, in string, html string) {
+	for _, m := range tagPattern.FindAllStringSubmatch(html, -1) {
+		if !allowedTags[m[2]] || (m[1] == "/" && m[3] != "") || !attrPattern.MatchString(m[3]) {
+			t.Errorf("%q: unsafe tag %s", in, m[0])
+		}
+
+		for _, href := range regexp.MustCompile(`href="([^"]*)"`).FindAllStringSubmatch(m[3], -1) {
+			if !strings.HasPrefix(href[1], "https://") && !strings.HasPrefix(href[1], "http://") && !strings.HasPrefix(href[1], "mailto:") {
+				t.Errorf("%q: unsafe link %s", in, href[1])
+			}
+		}
+	}
+}
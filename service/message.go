@@ -3,27 +3,86 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"gofeed-go/helper"
 	"gofeed-go/persistence"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type MessageService struct {
-	p *persistence.MessagePersistor
+	p           *persistence.MessagePersistor
+	policy      *ContentPolicy
+	relations   *persistence.RelationPersistor
+	attachments *persistence.AttachmentPersistor
+	listeners   []MessageListener
 }
 
-func NewMessageService(p *persistence.MessagePersistor) *MessageService {
-	return &MessageService{p}
+// MessageEvent is emitted after a message has been written successfully.
+type MessageEvent struct {
+	Type    string
+	Message *persistence.Message
+}
+
+// MessageListener gets notified about every MessageEvent. Listeners are called
+// synchronously and must hand off long running work themselves.
+type MessageListener func(event MessageEvent)
+
+const (
+	EventMessageCreated = "message.created"
+	EventMessageUpdated = "message.updated"
+	EventMessageDeleted = "message.deleted"
+
+	// EventMessagePreviewed is emitted after the link previews of a message
+	// have been stored. It's internal, webhooks and followers don't get it.
+	EventMessagePreviewed = "message.previewed"
+
+	// EventPollVoted is emitted with the new tallies after a vote
+	EventPollVoted = "poll.voted"
+)
+
+// NewMessageService creates the service, new and updated messages have to
+// pass policy (may be nil). Timelines don't contain messages of users blocked
+// or muted in relations (may be nil). New messages may reference uploads
+// stored in attachments (may be nil).
+func NewMessageService(p *persistence.MessagePersistor, policy *ContentPolicy, relations *persistence.RelationPersistor, attachments *persistence.AttachmentPersistor) *MessageService {
+	return &MessageService{p: p, policy: policy, relations: relations, attachments: attachments}
+}
+
+// Subscribe registers a listener for message events. It must be called before
+// the service is in use.
+func (s *MessageService) Subscribe(l MessageListener) {
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *MessageService) emit(ctx context.Context, eventType string, message *persistence.Message) {
+	dispatch(ctx, func() {
+		for _, l := range s.listeners {
+			l(MessageEvent{eventType, message})
+		}
+	})
 }
 
 var (
 	ErrNotAuthor       = errors.New("Dieser Beitrag ist nicht von dir und kann deshalb nicht gelöscht werden.")
 	ErrInvalidObjectID = errors.New("invalid ObjectID")
+	ErrVersionMismatch = errors.New("Dieser Beitrag wurde in der Zwischenzeit verändert.")
+	ErrReplyNotFound   = errors.New("Der Beitrag, auf den du antworten möchtest, existiert nicht.")
+
+	ErrInvalidAttachment  = errors.New("Dieser Anhang existiert nicht oder wird bereits verwendet.")
+	ErrTooManyAttachments = fmt.Errorf("Ein Beitrag kann höchstens %d Anhänge haben.", maxAttachments)
 )
 
-func (s *MessageService) GetMessages(ctx context.Context, limit *int64, skip *int64) (*[]persistence.Message, error) {
+// maxAttachments is the number of attachments a message can have
+const maxAttachments = 4
+
+// GetMessages returns the timeline, optionally restricted to the messages
+// with a hashtag (without #).
+func (s *MessageService) GetMessages(ctx context.Context, tag string, limit *int64, skip *int64) (*[]persistence.Message, error) {
 	opt := options.Find()
 
 	if limit != nil {
@@ -33,34 +92,552 @@ func (s *MessageService) GetMessages(ctx context.Context, limit *int64, skip *in
 		opt.SetSkip(*skip)
 	}
 
-	return s.p.Find(ctx, bson.M{}, opt)
+	filter := bson.M{}
+
+	if tag != "" {
+		filter["tags"] = strings.ToLower(strings.TrimPrefix(tag, "#"))
+	}
+
+	filter, err := s.timelineFilter(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := s.p.Find(ctx, filter, opt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages = presentAll(ctx, messages)
+	err = s.embedOriginals(ctx, *messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
 }
 
+// GetMessagesByIds returns the messages with the given ids in the same
+// order, if the user in ctx may see them in a timeline.
+func (s *MessageService) GetMessagesByIds(ctx context.Context, ids []primitive.ObjectID) ([]persistence.Message, error) {
+	filter, err := s.timelineFilter(ctx, bson.M{"_id": bson.M{"$in": ids}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := s.p.Find(ctx, filter, options.Find())
+
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[primitive.ObjectID]persistence.Message{}
+	for _, m := range *presentAll(ctx, found) {
+		byId[m.MessageID] = m
+	}
+
+	messages := []persistence.Message{}
+	for _, id := range ids {
+		if m, ok := byId[id]; ok {
+			messages = append(messages, m)
+		}
+	}
+
+	err = s.embedOriginals(ctx, messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// GetLatestMessages returns the newest messages, optionally restricted to the
+// messages of a single author.
+func (s *MessageService) GetLatestMessages(ctx context.Context, author string, limit int64) (*[]persistence.Message, error) {
+	filter := bson.M{}
+
+	if author != "" {
+		aid, err := primitive.ObjectIDFromHex(author)
+
+		if err != nil {
+			return nil, ErrInvalidObjectID
+		}
+
+		filter["authorId"] = aid
+	}
+
+	filter, err := s.timelineFilter(ctx, filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	opt := options.Find().SetSort(bson.D{{Key: "created", Value: -1}}).SetLimit(limit)
+
+	messages, err := s.p.Find(ctx, filter, opt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages = presentAll(ctx, messages)
+	err = s.embedOriginals(ctx, *messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// GetMessageById returns a message, unless it isn't published and the user
+// in ctx is neither its author nor a moderator.
 func (s *MessageService) GetMessageById(ctx context.Context, id string) (*persistence.Message, error) {
-	return s.p.FindById(ctx, id)
+	message, err := s.p.FindById(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !visible(ctx, message) {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return s.presentOne(ctx, message)
 }
 
-func (s *MessageService) UpdateMessage(ctx context.Context, id string, author string, message persistence.Message) (*persistence.Message, error) {
+// UpdateMessage updates the content of a message written by author. If versions
+// is not empty, the message is only updated if its current version matches one of them.
+func (s *MessageService) UpdateMessage(ctx context.Context, id string, author string, versions []int64, message persistence.Message) (*persistence.Message, error) {
+	message.Updated = helper.GetCurrentTimeMillies()
 
-	if !s.p.IsAuthor(ctx, id, author) {
-		return nil, ErrNotAuthor
+	// the policy checks need to know whose message it is
+	message.MessageID, _ = primitive.ObjectIDFromHex(id)
+	message.AuthorID, _ = primitive.ObjectIDFromHex(author)
+
+	err := s.applyPolicy(ctx, &message)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return s.p.UpdateById(ctx, id, message)
+	message.ContentHTML, message.Tags = renderMarkdown(message.Content)
+
+	updated, previous, err := s.p.UpdateById(ctx, id, author, versions, message)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	// listeners only know published messages, editing never publishes one
+	switch {
+	case previous != "":
+	case updated.Status == "":
+		s.emit(ctx, EventMessageUpdated, updated)
+	default:
+		// the message isn't public anymore
+		s.emit(ctx, EventMessageDeleted, updated)
+	}
+
+	return s.presentOne(ctx, updated)
 }
 
 func (s *MessageService) CreateMessage(ctx context.Context, message persistence.Message) (*persistence.Message, error) {
 	current := helper.GetCurrentTimeMillies()
 	message.Created = current
 	message.Updated = current
+	message.Version = 1
+
+	// only visible messages can be replied to
+	if message.ReplyTo != nil {
+		_, err := s.GetMessageById(ctx, message.ReplyTo.Hex())
+
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrReplyNotFound
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// only published messages can be quoted, quoting a repost quotes its original
+	if message.QuoteOf != nil {
+		quoted, err := s.originalById(ctx, message.QuoteOf.Hex())
+
+		if err == mongo.ErrNoDocuments || (err == nil && quoted.Status != "") {
+			return nil, ErrQuoteNotFound
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		message.QuoteOf = &quoted.MessageID
+	}
+
+	if message.Poll != nil {
+		poll, err := newPoll(message.Poll, current)
+
+		if err != nil {
+			return nil, err
+		}
+
+		message.Poll = poll
+	}
+
+	err := s.applyPolicy(ctx, &message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := s.resolveAttachments(ctx, &message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message.ContentHTML, message.Tags = renderMarkdown(message.Content)
+
+	created, err := s.p.Create(ctx, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attachments) > 0 {
+		err = s.attachments.Attach(ctx, attachments, created.MessageID)
+
+		// another message has claimed an attachment in the meantime
+		if err != nil {
+			s.p.DeleteById(ctx, created.MessageID.Hex())
+			return nil, translateError(err)
+		}
+	}
+
+	if created.Status == "" {
+		s.emit(ctx, EventMessageCreated, created)
+	}
+
+	return s.presentOne(ctx, created)
+}
+
+// applyPolicy runs the content policy and sets the status of message
+// accordingly. Rejected messages are returned as *PolicyViolation.
+func (s *MessageService) applyPolicy(ctx context.Context, message *persistence.Message) error {
+	message.Status = ""
+	message.PolicyReason = ""
+
+	if s.policy == nil {
+		return nil
+	}
+
+	violation, err := s.policy.Apply(ctx, message)
+
+	if err != nil || violation == nil {
+		return err
+	}
+
+	message.PolicyReason = violation.Rule + ": " + violation.Reason
+
+	switch violation.Action {
+	case ActionHold:
+		message.Status = persistence.MessageHeld
+	case ActionShadowHide:
+		message.Status = persistence.MessageHidden
+	default:
+		return violation
+	}
 
-	return s.p.Create(ctx, message)
+	return nil
 }
 
-func (s *MessageService) DeleteMessage(ctx context.Context, id string, author string) (bool, error) {
-	if !s.p.IsAuthor(ctx, id, author) {
-		return false, ErrNotAuthor
+// resolveAttachments replaces the attachments referenced by message (only
+// their id is set) by the uploads of its author and returns their ids.
+func (s *MessageService) resolveAttachments(ctx context.Context, message *persistence.Message) ([]primitive.ObjectID, error) {
+	if len(message.Attachments) == 0 {
+		return nil, nil
 	}
 
-	return s.p.Delete(ctx, id)
+	if len(message.Attachments) > maxAttachments {
+		return nil, ErrTooManyAttachments
+	}
+
+	if s.attachments == nil {
+		return nil, ErrInvalidAttachment
+	}
+
+	ids := make([]primitive.ObjectID, len(message.Attachments))
+	for i, a := range message.Attachments {
+		ids[i] = a.AttachmentID
+	}
+
+	uploads, err := s.attachments.FindUnattached(ctx, message.AuthorID, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[primitive.ObjectID]persistence.Attachment{}
+	for _, u := range *uploads {
+		byId[u.AttachmentID] = persistence.Attachment{AttachmentID: u.AttachmentID, Name: u.Name, ContentType: u.ContentType, Size: u.Size}
+	}
+
+	// unknown, foreign, used or duplicate attachments
+	if len(byId) != len(ids) {
+		return nil, ErrInvalidAttachment
+	}
+
+	for i, id := range ids {
+		message.Attachments[i] = byId[id]
+	}
+
+	return ids, nil
+}
+
+// RemoveMessage deletes a message as moderator, regardless of its author.
+func (s *MessageService) RemoveMessage(ctx context.Context, id string) (*persistence.Message, error) {
+	deleted, err := s.p.DeleteById(ctx, id)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	s.afterDelete(ctx, deleted)
+
+	return deleted, nil
+}
+
+// SetPreviews stores the link previews of a message, unless its content has
+// been changed in the meantime (mongo.ErrNoDocuments). It emits
+// EventMessagePreviewed instead of an update, the edit was announced already.
+func (s *MessageService) SetPreviews(ctx context.Context, id primitive.ObjectID, content string, previews []persistence.LinkPreview) (*persistence.Message, error) {
+	updated, err := s.p.SetPreviews(ctx, id, content, previews)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if updated.Status == "" {
+		s.emit(ctx, EventMessagePreviewed, updated)
+	}
+
+	return updated, nil
+}
+
+// findByIds loads several messages regardless of their status
+func (s *MessageService) findByIds(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]*persistence.Message, error) {
+	messages, err := s.p.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find())
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[primitive.ObjectID]*persistence.Message{}
+	for i := range *messages {
+		result[(*messages)[i].MessageID] = &(*messages)[i]
+	}
+
+	return result, nil
+}
+
+// GetMessagesByStatus lists messages, which aren't published, for moderators.
+func (s *MessageService) GetMessagesByStatus(ctx context.Context, status string, limit *int64, skip *int64) (*[]persistence.Message, error) {
+	opt := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+
+	if limit != nil {
+		opt.SetLimit(*limit)
+	}
+	if skip != nil {
+		opt.SetSkip(*skip)
+	}
+
+	return s.p.Find(ctx, bson.M{"status": status}, opt)
+}
+
+// SetMessageStatus publishes (empty status), hides or rejects a message as
+// moderator. Listeners are told about messages becoming public or private.
+func (s *MessageService) SetMessageStatus(ctx context.Context, id string, status string, reason string) (*persistence.Message, error) {
+	before, err := s.p.SetStatus(ctx, id, status, reason)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.statusChanged(ctx, before, status, reason), nil
+}
+
+// unhideMessage publishes a message, if it has been hidden for reason.
+// Otherwise mongo.ErrNoDocuments is returned.
+func (s *MessageService) unhideMessage(ctx context.Context, id string, reason string) (*persistence.Message, error) {
+	before, err := s.p.Unhide(ctx, id, reason)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.statusChanged(ctx, before, "", ""), nil
+}
+
+// statusChanged returns the message after its status has been changed and
+// tells the listeners about it
+func (s *MessageService) statusChanged(ctx context.Context, before *persistence.Message, status string, reason string) *persistence.Message {
+	message := *before
+	message.Status = status
+	message.PolicyReason = reason
+	message.Version++
+
+	switch {
+	case before.Status != "" && status == "":
+		s.emit(ctx, EventMessageCreated, &message)
+	case before.Status == "" && status != "":
+		s.emit(ctx, EventMessageDeleted, &message)
+	}
+
+	return &message
+}
+
+// visibleFilter restricts filter to published messages and the messages of
+// the user in ctx
+func visibleFilter(ctx context.Context, filter bson.M) bson.M {
+	published := bson.M{"status": bson.M{"$in": bson.A{nil, ""}}}
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return bson.M{"$and": bson.A{filter, published}}
+	}
+
+	return bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{published, bson.M{"authorId": user.UserID}}}}}
+}
+
+// timelineFilter restricts filter like visibleFilter and additionally removes
+// the messages of users the user in ctx has blocked or muted, or who have
+// blocked the user.
+func (s *MessageService) timelineFilter(ctx context.Context, filter bson.M) (bson.M, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil || s.relations == nil {
+		return visibleFilter(ctx, filter), nil
+	}
+
+	hidden, err := s.relations.HiddenAuthors(ctx, user.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hidden) > 0 {
+		filter = bson.M{"$and": bson.A{filter, bson.M{"authorId": bson.M{"$nin": hidden}}}}
+	}
+
+	return visibleFilter(ctx, filter), nil
+}
+
+// HiddenAuthors returns the authors removed from the timelines of the user in
+// ctx like timelineFilter does, for filtering messages as they are created.
+// Anonymous users don't hide anyone.
+func (s *MessageService) HiddenAuthors(ctx context.Context) (map[primitive.ObjectID]bool, error) {
+	hidden := map[primitive.ObjectID]bool{}
+	user, err := userFromContext(ctx)
+
+	if err != nil || s.relations == nil {
+		return hidden, nil
+	}
+
+	authors, err := s.relations.HiddenAuthors(ctx, user.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, author := range authors {
+		hidden[author] = true
+	}
+
+	return hidden, nil
+}
+
+func visible(ctx context.Context, message *persistence.Message) bool {
+	if message.Status == "" {
+		return true
+	}
+
+	user, err := userFromContext(ctx)
+
+	return err == nil && (user.UserID == message.AuthorID || user.IsModerator())
+}
+
+// present returns a copy of message prepared for the user in ctx, see conceal
+func present(ctx context.Context, message *persistence.Message) *persistence.Message {
+	m := *message
+	conceal(ctx, &m)
+	m.ContentHTML = MessageHTML(&m)
+	m.Poll = PresentPoll(ctx, m.Poll)
+	return &m
+}
+
+func presentAll(ctx context.Context, messages *[]persistence.Message) *[]persistence.Message {
+	for i := range *messages {
+		conceal(ctx, &(*messages)[i])
+		(*messages)[i].ContentHTML = MessageHTML(&(*messages)[i])
+		(*messages)[i].Poll = PresentPoll(ctx, (*messages)[i].Poll)
+	}
+	return messages
+}
+
+// conceal removes moderation details, unless the user in ctx is a moderator.
+// Authors aren't told that their message has been shadow-hidden.
+func conceal(ctx context.Context, message *persistence.Message) {
+	if user, err := userFromContext(ctx); err == nil && user.IsModerator() {
+		return
+	}
+
+	if message.Status == persistence.MessageHidden {
+		message.Status = ""
+	}
+	message.PolicyReason = ""
+}
+
+// DeleteMessage deletes a message written by author. If versions is not empty,
+// the message is only deleted if its current version matches one of them.
+func (s *MessageService) DeleteMessage(ctx context.Context, id string, author string, versions []int64) (bool, error) {
+	deleted, err := s.p.Delete(ctx, id, author, versions)
+
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	s.afterDelete(ctx, deleted)
+
+	return true, nil
+}
+
+func translateError(err error) error {
+	switch err {
+	case persistence.ErrNotAuthor:
+		return ErrNotAuthor
+	case persistence.ErrVersionMismatch:
+		return ErrVersionMismatch
+	case persistence.ErrInvalidObjectID:
+		return ErrInvalidObjectID
+	case persistence.ErrInvalidAttachment:
+		return ErrInvalidAttachment
+	case persistence.ErrDraftLocked:
+		return ErrDraftLocked
+	case persistence.ErrIsRepost:
+		return ErrRepostNotEditable
+	case persistence.ErrNoPoll:
+		return ErrNoPoll
+	case persistence.ErrPollClosed:
+		return ErrPollClosed
+	case persistence.ErrAlreadyVoted:
+		return ErrAlreadyVoted
+	}
+	return err
 }
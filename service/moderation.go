@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ModerationService handles reports of messages and the actions moderators
+// take on them. Every action is recorded in the audit trail.
+type ModerationService struct {
+	p         *persistence.ReportPersistor
+	ms        *MessageService
+	us        *UserService
+	threshold int64
+}
+
+// Actions moderators take on reported messages
+const (
+	ModerationDismiss = "dismiss" // the reports are unfounded
+	ModerationHide    = "hide"    // the message is only visible to its author
+	ModerationDelete  = "delete"  // the message is removed
+	ModerationWarn    = "warn"    // the author is warned, the message stays
+	ModerationSuspend = "suspend" // the author is suspended, the message is removed
+)
+
+// Actions, which are only recorded in the audit trail
+const (
+	ModerationApprove  = "approve"
+	ModerationReject   = "reject"
+	ModerationAutoHide = "auto-hide"
+)
+
+// reportsReason is the PolicyReason of messages hidden by autoHide, only
+// they are published again when the reports are dismissed
+const reportsReason = "reports: Dein Beitrag wurde nach mehreren Meldungen ausgeblendet."
+
+// ReportedMessage is an entry of the moderation queue.
+type ReportedMessage struct {
+	persistence.ReportSummary
+	Message *persistence.Message `json:"message,omitempty"`
+}
+
+var (
+	ErrOwnMessage              = errors.New("Du kannst deine eigenen Beiträge nicht melden.")
+	ErrUnknownModerationAction = errors.New("unknown action, expected dismiss, hide, delete, warn or suspend")
+)
+
+// NewModerationService creates the service. Messages are hidden automatically
+// once they have threshold open reports, 0 disables hiding.
+func NewModerationService(p *persistence.ReportPersistor, ms *MessageService, us *UserService, threshold int) *ModerationService {
+	return &ModerationService{p, ms, us, int64(threshold)}
+}
+
+// ReportMessage reports a message as the user in ctx.
+func (s *ModerationService) ReportMessage(ctx context.Context, id string, report persistence.Report) (*persistence.Report, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// only messages the user can see can be reported
+	message, err := s.ms.GetMessageById(ctx, id)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if message.AuthorID == user.UserID {
+		return nil, ErrOwnMessage
+	}
+
+	report.MessageID = message.MessageID
+	report.ReporterID = user.UserID
+	report.Created = helper.GetCurrentTimeMillies()
+
+	count, err := s.p.Create(ctx, report)
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.Status = persistence.ReportOpen
+
+	if s.threshold > 0 && count >= s.threshold && message.Status == "" {
+		err = s.autoHide(ctx, message, count)
+	}
+
+	return &report, err
+}
+
+// autoHide hides a message with too many reports until a moderator reviews it.
+// The reports stay open, so the message remains in the queue.
+func (s *ModerationService) autoHide(ctx context.Context, message *persistence.Message, count int64) error {
+	_, err := s.ms.SetMessageStatus(ctx, message.MessageID.Hex(), persistence.MessageHidden, reportsReason)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.p.AddAuditEntry(ctx, persistence.AuditEntry{
+		Action:    ModerationAutoHide,
+		MessageID: message.MessageID,
+		UserID:    message.AuthorID,
+		Reports:   count,
+		Created:   helper.GetCurrentTimeMillies(),
+	})
+
+	return err
+}
+
+// GetQueue returns the reported messages, the most reported first. Messages
+// deleted in the meantime have no message.
+func (s *ModerationService) GetQueue(ctx context.Context, limit int64, skip int64) (*[]ReportedMessage, error) {
+	summaries, err := s.p.Queue(ctx, limit, skip)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(*summaries))
+	for i, summary := range *summaries {
+		ids[i] = summary.MessageID
+	}
+
+	messages, err := s.ms.findByIds(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	queue := make([]ReportedMessage, len(*summaries))
+	for i, summary := range *summaries {
+		queue[i] = ReportedMessage{summary, messages[summary.MessageID]}
+	}
+
+	return &queue, nil
+}
+
+// Moderate takes action on a reported message as the moderator in ctx,
+// resolves its open reports and records the action in the audit trail.
+func (s *ModerationService) Moderate(ctx context.Context, id string, action string, note string) (*persistence.AuditEntry, error) {
+	moderator, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	message, err := s.ms.p.FindById(ctx, id)
+
+	// reports of deleted messages can still be dismissed
+	if err == mongo.ErrNoDocuments && action == ModerationDismiss {
+		message, err = &persistence.Message{MessageID: mid}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case ModerationDismiss:
+		// undo the automatic hiding, but not a hide by the policy or a moderator
+		if message.Status == persistence.MessageHidden && message.PolicyReason == reportsReason {
+			_, err = s.ms.unhideMessage(ctx, id, reportsReason)
+
+			// hidden by a moderator in the meantime
+			if err == mongo.ErrNoDocuments {
+				err = nil
+			}
+		}
+	case ModerationHide:
+		_, err = s.ms.SetMessageStatus(ctx, id, persistence.MessageHidden, "")
+	case ModerationDelete:
+		_, err = s.ms.RemoveMessage(ctx, id)
+	case ModerationWarn:
+		err = s.us.WarnUser(ctx, message.AuthorID)
+	case ModerationSuspend:
+		err = s.us.SuspendUser(ctx, message.AuthorID, true)
+		if err == nil {
+			_, err = s.ms.RemoveMessage(ctx, id)
+		}
+	default:
+		return nil, ErrUnknownModerationAction
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := s.p.Resolve(ctx, mid, action)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.p.AddAuditEntry(ctx, persistence.AuditEntry{
+		Action:      action,
+		ModeratorID: moderator.UserID,
+		MessageID:   mid,
+		UserID:      message.AuthorID,
+		Reports:     resolved,
+		Note:        note,
+		Created:     helper.GetCurrentTimeMillies(),
+	})
+}
+
+// SetMessageStatus changes the status of a message like
+// MessageService.SetMessageStatus and records it in the audit trail.
+func (s *ModerationService) SetMessageStatus(ctx context.Context, id string, status string) (*persistence.Message, error) {
+	moderator, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.ms.SetMessageStatus(ctx, id, status, "")
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	action := ModerationApprove
+	switch status {
+	case persistence.MessageHidden:
+		action = ModerationHide
+	case persistence.MessageRejected:
+		action = ModerationReject
+	}
+
+	_, err = s.p.AddAuditEntry(ctx, persistence.AuditEntry{
+		Action:      action,
+		ModeratorID: moderator.UserID,
+		MessageID:   message.MessageID,
+		UserID:      message.AuthorID,
+		Created:     helper.GetCurrentTimeMillies(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// GetAuditTrail returns the audit trail, optionally restricted to a message
+// or the messages of a user.
+func (s *ModerationService) GetAuditTrail(ctx context.Context, message string, user string, limit int64, skip int64) (*[]persistence.AuditEntry, error) {
+	filter := bson.M{}
+
+	for key, id := range map[string]string{"messageId": message, "userId": user} {
+		if id == "" {
+			continue
+		}
+
+		oid, err := primitive.ObjectIDFromHex(id)
+
+		if err != nil {
+			return nil, ErrInvalidObjectID
+		}
+
+		filter[key] = oid
+	}
+
+	return s.p.FindAuditEntries(ctx, filter, limit, skip)
+}
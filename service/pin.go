@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PinService pins messages. Global pins are announcements set by admins and
+// shown ahead of the timeline, profile pins are messages users pin to their
+// own profile.
+type PinService struct {
+	p  *persistence.PinPersistor
+	ms *MessageService
+}
+
+const (
+	maxGlobalPins  = 5
+	maxProfilePins = 3
+)
+
+var (
+	ErrPinForeign      = errors.New("Du kannst nur deine eigenen Beiträge an dein Profil anheften.")
+	ErrPinUnpublished  = errors.New("Nur veröffentlichte Beiträge können angeheftet werden.")
+	ErrPinExpired      = errors.New("Das Ablaufdatum muss in der Zukunft liegen.")
+	ErrInvalidPinOrder = errors.New("Die Reihenfolge muss jeden angehefteten Beitrag genau einmal enthalten.")
+
+	ErrTooManyGlobalPins  = fmt.Errorf("Es können höchstens %d Beiträge angeheftet werden.", maxGlobalPins)
+	ErrTooManyProfilePins = fmt.Errorf("Du kannst höchstens %d Beiträge an dein Profil anheften.", maxProfilePins)
+)
+
+func NewPinService(p *persistence.PinPersistor, ms *MessageService) *PinService {
+	return &PinService{p, ms}
+}
+
+// GetGlobalPins returns the pinned announcements, which the user in ctx may see.
+func (s *PinService) GetGlobalPins(ctx context.Context) ([]persistence.Message, error) {
+	return s.pinned(ctx, nil)
+}
+
+// GetProfilePins returns the messages pinned to the profile of user ("me"
+// for the user in ctx).
+func (s *PinService) GetProfilePins(ctx context.Context, user string) ([]persistence.Message, error) {
+	if user == "me" {
+		u, err := userFromContext(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return s.pinned(ctx, &u.UserID)
+	}
+
+	oid, err := primitive.ObjectIDFromHex(user)
+
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+
+	return s.pinned(ctx, &oid)
+}
+
+func (s *PinService) pinned(ctx context.Context, scope *primitive.ObjectID) ([]persistence.Message, error) {
+	pins, err := s.p.Find(ctx, scope, helper.GetCurrentTimeMillies())
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(*pins))
+	for i, pin := range *pins {
+		ids[i] = pin.MessageID
+	}
+
+	if len(ids) == 0 {
+		return []persistence.Message{}, nil
+	}
+
+	messages, err := s.ms.GetMessagesByIds(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		messages[i].Pinned = true
+	}
+
+	return messages, nil
+}
+
+// Pin pins a message globally (with an optional expiry) or to the profile
+// of the user in ctx, who must be its author. Only published messages can
+// be pinned.
+func (s *PinService) Pin(ctx context.Context, global bool, id string, expires *int64) (*persistence.Pin, error) {
+	scope, err := pinScope(ctx, global)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.ms.GetMessageById(ctx, id)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if message.Status != "" {
+		return nil, ErrPinUnpublished
+	}
+
+	if scope != nil && message.AuthorID != *scope {
+		return nil, ErrPinForeign
+	}
+
+	now := helper.GetCurrentTimeMillies()
+	max, tooMany := maxGlobalPins, ErrTooManyGlobalPins
+
+	if scope != nil {
+		// profile pins don't expire
+		expires = nil
+		max, tooMany = maxProfilePins, ErrTooManyProfilePins
+	}
+
+	if expires != nil && *expires <= now {
+		return nil, ErrPinExpired
+	}
+
+	pin, err := s.p.Add(ctx, persistence.Pin{UserID: scope, MessageID: message.MessageID, Created: now, Expires: expires}, max, now)
+
+	if err == persistence.ErrTooManyPins {
+		return nil, tooMany
+	}
+
+	return pin, err
+}
+
+// Unpin removes a global pin or a pin from the profile of the user in ctx.
+func (s *PinService) Unpin(ctx context.Context, global bool, id string) error {
+	scope, err := pinScope(ctx, global)
+
+	if err != nil {
+		return err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return ErrInvalidObjectID
+	}
+
+	return s.p.Remove(ctx, scope, oid)
+}
+
+// Reorder changes the order of the global or profile pins. ids has to
+// contain every pinned message exactly once.
+func (s *PinService) Reorder(ctx context.Context, global bool, ids []string) ([]persistence.Message, error) {
+	scope, err := pinScope(ctx, global)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := s.p.Find(ctx, scope, helper.GetCurrentTimeMillies())
+
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := map[primitive.ObjectID]bool{}
+	for _, pin := range *pins {
+		pinned[pin.MessageID] = true
+	}
+
+	if len(ids) != len(pinned) {
+		return nil, ErrInvalidPinOrder
+	}
+
+	order := make([]primitive.ObjectID, len(ids))
+
+	for i, id := range ids {
+		oid, err := primitive.ObjectIDFromHex(id)
+
+		if err != nil || !pinned[oid] {
+			return nil, ErrInvalidPinOrder
+		}
+
+		// every message once
+		delete(pinned, oid)
+		order[i] = oid
+	}
+
+	err = s.p.Reorder(ctx, scope, order)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.pinned(ctx, scope)
+}
+
+// OnMessageEvent unpins deleted messages.
+// It's meant to be registered with MessageService.Subscribe.
+func (s *PinService) OnMessageEvent(e MessageEvent) {
+	if e.Type != EventMessageDeleted {
+		return
+	}
+
+	go func() {
+		err := s.p.DeleteByMessage(context.Background(), e.Message.MessageID)
+
+		if err != nil {
+			log.Println("pin: couldn't unpin deleted message:", err)
+		}
+	}()
+}
+
+// pinScope returns the user whose profile pins are changed, nil for global pins
+func pinScope(ctx context.Context, global bool) (*primitive.ObjectID, error) {
+	if global {
+		return nil, nil
+	}
+
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.UserID, nil
+}
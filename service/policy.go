@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Actions taken, if a message violates a rule of the content policy
+const (
+	ActionReject     = "reject"      // the message isn't written
+	ActionHold       = "hold"        // the message is held for review
+	ActionShadowHide = "shadow-hide" // the message is only visible to its author
+)
+
+// actionSeverity decides which action is taken, if several rules are violated
+var actionSeverity = map[string]int{ActionShadowHide: 1, ActionHold: 2, ActionReject: 3}
+
+var ErrUnknownAction = errors.New("unknown action, expected reject, hold or shadow-hide")
+
+// PolicyViolation describes why a message violates a rule. Rejections are
+// returned as error by CreateMessage and UpdateMessage.
+type PolicyViolation struct {
+	Rule   string
+	Reason string
+	Action string
+}
+
+func (v *PolicyViolation) Error() string {
+	return v.Reason
+}
+
+// PolicyRule checks a message before it is written. It returns nil, if the
+// message complies with the rule.
+type PolicyRule interface {
+	Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error)
+}
+
+// ContentPolicy is a pipeline of rules every message has to pass.
+type ContentPolicy struct {
+	rules []PolicyRule
+}
+
+func NewContentPolicy(rules ...PolicyRule) *ContentPolicy {
+	return &ContentPolicy{rules}
+}
+
+// ParseAction validates an action read from the configuration.
+func ParseAction(action string) (string, error) {
+	if _, ok := actionSeverity[action]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownAction, action)
+	}
+	return action, nil
+}
+
+// Apply runs every rule and returns the most severe violation, nil if the
+// message passes all of them.
+func (p *ContentPolicy) Apply(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	var worst *PolicyViolation
+
+	for _, rule := range p.rules {
+		v, err := rule.Check(ctx, message)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if v != nil && (worst == nil || actionSeverity[v.Action] > actionSeverity[worst.Action]) {
+			worst = v
+		}
+	}
+
+	return worst, nil
+}
+
+// MaxLengthRule limits the number of characters of a message.
+type MaxLengthRule struct {
+	Max    int
+	Action string
+}
+
+func (r MaxLengthRule) Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	if utf8.RuneCountInString(message.Content) <= r.Max {
+		return nil, nil
+	}
+
+	return &PolicyViolation{"max-length", fmt.Sprintf("Dein Beitrag ist zu lang (max. %d Zeichen).", r.Max), r.Action}, nil
+}
+
+// LinkLimitRule limits the number of links in a message.
+type LinkLimitRule struct {
+	Max    int
+	Action string
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+func (r LinkLimitRule) Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	if len(linkPattern.FindAllStringIndex(message.Content, -1)) <= r.Max {
+		return nil, nil
+	}
+
+	return &PolicyViolation{"link-limit", fmt.Sprintf("Dein Beitrag enthält zu viele Links (max. %d).", r.Max), r.Action}, nil
+}
+
+// BannedWordsRule looks for banned words and phrases. Messages and the list
+// are normalised, so case, accents, full-width letters or zero-width spaces
+// don't hide a banned word.
+type BannedWordsRule struct {
+	phrases [][]string
+	action  string
+}
+
+func NewBannedWordsRule(words []string, action string) *BannedWordsRule {
+	r := &BannedWordsRule{action: action}
+
+	for _, w := range words {
+		if tokens := tokenize(w); len(tokens) > 0 {
+			r.phrases = append(r.phrases, tokens)
+		}
+	}
+
+	return r
+}
+
+func (r *BannedWordsRule) Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	tokens := tokenize(message.Content)
+
+	for _, phrase := range r.phrases {
+		if containsPhrase(tokens, phrase) {
+			return &PolicyViolation{"banned-words", "Dein Beitrag enthält unzulässige Wörter.", r.action}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// DuplicateRule detects messages an author has already posted within window.
+type DuplicateRule struct {
+	p      *persistence.MessagePersistor
+	window time.Duration
+	action string
+}
+
+// duplicateCandidates is the number of recent messages compared with a new one
+const duplicateCandidates = 50
+
+func NewDuplicateRule(p *persistence.MessagePersistor, window time.Duration, action string) *DuplicateRule {
+	return &DuplicateRule{p, window, action}
+}
+
+func (r *DuplicateRule) Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	// reposts have no content, a message is only reposted once anyway
+	if message.RepostOf != nil {
+		return nil, nil
+	}
+
+	since := helper.GetCurrentTimeMillies() - r.window.Milliseconds()
+	filter := bson.M{"authorId": message.AuthorID, "created": bson.M{"$gte": since}}
+
+	// an updated message isn't a duplicate of itself
+	if !message.MessageID.IsZero() {
+		filter["_id"] = bson.M{"$ne": message.MessageID}
+	}
+
+	recent, err := r.p.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created", Value: -1}}).SetLimit(duplicateCandidates))
+
+	if err != nil {
+		return nil, err
+	}
+
+	content := strings.Join(tokenize(message.Content), " ")
+
+	for _, m := range *recent {
+		if strings.Join(tokenize(m.Content), " ") == content {
+			return &PolicyViolation{"duplicate", "Du hast diesen Beitrag bereits veröffentlicht.", r.action}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// SuspensionRule rejects messages of suspended users. Their JWT stays valid
+// until it expires, therefore every write is checked.
+type SuspensionRule struct {
+	p *persistence.UserPersistor
+}
+
+func NewSuspensionRule(p *persistence.UserPersistor) *SuspensionRule {
+	return &SuspensionRule{p}
+}
+
+func (r *SuspensionRule) Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	user, err := r.p.FindById(ctx, message.AuthorID.Hex())
+
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.Suspended {
+		return nil, nil
+	}
+
+	return &PolicyViolation{"suspended", ErrSuspended.Error(), ActionReject}, nil
+}
+
+// BlockRule rejects replies to, mentions, reposts and quotes of users, who
+// have blocked the author of the message.
+type BlockRule struct {
+	relations *persistence.RelationPersistor
+	messages  *persistence.MessagePersistor
+}
+
+func NewBlockRule(relations *persistence.RelationPersistor, messages *persistence.MessagePersistor) *BlockRule {
+	return &BlockRule{relations, messages}
+}
+
+func (r *BlockRule) Check(ctx context.Context, message *persistence.Message) (*PolicyViolation, error) {
+	users := mentions(message.Content)
+
+	for _, ref := range []*primitive.ObjectID{message.ReplyTo, message.RepostOf, message.QuoteOf} {
+		if ref == nil {
+			continue
+		}
+
+		referenced, err := r.messages.FindById(ctx, ref.Hex())
+
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+
+		if referenced != nil {
+			users = append(users, referenced.AuthorID)
+		}
+	}
+
+	blocked, err := r.relations.IsBlocked(ctx, message.AuthorID, users)
+
+	if err != nil || !blocked {
+		return nil, err
+	}
+
+	return &PolicyViolation{"blocked", "Du kannst diesem Nutzer nicht antworten, ihn nicht erwähnen und seine Beiträge nicht teilen.", ActionReject}, nil
+}
+
+// mentionPattern matches mentions of users by their id, e.g. @60d3024837289a35c65874ab
+var mentionPattern = regexp.MustCompile(`@([0-9a-f]{24})\b`)
+
+// mentions returns the users mentioned in content
+func mentions(content string) []primitive.ObjectID {
+	users := []primitive.ObjectID{}
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if oid, err := primitive.ObjectIDFromHex(match[1]); err == nil {
+			users = append(users, oid)
+		}
+	}
+
+	return users
+}
+
+// tokenize normalises s and splits it into lower case words. Normalising folds
+// compatibility characters (full-width letters, ligatures) and removes accents
+// and invisible format characters (zero-width spaces).
+func tokenize(s string) []string {
+	// transformers aren't safe for concurrent use
+	normalizer := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), runes.Remove(runes.In(unicode.Cf)), norm.NFC)
+	normalized, _, err := transform.String(normalizer, s)
+
+	if err != nil {
+		normalized = s
+	}
+
+	return strings.FieldsFunc(strings.ToLower(normalized), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func containsPhrase(tokens []string, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		match := true
+
+		for j := range phrase {
+			if tokens[i+j] != phrase[j] {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollOptionLength = 100
+
+	// polls without a closing time close after defaultPollDuration
+	defaultPollDuration = 24 * time.Hour
+	maxPollDuration     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidPoll        = fmt.Errorf("Eine Umfrage braucht %d bis %d verschiedene Antworten mit höchstens %d Zeichen.", minPollOptions, maxPollOptions, maxPollOptionLength)
+	ErrInvalidPollClosing = fmt.Errorf("Das Ende der Umfrage muss in der Zukunft und höchstens %d Tage entfernt liegen.", int(maxPollDuration.Hours()/24))
+	ErrNoPoll             = errors.New("Dieser Beitrag enthält keine Umfrage.")
+	ErrPollClosed         = errors.New("Diese Umfrage ist bereits beendet.")
+	ErrAlreadyVoted       = errors.New("Du hast bereits abgestimmt.")
+	ErrInvalidChoice      = errors.New("Bitte wähle eine Antwort aus, bei Mehrfachauswahl auch mehrere.")
+	ErrPollBlocked        = errors.New("Du kannst an dieser Umfrage nicht teilnehmen.")
+)
+
+// newPoll validates the poll of a new message and returns it without votes
+func newPoll(poll *persistence.Poll, now int64) (*persistence.Poll, error) {
+	if len(poll.Options) < minPollOptions || len(poll.Options) > maxPollOptions {
+		return nil, ErrInvalidPoll
+	}
+
+	closes := poll.Closes
+	if closes == 0 {
+		closes = now + defaultPollDuration.Milliseconds()
+	}
+
+	if closes <= now || closes > now+maxPollDuration.Milliseconds() {
+		return nil, ErrInvalidPollClosing
+	}
+
+	var zero int64
+	created := &persistence.Poll{Multiple: poll.Multiple, Closes: closes, Voters: &zero, Votes: map[string][]int{}}
+	seen := map[string]bool{}
+
+	for _, option := range poll.Options {
+		text := strings.TrimSpace(option.Text)
+		key := strings.ToLower(text)
+
+		if text == "" || utf8.RuneCountInString(text) > maxPollOptionLength || seen[key] {
+			return nil, ErrInvalidPoll
+		}
+
+		seen[key] = true
+		created.Options = append(created.Options, persistence.PollOption{Text: text, Votes: &zero})
+	}
+
+	return created, nil
+}
+
+// PresentPoll returns a copy of poll for the user in ctx. The results are
+// hidden, until the user has voted or the poll has closed.
+func PresentPoll(ctx context.Context, poll *persistence.Poll) *persistence.Poll {
+	if poll == nil {
+		return nil
+	}
+
+	p := *poll
+	p.Options = append([]persistence.PollOption{}, poll.Options...)
+	p.Closed = p.Closes <= helper.GetCurrentTimeMillies()
+	p.Voted = nil
+
+	if user, err := userFromContext(ctx); err == nil {
+		p.Voted = poll.Votes[user.UserID.Hex()]
+	}
+
+	p.Votes = nil
+
+	if !p.Closed && p.Voted == nil {
+		p.Voters = nil
+		for i := range p.Options {
+			p.Options[i].Votes = nil
+		}
+	}
+
+	return &p
+}
+
+// Vote records the choices (indices of the options) of the user in ctx in
+// the poll of a message. Every user votes once, votes can't be changed.
+func (s *MessageService) Vote(ctx context.Context, id string, choices []int) (*persistence.Message, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.GetMessageById(ctx, id)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	// messages, which aren't published, can't be voted on
+	if message.Status != "" {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	if message.Poll == nil {
+		return nil, ErrNoPoll
+	}
+
+	choices, err = validChoices(message.Poll, choices)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.relations != nil {
+		blocked, err := s.relations.IsBlocked(ctx, user.UserID, []primitive.ObjectID{message.AuthorID})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if blocked {
+			return nil, ErrPollBlocked
+		}
+	}
+
+	updated, err := s.p.Vote(ctx, message.MessageID, user.UserID, choices, helper.GetCurrentTimeMillies())
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	s.emit(ctx, EventPollVoted, updated)
+
+	return s.presentOne(ctx, updated)
+}
+
+// validChoices checks the choices of a vote and returns them sorted
+func validChoices(poll *persistence.Poll, choices []int) ([]int, error) {
+	if len(choices) == 0 || (!poll.Multiple && len(choices) > 1) {
+		return nil, ErrInvalidChoice
+	}
+
+	sorted := append([]int{}, choices...)
+	sort.Ints(sorted)
+
+	for i, choice := range sorted {
+		if choice < 0 || choice >= len(poll.Options) || (i > 0 && sorted[i-1] == choice) {
+			return nil, ErrInvalidChoice
+		}
+	}
+
+	return sorted, nil
+}
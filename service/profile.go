@@ -0,0 +1,319 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ProfileService manages the public profiles of users. The profile is
+// stored with the user, see UserService.
+type ProfileService struct {
+	us         *UserService
+	messages   *persistence.MessagePersistor
+	federation *persistence.FederationPersistor
+}
+
+// Profile is a user as shown on their profile page
+type Profile struct {
+	UserInfo
+	Bio         string     `json:"bio,omitempty"`
+	Website     string     `json:"website,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	Banner      *ImageInfo `json:"banner,omitempty"`
+	MemberSince int64      `json:"memberSince"`
+
+	// Posts counts the published messages without reposts, Followers the
+	// followers on other ActivityPub servers
+	Posts     int64 `json:"posts"`
+	Followers int64 `json:"followers"`
+
+	// KeepProfile is only returned to the user themself
+	KeepProfile *bool `json:"keepProfile,omitempty"`
+}
+
+// ProfileUpdate changes the profile of the user in ctx, fields left nil
+// aren't changed and empty strings remove them (except for the name). With
+// KeepProfile the sign in doesn't overwrite name and avatar with the ones of
+// the OAuth provider anymore.
+type ProfileUpdate struct {
+	Name        *string `json:"name"`
+	Bio         *string `json:"bio"`
+	Website     *string `json:"website"`
+	Location    *string `json:"location"`
+	KeepProfile *bool   `json:"keepProfile"`
+}
+
+const (
+	maxNameLength     = 50
+	maxBioLength      = 300
+	maxWebsiteLength  = 200
+	maxLocationLength = 50
+)
+
+var (
+	ErrInvalidName     = fmt.Errorf("Der Name muss 1 bis %d Zeichen lang sein.", maxNameLength)
+	ErrInvalidBio      = fmt.Errorf("Die Beschreibung darf höchstens %d Zeichen lang sein.", maxBioLength)
+	ErrInvalidWebsite  = fmt.Errorf("Die Website muss eine http(s)-Adresse mit höchstens %d Zeichen sein.", maxWebsiteLength)
+	ErrInvalidLocation = fmt.Errorf("Der Ort darf höchstens %d Zeichen lang sein.", maxLocationLength)
+)
+
+// NewProfileService creates the service, posts are counted in mr and
+// followers in fp.
+func NewProfileService(us *UserService, mr *persistence.MessagePersistor, fp *persistence.FederationPersistor) *ProfileService {
+	return &ProfileService{us, mr, fp}
+}
+
+// GetProfile returns the profile of a user, "me" is the user in ctx.
+func (s *ProfileService) GetProfile(ctx context.Context, id string) (*Profile, error) {
+	own := id == "me"
+
+	if own {
+		user, err := userFromContext(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		id = user.UserID.Hex()
+	}
+
+	user, err := s.us.p.FindById(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := s.toProfile(ctx, user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if own {
+		profile.KeepProfile = &user.KeepProfile
+	}
+
+	return profile, nil
+}
+
+func (s *ProfileService) toProfile(ctx context.Context, user *persistence.User) (*Profile, error) {
+	posts, err := s.messages.CountByAuthor(ctx, user.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	followers, err := s.federation.CountFollowers(ctx, user.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Profile{
+		UserInfo:    *toUserInfo(user),
+		Bio:         user.Bio,
+		Website:     user.Website,
+		Location:    user.Location,
+		Banner:      toImageInfo(user.BannerImage),
+		MemberSince: user.MemberSince,
+		Posts:       posts,
+		Followers:   followers,
+	}, nil
+}
+
+// UpdateProfile validates and stores the changes to the profile of the user
+// in ctx and returns the updated profile.
+func (s *ProfileService) UpdateProfile(ctx context.Context, update ProfileUpdate) (*Profile, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := helper.GetCurrentTimeMillies()
+	set := bson.M{"updated": now}
+	unset := bson.M{}
+
+	if update.Name != nil {
+		name, ok := profileText(*update.Name, maxNameLength, false)
+
+		if !ok || name == "" {
+			return nil, ErrInvalidName
+		}
+
+		set["name"] = name
+	}
+
+	if update.Bio != nil {
+		bio, ok := profileText(*update.Bio, maxBioLength, true)
+
+		if !ok {
+			return nil, ErrInvalidBio
+		}
+
+		setOrUnset(set, unset, "bio", bio)
+	}
+
+	if update.Website != nil {
+		website, ok := profileWebsite(*update.Website)
+
+		if !ok {
+			return nil, ErrInvalidWebsite
+		}
+
+		setOrUnset(set, unset, "website", website)
+	}
+
+	if update.Location != nil {
+		location, ok := profileText(*update.Location, maxLocationLength, false)
+
+		if !ok {
+			return nil, ErrInvalidLocation
+		}
+
+		setOrUnset(set, unset, "location", location)
+	}
+
+	if update.KeepProfile != nil {
+		set["keepProfile"] = *update.KeepProfile
+	}
+
+	updated, err := s.us.p.Update(ctx, user.UserID, set, unset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.us.emit(ctx, EventUserUpdated, updated)
+
+	profile, err := s.toProfile(ctx, updated)
+
+	if err != nil {
+		return nil, err
+	}
+
+	profile.KeepProfile = &updated.KeepProfile
+
+	return profile, nil
+}
+
+func setOrUnset(set bson.M, unset bson.M, field string, value string) {
+	if value == "" {
+		unset[field] = ""
+		return
+	}
+
+	set[field] = value
+}
+
+// profileText trims s and checks its length in characters. Control
+// characters are refused, except for line breaks in multiline texts.
+func profileText(s string, max int, multiline bool) (string, bool) {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n"))
+
+	if !utf8.ValidString(s) || utf8.RuneCountInString(s) > max {
+		return "", false
+	}
+
+	for _, r := range s {
+		if unicode.IsControl(r) && !(multiline && r == '\n') {
+			return "", false
+		}
+	}
+
+	return s, true
+}
+
+// profileWebsite accepts empty strings and absolute http(s) URLs
+func profileWebsite(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+
+	if s == "" {
+		return "", true
+	}
+
+	if len(s) > maxWebsiteLength {
+		return "", false
+	}
+
+	u, err := url.Parse(s)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return "", false
+	}
+
+	return u.String(), true
+}
+
+// SetBanner replaces the profile banner of the user in ctx.
+func (s *ProfileService) SetBanner(ctx context.Context, data []byte) (*Profile, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := s.us.images.Store(ctx, data, BannerSizes, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := s.replaceBanner(ctx, user.UserID, image)
+
+	if err != nil {
+		s.us.images.Delete(ctx, image)
+		return nil, err
+	}
+
+	return s.toProfile(ctx, updated)
+}
+
+// RemoveBanner removes the profile banner of the user in ctx.
+func (s *ProfileService) RemoveBanner(ctx context.Context) (*Profile, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := s.replaceBanner(ctx, user.UserID, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toProfile(ctx, updated)
+}
+
+func (s *ProfileService) replaceBanner(ctx context.Context, id primitive.ObjectID, image *persistence.Image) (*persistence.User, error) {
+	now := helper.GetCurrentTimeMillies()
+	user, err := s.us.p.SetBannerImage(ctx, id, image, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user.BannerImage != nil {
+		if err := s.us.images.Delete(ctx, user.BannerImage); err != nil {
+			log.Println("profile: couldn't delete banner:", err)
+		}
+	}
+
+	user.BannerImage = image
+	user.Updated = now
+
+	s.us.emit(ctx, EventUserUpdated, user)
+
+	return user, nil
+}
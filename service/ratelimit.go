@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: it holds up to Capacity requests and is
+// refilled evenly, Capacity tokens per Period.
+type RateLimit struct {
+	Capacity int
+	Period   time.Duration
+}
+
+// RateLimitStatus is the state of a bucket after a request has been counted.
+type RateLimitStatus struct {
+	Allowed   bool
+	Remaining int
+
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+
+	// RetryAfter is the time until the next request is allowed, if this one wasn't
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the buckets. MemoryRateLimitStore is enough for a
+// single instance, several instances need a shared implementation (e.g. Redis).
+type RateLimitStore interface {
+	// Take removes a token from the bucket stored under key, if there is one.
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitStatus, error)
+}
+
+var ErrInvalidRateLimit = errors.New("invalid rate limit, expected <requests>/<period>, e.g. 10/1m")
+
+// ParseRateLimit parses limits like "10/1m" (10 requests per minute).
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+
+	if len(parts) != 2 {
+		return RateLimit{}, ErrInvalidRateLimit
+	}
+
+	capacity, err := strconv.Atoi(parts[0])
+
+	if err != nil || capacity <= 0 {
+		return RateLimit{}, ErrInvalidRateLimit
+	}
+
+	period, err := time.ParseDuration(parts[1])
+
+	if err != nil || period <= 0 {
+		return RateLimit{}, ErrInvalidRateLimit
+	}
+
+	return RateLimit{capacity, period}, nil
+}
+
+// rate returns the tokens refilled per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Capacity) / l.Period.Seconds()
+}
+
+// MemoryRateLimitStore keeps the buckets in memory.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// rateLimitSweepInterval is the interval full buckets are dropped in
+const rateLimitSweepInterval = time.Minute
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Capacity), last: now}
+		s.buckets[key] = b
+	}
+
+	return b.take(now, limit), nil
+}
+
+// sweep drops buckets, which are full again. They don't differ from new ones.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+
+	for key, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastSweep = now
+}
+
+func (b *bucket) take(now time.Time, limit RateLimit) RateLimitStatus {
+	rate := limit.rate()
+
+	b.tokens = math.Min(float64(limit.Capacity), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	status := RateLimitStatus{}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		status.Allowed = true
+	} else {
+		status.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+
+	status.Remaining = int(b.tokens)
+	status.Reset = seconds((float64(limit.Capacity) - b.tokens) / rate)
+	b.full = now.Add(status.Reset)
+
+	return status
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RateLimit
+		err  error
+	}{
+		{"10/1m", RateLimit{10, time.Minute}, nil},
+		{" 300/1h ", RateLimit{300, time.Hour}, nil},
+		{"1/500ms", RateLimit{1, 500 * time.Millisecond}, nil},
+		{"10", RateLimit{}, ErrInvalidRateLimit},
+		{"0/1m", RateLimit{}, ErrInvalidRateLimit},
+		{"-1/1m", RateLimit{}, ErrInvalidRateLimit},
+		{"10/0s", RateLimit{}, ErrInvalidRateLimit},
+		{"10/minute", RateLimit{}, ErrInvalidRateLimit},
+		{"", RateLimit{}, ErrInvalidRateLimit},
+	}
+
+	for _, test := range tests {
+		got, err := ParseRateLimit(test.in)
+
+		if got != test.want || err != test.err {
+			t.Errorf("ParseRateLimit(%q): got %v, %v, want %v, %v", test.in, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	limit := RateLimit{Capacity: 3, Period: 3 * time.Second}
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		// after is the time since start
+		after time.Duration
+
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst up to the capacity",
+			steps: []step{
+				{0, true, 2, 0, time.Second},
+				{0, true, 1, 0, 2 * time.Second},
+				{0, true, 0, 0, 3 * time.Second},
+				{0, false, 0, time.Second, 3 * time.Second},
+			},
+		},
+		{
+			name: "refill one token per second",
+			steps: []step{
+				{0, true, 2, 0, time.Second},
+				{0, true, 1, 0, 2 * time.Second},
+				{0, true, 0, 0, 3 * time.Second},
+				{500 * time.Millisecond, false, 0, 500 * time.Millisecond, 2500 * time.Millisecond},
+				{time.Second, true, 0, 0, 3 * time.Second},
+				{time.Second, false, 0, time.Second, 3 * time.Second},
+			},
+		},
+		{
+			name: "refill stops at the capacity",
+			steps: []step{
+				{0, true, 2, 0, time.Second},
+				{time.Hour, true, 2, 0, time.Second},
+				{time.Hour, true, 1, 0, 2 * time.Second},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &bucket{tokens: float64(limit.Capacity), last: start}
+
+			for i, s := range test.steps {
+				got := b.take(start.Add(s.after), limit)
+				want := RateLimitStatus{s.allowed, s.remaining, s.reset, s.retryAfter}
+
+				if !durationsEqual(got.Reset, want.Reset) || !durationsEqual(got.RetryAfter, want.RetryAfter) ||
+					got.Allowed != want.Allowed || got.Remaining != want.Remaining {
+					t.Fatalf("step %d: got %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// durationsEqual compares durations computed with floats
+func durationsEqual(a time.Duration, b time.Duration) bool {
+	d := a - b
+	return d > -time.Millisecond && d < time.Millisecond
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	ctx := context.Background()
+	limit := RateLimit{Capacity: 2, Period: time.Hour}
+
+	for i, want := range []bool{true, true, false} {
+		status, err := store.Take(ctx, "a", limit)
+
+		if err != nil || status.Allowed != want {
+			t.Fatalf("a, request %d: got %v, %v, want %v", i, status.Allowed, err, want)
+		}
+	}
+
+	// every key has a bucket of its own
+	if status, _ := store.Take(ctx, "b", limit); !status.Allowed {
+		t.Error("b: got refused, want allowed")
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RelationService manages the users the user in ctx has blocked or muted.
+type RelationService struct {
+	p  *persistence.RelationPersistor
+	us *UserService
+}
+
+// RelatedUser is a blocked or muted user.
+type RelatedUser struct {
+	UserInfo
+	Since int64 `json:"since"`
+}
+
+var ErrSelfRelation = errors.New("Du kannst dich nicht selbst blockieren oder stummschalten.")
+
+func NewRelationService(p *persistence.RelationPersistor, us *UserService) *RelationService {
+	return &RelationService{p, us}
+}
+
+// AddRelation blocks or mutes target.
+func (s *RelationService) AddRelation(ctx context.Context, relationType string, target string) (*RelatedUser, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.us.GetUserInfo(ctx, target)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if info.UserID == user.UserID {
+		return nil, ErrSelfRelation
+	}
+
+	relation, err := s.p.Add(ctx, persistence.Relation{
+		UserID:   user.UserID,
+		TargetID: info.UserID,
+		Type:     relationType,
+		Created:  helper.GetCurrentTimeMillies(),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &RelatedUser{*info, relation.Created}, nil
+}
+
+// RemoveRelation unblocks or unmutes target.
+func (s *RelationService) RemoveRelation(ctx context.Context, relationType string, target string) error {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(target)
+
+	if err != nil {
+		return ErrInvalidObjectID
+	}
+
+	return s.p.Remove(ctx, user.UserID, oid, relationType)
+}
+
+// GetRelations lists the users blocked or muted by the user in ctx, the
+// newest first.
+func (s *RelationService) GetRelations(ctx context.Context, relationType string) (*[]RelatedUser, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	relations, err := s.p.FindByUser(ctx, user.UserID, relationType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(*relations))
+	for i, r := range *relations {
+		ids[i] = r.TargetID.Hex()
+	}
+
+	infos, err := s.us.GetUserInfos(ctx, ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]RelatedUser, len(*relations))
+	for i, r := range *relations {
+		info, ok := infos[r.TargetID.Hex()]
+
+		// the user doesn't exist anymore
+		if !ok {
+			info = &UserInfo{UserID: r.TargetID}
+		}
+
+		users[i] = RelatedUser{*info, r.Created}
+	}
+
+	return &users, nil
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Reasons, why the original of a repost or quote isn't embedded
+const (
+	UnavailableDeleted = "deleted" // deleted or not published (anymore)
+	UnavailableBlocked = "blocked" // the reader and the author of the original have blocked each other
+)
+
+var (
+	ErrQuoteNotFound     = errors.New("Der Beitrag, den du zitieren möchtest, existiert nicht.")
+	ErrRepostUnpublished = errors.New("Nur veröffentlichte Beiträge können geteilt werden.")
+	ErrRepostNotEditable = errors.New("Geteilte Beiträge können nicht bearbeitet werden.")
+)
+
+// Repost shares a message with the followers of the user in ctx. Reposting a
+// message again returns the existing repost, reposting a repost shares its
+// original.
+func (s *MessageService) Repost(ctx context.Context, id string) (*persistence.Message, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	original, err := s.originalById(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if original.Status != "" {
+		return nil, ErrRepostUnpublished
+	}
+
+	current := helper.GetCurrentTimeMillies()
+	repost := persistence.Message{AuthorID: user.UserID, RepostOf: &original.MessageID, Created: current, Updated: current, Version: 1}
+
+	// suspended users can't repost, neither can users blocked by the author
+	err = s.applyPolicy(ctx, &repost)
+
+	if err != nil {
+		return nil, err
+	}
+
+	created, isNew, err := s.p.Repost(ctx, repost)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if isNew {
+		err = s.p.CountReposts(ctx, original.MessageID, 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if created.Status == "" {
+			s.emit(ctx, EventMessageCreated, created)
+		}
+	}
+
+	return s.presentOne(ctx, created)
+}
+
+// Unrepost removes the repost of a message (or of the original of a repost)
+// by the user in ctx.
+func (s *MessageService) Unrepost(ctx context.Context, id string) error {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return ErrInvalidObjectID
+	}
+
+	// the id of the own repost may be passed instead of the original's
+	if message, err := s.p.FindById(ctx, id); err == nil && message.RepostOf != nil {
+		oid = *message.RepostOf
+	}
+
+	deleted, err := s.p.Unrepost(ctx, user.UserID, oid)
+
+	if err != nil {
+		return err
+	}
+
+	s.afterDelete(ctx, deleted)
+
+	return nil
+}
+
+// originalById returns a visible message, for reposts their original
+func (s *MessageService) originalById(ctx context.Context, id string) (*persistence.Message, error) {
+	message, err := s.GetMessageById(ctx, id)
+
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if message.RepostOf == nil {
+		return message, nil
+	}
+
+	if message.Original == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return message.Original, nil
+}
+
+// afterDelete tells the listeners about a deleted message and keeps the
+// reposts consistent: the count of the original of a repost is decreased,
+// the reposts of any other message are removed along with it.
+func (s *MessageService) afterDelete(ctx context.Context, message *persistence.Message) {
+	s.emit(ctx, EventMessageDeleted, message)
+
+	if message.RepostOf != nil {
+		err := s.p.CountReposts(ctx, *message.RepostOf, -1)
+
+		if err != nil {
+			log.Println("repost: couldn't update count:", err)
+		}
+
+		return
+	}
+
+	reposts, err := s.p.DeleteReposts(ctx, message.MessageID)
+
+	if err != nil {
+		log.Println("repost: couldn't remove reposts of deleted message:", err)
+		return
+	}
+
+	for i := range *reposts {
+		s.emit(ctx, EventMessageDeleted, &(*reposts)[i])
+	}
+}
+
+// presentOne prepares a message like present and embeds its original
+func (s *MessageService) presentOne(ctx context.Context, message *persistence.Message) (*persistence.Message, error) {
+	messages := []persistence.Message{*present(ctx, message)}
+	err := s.embedOriginals(ctx, messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &messages[0], nil
+}
+
+// embedOriginals embeds the originals of reposts and quotes as the user in
+// ctx sees them. Originals, which have been deleted or whose author and the
+// user have blocked each other, are replaced by the reason.
+func (s *MessageService) embedOriginals(ctx context.Context, messages []persistence.Message) error {
+	ids := []primitive.ObjectID{}
+	for i := range messages {
+		if ref := originalOf(&messages[i]); ref != nil {
+			ids = append(ids, *ref)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	originals, err := s.findByIds(ctx, ids)
+
+	if err != nil {
+		return err
+	}
+
+	blocks := map[primitive.ObjectID]bool{}
+
+	if user, err := userFromContext(ctx); err == nil && s.relations != nil {
+		authors := []primitive.ObjectID{}
+		for _, o := range originals {
+			authors = append(authors, o.AuthorID)
+		}
+
+		blocks, err = s.relations.Blocks(ctx, user.UserID, authors)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range messages {
+		ref := originalOf(&messages[i])
+
+		if ref == nil {
+			continue
+		}
+
+		original, ok := originals[*ref]
+
+		switch {
+		case !ok || !visible(ctx, original):
+			messages[i].OriginalUnavailable = UnavailableDeleted
+		case blocks[original.AuthorID]:
+			messages[i].OriginalUnavailable = UnavailableBlocked
+		default:
+			messages[i].Original = present(ctx, original)
+		}
+	}
+
+	return nil
+}
+
+func originalOf(message *persistence.Message) *primitive.ObjectID {
+	if message.RepostOf != nil {
+		return message.RepostOf
+	}
+
+	return message.QuoteOf
+}
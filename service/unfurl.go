@@ -0,0 +1,398 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/html"
+)
+
+// UnfurlService adds previews of the links in new and edited messages. Pages
+// are fetched in the background and cached by URL.
+type UnfurlService struct {
+	p        *persistence.PreviewPersistor
+	ms       *MessageService
+	client   *http.Client
+	ttl      time.Duration
+	maxLinks int
+}
+
+var (
+	ErrForbiddenAddress = errors.New("address not allowed")
+	ErrTooManyRedirects = errors.New("too many redirects")
+)
+
+const (
+	// unfurlMaxBody is the part of a page read to find its metadata
+	unfurlMaxBody = 512 << 10
+
+	// maxRedirects is the number of redirects NewPublicClient follows
+	maxRedirects = 3
+
+	unfurlTimeout     = 5 * time.Second
+	unfurlMessageTime = 30 * time.Second
+	unfurlUserAgent   = "GoFeed-LinkPreview/1.0"
+
+	maxPreviewTitle       = 300
+	maxPreviewDescription = 1000
+)
+
+// NewUnfurlService creates the service. Previews are cached for ttl, at most
+// maxLinks links of a message are unfurled.
+func NewUnfurlService(p *persistence.PreviewPersistor, ms *MessageService, ttl time.Duration, maxLinks int) *UnfurlService {
+	return &UnfurlService{p, ms, NewPublicClient(unfurlTimeout), ttl, maxLinks}
+}
+
+// NewPublicClient creates a client, which only connects to public addresses.
+// The address is checked after the name has been resolved, so neither
+// redirects nor DNS rebinding reach internal services. It's used for every
+// URL, which users or remote servers control.
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+
+			if err != nil || !isPublicIP(net.ParseIP(host)) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// proxies would connect on our behalf
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return ErrTooManyRedirects
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, req.URL)
+			}
+
+			return nil
+		},
+	}
+}
+
+// privateNetworks are the ranges, which aren't reachable from the internet
+// or reserved (RFC 6890)
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "100::/64", "2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			panic(err)
+		}
+
+		networks[i] = network
+	}
+
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// OnMessageEvent unfurls the links of published messages.
+// It's meant to be registered with MessageService.Subscribe.
+func (s *UnfurlService) OnMessageEvent(e MessageEvent) {
+	if (e.Type != EventMessageCreated && e.Type != EventMessageUpdated) || e.Message.Status != "" {
+		return
+	}
+
+	// messages without links don't need a request
+	if len(e.Message.Previews) == 0 && len(extractLinks(e.Message.Content, 1)) == 0 {
+		return
+	}
+
+	go s.unfurlMessage(e.Message)
+}
+
+func (s *UnfurlService) unfurlMessage(message *persistence.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlMessageTime)
+	defer cancel()
+
+	previews := []persistence.LinkPreview{}
+
+	for _, link := range extractLinks(message.Content, s.maxLinks) {
+		preview, err := s.Preview(ctx, link)
+
+		if err != nil {
+			log.Printf("unfurl: couldn't preview %s: %v\n", link, err)
+			continue
+		}
+
+		if preview != nil {
+			previews = append(previews, *preview)
+		}
+	}
+
+	// nothing to store, e.g. after an edit which kept the links
+	if reflect.DeepEqual(previews, message.Previews) || (len(previews) == 0 && len(message.Previews) == 0) {
+		return
+	}
+
+	_, err := s.ms.SetPreviews(ctx, message.MessageID, message.Content, previews)
+
+	// the message has been edited or deleted, its own event takes care of it
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("unfurl: couldn't store previews:", err)
+	}
+}
+
+// Preview returns the preview of a page, nil if it has none. Previews are
+// cached, pages without previews as well.
+func (s *UnfurlService) Preview(ctx context.Context, link string) (*persistence.LinkPreview, error) {
+	now := helper.GetCurrentTimeMillies()
+	cached, err := s.p.Find(ctx, link)
+
+	if err == nil && cached.Fetched > now-s.ttl.Milliseconds() {
+		return cached.Preview, nil
+	}
+
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	preview, err := s.fetch(ctx, link)
+
+	if err != nil {
+		// failures are cached as well, the page isn't requested again until the entry expires
+		log.Printf("unfurl: %s: %v\n", link, err)
+	}
+
+	return preview, s.p.Store(ctx, persistence.CachedPreview{URL: link, Preview: preview, Fetched: now})
+}
+
+// Run removes expired cache entries until ctx is cancelled.
+func (s *UnfurlService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := s.p.DeleteExpired(ctx, helper.GetCurrentTimeMillies()-s.ttl.Milliseconds())
+
+		if err != nil {
+			log.Println("unfurl: couldn't remove expired previews:", err)
+		}
+	}
+}
+
+// fetch requests a page and reads its metadata
+func (s *UnfurlService) fetch(ctx context.Context, link string) (*persistence.LinkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", unfurlUserAgent)
+	req.Header.Set("Accept", "text/html")
+
+	res, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unexpected content type %q", mediaType)
+	}
+
+	return parsePreview(io.LimitReader(res.Body, unfurlMaxBody), link, res.Request.URL), nil
+}
+
+// parsePreview reads the Open Graph and Twitter card metadata of a page,
+// falling back to its title and description. Relative image URLs are
+// resolved against base (the URL after redirects).
+func parsePreview(r io.Reader, link string, base *url.URL) *persistence.LinkPreview {
+	meta := map[string]string{}
+	title := ""
+	inTitle := false
+
+	z := html.NewTokenizer(r)
+
+	for done := false; !done; {
+		switch z.Next() {
+		case html.ErrorToken:
+			done = true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+
+			switch string(name) {
+			case "body":
+				// the metadata is in the head
+				done = true
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = string(v)
+					}
+				}
+
+				// the first occurrence wins
+				if _, ok := meta[key]; key != "" && !ok {
+					meta[key] = strings.TrimSpace(content)
+				}
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				inTitle = false
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := meta[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	preview := &persistence.LinkPreview{
+		URL:         link,
+		Title:       truncate(first("og:title", "twitter:title"), maxPreviewTitle),
+		Description: truncate(first("og:description", "twitter:description", "description"), maxPreviewDescription),
+		SiteName:    truncate(first("og:site_name"), maxPreviewTitle),
+	}
+
+	if preview.Title == "" {
+		preview.Title = truncate(title, maxPreviewTitle)
+	}
+
+	if src := first("og:image", "og:image:url", "twitter:image", "twitter:image:src"); src != "" {
+		if image, err := base.Parse(src); err == nil && image.Host != "" && (image.Scheme == "http" || image.Scheme == "https") {
+			preview.Image = image.String()
+		}
+	}
+
+	if preview.Title == "" && preview.Description == "" && preview.Image == "" {
+		return nil
+	}
+
+	return preview
+}
+
+// extractLinks returns the first max distinct http(s) links in content
+func extractLinks(content string, max int) []string {
+	links := []string{}
+
+	for _, match := range linkPattern.FindAllString(content, -1) {
+		if len(links) >= max {
+			break
+		}
+
+		match = trimLink(match)
+
+		if strings.HasPrefix(strings.ToLower(match), "www.") {
+			match = "https://" + match
+		}
+
+		u, err := url.Parse(match)
+
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		u.Fragment = ""
+
+		if link := u.String(); !contains(links, link) {
+			links = append(links, link)
+		}
+	}
+
+	return links
+}
+
+// truncate shortens s to max runes and removes invalid UTF-8
+func truncate(s string, max int) string {
+	s = strings.ToValidUTF8(s, "")
+
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	return string([]rune(s)[:max-1]) + "…"
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		// public addresses
+		{"93.184.216.34", true},
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"::ffff:93.184.216.34", true},
+
+		// private, loopback and link-local addresses
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+
+		// IPv4-mapped IPv6 addresses count as IPv4
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+
+		// reserved ranges
+		{"192.0.2.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"ff02::1", false},
+		{"64:ff9b::7f00:1", false},
+	}
+
+	for _, test := range tests {
+		if got := isPublicIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("isPublicIP(%s): got %v, want %v", test.ip, got, test.want)
+		}
+	}
+
+	if isPublicIP(nil) {
+		t.Error("isPublicIP(nil): got true, want false")
+	}
+}
+
+func TestPublicClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	_, err := NewPublicClient(time.Second).Get(server.URL)
+
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("got %v, want %v", err, ErrForbiddenAddress)
+	}
+}
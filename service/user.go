@@ -2,25 +2,69 @@ package service
 
 import (
 	"context"
+	"errors"
 	"gofeed-go/helper"
 	"gofeed-go/persistence"
+	"log"
 
 	"github.com/markbates/goth"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type UserService struct {
-	p *persistence.UserPersistor
+	p         *persistence.UserPersistor
+	images    *ImageService
+	listeners []UserListener
 }
 
+// UserEvent is emitted after a user has been written successfully.
+type UserEvent struct {
+	Type string
+	User *persistence.User
+}
+
+// UserListener gets notified about every UserEvent. Listeners are called
+// synchronously and must hand off long running work themselves.
+type UserListener func(event UserEvent)
+
+const (
+	EventUserSignedIn = "user.signed_in"
+	EventUserUpdated  = "user.updated"
+)
+
+var ErrSuspended = errors.New("Dein Konto wurde gesperrt.")
+
 type UserInfo struct {
 	UserID primitive.ObjectID `json:"id"`
 	Name   string             `json:"name"`
 	Avatar string             `json:"avatar"`
+
+	// AvatarImage describes the variants of a custom avatar
+	AvatarImage *ImageInfo `json:"avatarImage,omitempty"`
+
+	// Updated is the time the profile was last synced with the OAuth provider
+	// or changed by the user
+	Updated int64 `json:"-"`
+}
+
+// NewUserService creates the service, custom avatars are processed by images.
+func NewUserService(p *persistence.UserPersistor, images *ImageService) *UserService {
+	return &UserService{p: p, images: images}
+}
+
+// Subscribe registers a listener for user events. It must be called before
+// the service is in use.
+func (s *UserService) Subscribe(l UserListener) {
+	s.listeners = append(s.listeners, l)
 }
 
-func NewUserService(p *persistence.UserPersistor) *UserService {
-	return &UserService{p}
+func (s *UserService) emit(ctx context.Context, eventType string, user *persistence.User) {
+	dispatch(ctx, func() {
+		for _, l := range s.listeners {
+			l(UserEvent{eventType, user})
+		}
+	})
 }
 
 func (s *UserService) UserSignedIn(ctx context.Context, gothUser goth.User) (*persistence.User, error) {
@@ -28,28 +72,38 @@ func (s *UserService) UserSignedIn(ctx context.Context, gothUser goth.User) (*pe
 
 	user, err := s.p.FindByProvider(ctx, gothUser.Provider, gothUser.UserID)
 
+	if err == nil && user.Suspended {
+		return nil, ErrSuspended
+	}
+
 	if err != nil || user == nil {
 		user, err = s.p.Create(ctx, persistence.User{
 			ProviderID:  gothUser.UserID,
 			Provider:    gothUser.Provider,
 			Name:        gothUser.Name,
 			Avatar:      gothUser.AvatarURL,
-			Group:       "user",
+			Group:       GroupUser,
 			MemberSince: millis,
 			LastLogin:   millis,
 		})
 	} else {
-		user, err = s.p.Update(ctx, user.UserID.Hex(), persistence.User{
-			Name:      gothUser.Name,
-			Avatar:    gothUser.AvatarURL,
-			LastLogin: millis,
-		})
+		set := bson.M{"last_login": millis}
+
+		// names and avatars chosen by the user aren't overwritten, see ProfileUpdate
+		if !user.KeepProfile {
+			set["name"] = gothUser.Name
+			set["avatar"] = gothUser.AvatarURL
+		}
+
+		user, err = s.p.Update(ctx, user.UserID, set, nil)
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
+	s.emit(ctx, EventUserSignedIn, user)
+
 	return user, nil
 }
 
@@ -60,5 +114,128 @@ func (s *UserService) GetUserInfo(ctx context.Context, id string) (*UserInfo, er
 		return nil, err
 	}
 
-	return &UserInfo{UserID: user.UserID, Name: user.Name, Avatar: user.Avatar}, nil
+	return toUserInfo(user), nil
+}
+
+// GetUserInfos loads the information of several users at once. Users that
+// don't exist are missing in the result.
+func (s *UserService) GetUserInfos(ctx context.Context, ids []string) (map[string]*UserInfo, error) {
+	oids := []primitive.ObjectID{}
+
+	for _, id := range ids {
+		if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+			oids = append(oids, oid)
+		}
+	}
+
+	infos := map[string]*UserInfo{}
+
+	if len(oids) == 0 {
+		return infos, nil
+	}
+
+	users, err := s.p.FindByIds(ctx, oids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range *users {
+		infos[user.UserID.Hex()] = toUserInfo(&user)
+	}
+
+	return infos, nil
+}
+
+func toUserInfo(user *persistence.User) *UserInfo {
+	info := &UserInfo{UserID: user.UserID, Name: user.Name, Avatar: user.Avatar, Updated: max64(user.LastLogin, user.Updated)}
+
+	// the largest variant of a custom avatar replaces the one of the provider
+	if image := toImageInfo(user.AvatarImage); image != nil && len(image.Variants) > 0 {
+		info.AvatarImage = image
+		info.Avatar = image.Variants[len(image.Variants)-1].URL
+	}
+
+	return info
+}
+
+// SetAvatar replaces the avatar of the user in ctx by a custom image. The
+// provider's avatar is used again, once the custom avatar has been removed.
+func (s *UserService) SetAvatar(ctx context.Context, data []byte) (*UserInfo, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := s.images.Store(ctx, data, AvatarSizes, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := s.replaceAvatar(ctx, user.UserID, image)
+
+	if err != nil {
+		s.images.Delete(ctx, image)
+		return nil, err
+	}
+
+	return toUserInfo(updated), nil
+}
+
+// RemoveAvatar removes the custom avatar of the user in ctx.
+func (s *UserService) RemoveAvatar(ctx context.Context) (*UserInfo, error) {
+	user, err := userFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := s.replaceAvatar(ctx, user.UserID, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return toUserInfo(updated), nil
+}
+
+func (s *UserService) replaceAvatar(ctx context.Context, id primitive.ObjectID, image *persistence.Image) (*persistence.User, error) {
+	now := helper.GetCurrentTimeMillies()
+	user, err := s.p.SetAvatarImage(ctx, id, image, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user.AvatarImage != nil {
+		if err := s.images.Delete(ctx, user.AvatarImage); err != nil {
+			log.Println("user: couldn't delete avatar:", err)
+		}
+	}
+
+	user.AvatarImage = image
+	user.Updated = now
+
+	s.emit(ctx, EventUserUpdated, user)
+
+	return user, nil
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// WarnUser records a warning issued by a moderator.
+func (s *UserService) WarnUser(ctx context.Context, id primitive.ObjectID) error {
+	return s.p.AddWarning(ctx, id)
+}
+
+// SuspendUser keeps a user from signing in and writing messages.
+func (s *UserService) SuspendUser(ctx context.Context, id primitive.ObjectID, suspended bool) error {
+	return s.p.SetSuspended(ctx, id, suspended)
 }
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// UserLoader batches and caches user lookups for the lifetime of a single
+// request. Loads issued within a short window are combined into one query.
+type UserLoader struct {
+	ctx     context.Context
+	us      *UserService
+	mu      sync.Mutex
+	cache   map[string]*userLoad
+	pending []string
+}
+
+type userLoad struct {
+	done chan struct{}
+	user *UserInfo
+	err  error
+}
+
+// userLoaderWait is the time loads are collected, before they are sent as batch
+const userLoaderWait = 2 * time.Millisecond
+
+func NewUserLoader(ctx context.Context, us *UserService) *UserLoader {
+	return &UserLoader{ctx: ctx, us: us, cache: map[string]*userLoad{}}
+}
+
+// Prime puts already loaded users into the cache.
+func (l *UserLoader) Prime(users map[string]*UserInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id, user := range users {
+		if _, ok := l.cache[id]; !ok {
+			load := &userLoad{done: make(chan struct{}), user: user}
+			close(load.done)
+			l.cache[id] = load
+		}
+	}
+}
+
+// Load returns the user with the given id or nil, if it doesn't exist.
+func (l *UserLoader) Load(id string) (*UserInfo, error) {
+	l.mu.Lock()
+	load, ok := l.cache[id]
+
+	if !ok {
+		load = &userLoad{done: make(chan struct{})}
+		l.cache[id] = load
+		l.pending = append(l.pending, id)
+
+		// the first load of a batch schedules it
+		if len(l.pending) == 1 {
+			time.AfterFunc(userLoaderWait, l.dispatch)
+		}
+	}
+	l.mu.Unlock()
+
+	<-load.done
+	return load.user, load.err
+}
+
+// LoadMany loads several users with a single query, unless they are cached.
+func (l *UserLoader) LoadMany(ids []string) (map[string]*UserInfo, error) {
+	l.mu.Lock()
+	missing := []string{}
+	for _, id := range ids {
+		if _, ok := l.cache[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	l.mu.Unlock()
+
+	if len(missing) > 0 {
+		users, err := l.us.GetUserInfos(l.ctx, missing)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// unknown users are cached as well
+		for _, id := range missing {
+			if _, ok := users[id]; !ok {
+				users[id] = nil
+			}
+		}
+
+		l.Prime(users)
+	}
+
+	result := map[string]*UserInfo{}
+	for _, id := range ids {
+		user, err := l.Load(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if user != nil {
+			result[id] = user
+		}
+	}
+
+	return result, nil
+}
+
+func (l *UserLoader) dispatch() {
+	l.mu.Lock()
+	ids := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	users, err := l.us.GetUserInfos(l.ctx, ids)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, id := range ids {
+		load := l.cache[id]
+		load.err = err
+
+		if err == nil {
+			load.user = users[id]
+		}
+
+		close(load.done)
+	}
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gofeed-go/helper"
+	"gofeed-go/persistence"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WebhookService notifies registered webhooks about message and user events.
+// Deliveries are queued in the database and sent by Run, failed deliveries
+// are retried with exponential backoff.
+type WebhookService struct {
+	p      *persistence.WebhookPersistor
+	client *http.Client
+
+	// events holds the events the listeners received, until Run queues
+	// their deliveries
+	events chan webhookEvent
+}
+
+type webhookEvent struct {
+	event   string
+	payload []byte
+	created int64
+}
+
+const (
+	webhookPollInterval = 5 * time.Second
+	webhookLockDuration = time.Minute
+	webhookRetryBase    = 30 * time.Second
+	webhookMaxAttempts  = 8
+	webhookEnqueueTime  = 5 * time.Second
+	webhookLogSize      = 50
+
+	// webhookBacklog is the number of events waiting to be queued, further
+	// events are dropped
+	webhookBacklog = 1000
+)
+
+// WebhookEvents are the events webhooks can subscribe to.
+var WebhookEvents = []string{EventMessageCreated, EventMessageUpdated, EventMessageDeleted, EventPollVoted, EventUserSignedIn, EventUserUpdated}
+
+var (
+	ErrUnknownEvent = errors.New("unknown event")
+)
+
+// WebhookPayload is the body posted to webhooks.
+type WebhookPayload struct {
+	Event   string      `json:"event"`
+	Created int64       `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+func NewWebhookService(p *persistence.WebhookPersistor, client *http.Client) *WebhookService {
+	return &WebhookService{p, client, make(chan webhookEvent, webhookBacklog)}
+}
+
+// CreateWebhook registers a webhook. If no secret is given, one is generated.
+// The secret is only returned on creation.
+func (s *WebhookService) CreateWebhook(ctx context.Context, creator primitive.ObjectID, webhook persistence.Webhook) (*persistence.Webhook, error) {
+	for _, e := range webhook.Events {
+		if !contains(WebhookEvents, e) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, e)
+		}
+	}
+
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook.WebhookID = primitive.NilObjectID
+	webhook.CreatedBy = creator
+	webhook.Created = helper.GetCurrentTimeMillies()
+
+	return s.p.Create(ctx, webhook)
+}
+
+func (s *WebhookService) GetWebhooks(ctx context.Context) (*[]persistence.Webhook, error) {
+	webhooks, err := s.p.Find(ctx, bson.M{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range *webhooks {
+		(*webhooks)[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+func (s *WebhookService) GetWebhook(ctx context.Context, id string) (*persistence.Webhook, error) {
+	webhook, err := s.p.FindById(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.Secret = ""
+
+	return webhook, nil
+}
+
+func (s *WebhookService) DeleteWebhook(ctx context.Context, id string) error {
+	return s.p.Delete(ctx, id)
+}
+
+func (s *WebhookService) GetDeliveries(ctx context.Context, webhook string) (*[]persistence.Delivery, error) {
+	return s.p.FindDeliveries(ctx, webhook, webhookLogSize)
+}
+
+// Redeliver queues the payload of a previous delivery again.
+func (s *WebhookService) Redeliver(ctx context.Context, webhook string, id string) (*persistence.Delivery, error) {
+	delivery, err := s.p.FindDelivery(ctx, webhook, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := helper.GetCurrentTimeMillies()
+
+	return s.p.Enqueue(ctx, persistence.Delivery{
+		WebhookID:    delivery.WebhookID,
+		Event:        delivery.Event,
+		Payload:      delivery.Payload,
+		Status:       persistence.DeliveryPending,
+		NextAttempt:  now,
+		RedeliveryOf: delivery.DeliveryID,
+		Created:      now,
+	})
+}
+
+// OnMessageEvent queues deliveries for message events.
+// It's meant to be registered with MessageService.Subscribe.
+func (s *WebhookService) OnMessageEvent(e MessageEvent) {
+	if !contains(WebhookEvents, e.Type) {
+		return
+	}
+
+	s.enqueue(e.Type, e.Message)
+}
+
+// OnUserEvent queues deliveries for user events.
+// It's meant to be registered with UserService.Subscribe.
+func (s *WebhookService) OnUserEvent(e UserEvent) {
+	s.enqueue(e.Type, toUserInfo(e.User))
+}
+
+// enqueue hands event over to Run, the listeners mustn't wait for the
+// database. The payload is encoded right away, as data may change later on.
+func (s *WebhookService) enqueue(event string, data interface{}) {
+	now := helper.GetCurrentTimeMillies()
+	payload, err := json.Marshal(WebhookPayload{event, now, data})
+
+	if err != nil {
+		log.Println("webhook: couldn't encode payload:", err)
+		return
+	}
+
+	select {
+	case s.events <- webhookEvent{event, payload, now}:
+	default:
+		log.Println("webhook: backlog full, dropped", event)
+	}
+}
+
+// store stores a delivery for every webhook subscribed to the event.
+func (s *WebhookService) store(e webhookEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookEnqueueTime)
+	defer cancel()
+
+	webhooks, err := s.p.Find(ctx, bson.M{"events": e.event})
+
+	if err != nil {
+		log.Println("webhook: couldn't load webhooks:", err)
+		return
+	}
+
+	for _, w := range *webhooks {
+		_, err := s.p.Enqueue(ctx, persistence.Delivery{
+			WebhookID:   w.WebhookID,
+			Event:       e.event,
+			Payload:     string(e.payload),
+			Status:      persistence.DeliveryPending,
+			NextAttempt: e.created,
+			Created:     e.created,
+		})
+
+		if err != nil {
+			log.Printf("webhook: couldn't queue %s for %s: %v\n", e.event, w.WebhookID.Hex(), err)
+		}
+	}
+}
+
+// Run queues the deliveries of new events and sends queued deliveries until
+// ctx is cancelled. Several instances may run concurrently, deliveries are
+// locked while they are being sent.
+func (s *WebhookService) Run(ctx context.Context) {
+	// one goroutine keeps the deliveries in the order of the events
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-s.events:
+				s.store(e)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// send everything that is due, before waiting for the next tick
+		for s.deliverNext(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverNext sends the next due delivery and reports whether there was one.
+func (s *WebhookService) deliverNext(ctx context.Context) bool {
+	now := helper.GetCurrentTimeMillies()
+	delivery, err := s.p.ClaimDue(ctx, now, now+webhookLockDuration.Milliseconds())
+
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+
+	if err != nil {
+		log.Println("webhook: couldn't claim delivery:", err)
+		return false
+	}
+
+	webhook, err := s.p.FindById(ctx, delivery.WebhookID.Hex())
+
+	if err != nil {
+		// the webhook has been deleted in the meantime
+		delivery.Error = err.Error()
+		delivery.Status = persistence.DeliveryFailed
+	} else {
+		s.attempt(ctx, webhook, delivery)
+	}
+
+	if err := s.p.SaveAttempt(ctx, *delivery); err != nil {
+		log.Println("webhook: couldn't save delivery:", err)
+	}
+
+	return true
+}
+
+// attempt posts a delivery once and updates its state.
+func (s *WebhookService) attempt(ctx context.Context, webhook *persistence.Webhook, delivery *persistence.Delivery) {
+	delivery.Attempts++
+	delivery.LastAttempt = helper.GetCurrentTimeMillies()
+	delivery.ResponseStatus = 0
+	delivery.Error = ""
+
+	status, err := s.post(ctx, webhook, delivery)
+	delivery.ResponseStatus = status
+
+	if err == nil {
+		delivery.Status = persistence.DeliverySucceeded
+		return
+	}
+
+	delivery.Error = err.Error()
+
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Status = persistence.DeliveryFailed
+		return
+	}
+
+	// 30s, 1m, 2m, 4m, ...
+	backoff := webhookRetryBase * time.Duration(1<<uint(delivery.Attempts-1))
+	delivery.NextAttempt = delivery.LastAttempt + backoff.Milliseconds()
+}
+
+func (s *WebhookService) post(ctx context.Context, webhook *persistence.Webhook, delivery *persistence.Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoFeed-Webhook")
+	req.Header.Set("X-GoFeed-Event", delivery.Event)
+	req.Header.Set("X-GoFeed-Delivery", delivery.DeliveryID.Hex())
+	req.Header.Set("X-GoFeed-Signature", "sha256="+SignPayload(webhook.Secret, []byte(delivery.Payload)))
+
+	res, err := s.client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+// SignPayload returns the hex encoded HMAC-SHA256 of payload, which receivers
+// compare with the X-GoFeed-Signature header.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
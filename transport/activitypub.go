@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ActivityPubController struct {
+	s *service.FederationService
+}
+
+// maxInboxBody limits the size of activities posted to an inbox
+const maxInboxBody = 1 << 20
+
+func NewActivityPubController(s *service.FederationService) *ActivityPubController {
+	return &ActivityPubController{s}
+}
+
+func (c *ActivityPubController) RegisterRoutes(router *mux.Router) {
+
+	router.HandleFunc("/.well-known/webfinger", c.getWebFinger).Methods("GET")
+
+	router.HandleFunc("/ap/users/{id}", c.getActor).Methods("GET")
+	router.HandleFunc("/ap/users/{id}/outbox", c.getOutbox).Methods("GET")
+	router.HandleFunc("/ap/users/{id}/followers", c.getFollowers).Methods("GET")
+	router.HandleFunc("/ap/notes/{id}", c.getNote).Methods("GET")
+
+	// Requests to the inbox are authenticated by HTTP Signatures
+	router.HandleFunc("/ap/users/{id}/inbox", c.postInbox).Methods("POST")
+
+	fmt.Println("ActivityPub routes registered")
+}
+
+func (c *ActivityPubController) getWebFinger(w http.ResponseWriter, req *http.Request) {
+	resource := req.URL.Query().Get("resource")
+
+	if resource == "" {
+		http.Error(w, "Missing param: resource", http.StatusBadRequest)
+		return
+	}
+
+	finger, err := c.s.WebFinger(req.Context(), resource)
+
+	if err == service.ErrUnknownResource {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeActivityJSON(w, "application/jrd+json", finger, err)
+}
+
+func (c *ActivityPubController) getActor(w http.ResponseWriter, req *http.Request) {
+	actor, err := c.s.GetActor(req.Context(), mux.Vars(req)["id"])
+	writeActivityJSON(w, service.ActivityContentType, actor, err)
+}
+
+func (c *ActivityPubController) getOutbox(w http.ResponseWriter, req *http.Request) {
+	outbox, err := c.s.GetOutbox(req.Context(), mux.Vars(req)["id"])
+	writeActivityJSON(w, service.ActivityContentType, outbox, err)
+}
+
+func (c *ActivityPubController) getFollowers(w http.ResponseWriter, req *http.Request) {
+	followers, err := c.s.GetFollowers(req.Context(), mux.Vars(req)["id"])
+	writeActivityJSON(w, service.ActivityContentType, followers, err)
+}
+
+func (c *ActivityPubController) getNote(w http.ResponseWriter, req *http.Request) {
+	note, err := c.s.GetNote(req.Context(), mux.Vars(req)["id"])
+	writeActivityJSON(w, service.ActivityContentType, note, err)
+}
+
+func (c *ActivityPubController) postInbox(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxInboxBody))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = c.s.HandleInbox(req.Context(), mux.Vars(req)["id"], req, body)
+
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errors.Is(err, service.ErrUnverified):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case err == mongo.ErrNoDocuments, err == persistence.ErrInvalidObjectID:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == service.ErrInvalidActivity:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == service.ErrActorMismatch:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeActivityJSON(w http.ResponseWriter, contentType string, v interface{}, err error) {
+	if err == mongo.ErrNoDocuments || err == persistence.ErrInvalidObjectID {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gofeed-go/service"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AttachmentController handles uploads, which can be attached to messages.
+type AttachmentController struct {
+	s       *service.AttachmentService
+	a       *service.AuthService
+	maxSize int64
+}
+
+// multipartOverhead is the size allowed for the multipart framing of an upload
+const multipartOverhead = 64 << 10
+
+// uploadMemory is the part of an upload kept in memory, the rest is buffered on disk
+const uploadMemory = 1 << 20
+
+func NewAttachmentController(s *service.AttachmentService, a *service.AuthService, maxSize int64) *AttachmentController {
+	return &AttachmentController{s, a, maxSize}
+}
+
+func (c *AttachmentController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/attachment", c.a.Middleware(c.postAttachment)).Methods("POST")
+	router.HandleFunc("/attachment/{id}", c.a.OptionalMiddleware(c.getAttachment)).Methods("GET")
+
+	fmt.Println("Attachment routes registered")
+}
+
+// postAttachment stores the file sent as multipart/form-data field "file"
+func (c *AttachmentController) postAttachment(w http.ResponseWriter, req *http.Request) {
+	file, header, ok := formFile(w, req, c.maxSize)
+
+	if !ok {
+		return
+	}
+
+	defer file.Close()
+
+	attachment, err := c.s.Upload(req.Context(), header.Filename, file, header.Size)
+
+	switch {
+	case err == service.ErrAttachmentTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, service.ErrUnsupportedFileType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(attachment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// formFile reads the file sent as multipart/form-data field "file". Files
+// larger than maxSize are refused with 413. If ok is false, an error has been
+// written already.
+func formFile(w http.ResponseWriter, req *http.Request, maxSize int64) (file multipart.File, header *multipart.FileHeader, ok bool) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxSize+multipartOverhead)
+	err := req.ParseMultipartForm(uploadMemory)
+
+	if err != nil {
+		// MaxBytesReader doesn't export its error
+		if strings.Contains(err.Error(), "request body too large") {
+			http.Error(w, service.ErrAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return nil, nil, false
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	file, header, err = req.FormFile("file")
+
+	if err != nil {
+		req.MultipartForm.RemoveAll()
+		http.Error(w, "Missing file: "+err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	if header.Size > maxSize {
+		file.Close()
+		req.MultipartForm.RemoveAll()
+		http.Error(w, service.ErrAttachmentTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return nil, nil, false
+	}
+
+	return multipartFile{file, req.MultipartForm}, header, true
+}
+
+// multipartFile removes the temporary files of the form, once it's closed
+type multipartFile struct {
+	multipart.File
+	form *multipart.Form
+}
+
+func (f multipartFile) Close() error {
+	err := f.File.Close()
+	f.form.RemoveAll()
+	return err
+}
+
+func (c *AttachmentController) getAttachment(w http.ResponseWriter, req *http.Request) {
+	attachment, content, err := c.s.Open(req.Context(), mux.Vars(req)["id"])
+
+	switch {
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrInvalidObjectID:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer content.Close()
+
+	// images are displayed, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+
+	io.Copy(w, content)
+}
@@ -0,0 +1,262 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// BatchController executes several API requests at once. The sub-requests
+// are dispatched through the router, like they were sent separately.
+type BatchController struct {
+	t           *persistence.Transactor
+	router      http.Handler
+	maxRequests int
+	concurrency int
+}
+
+type batchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type batchResult struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body,omitempty"`
+}
+
+var (
+	ErrInvalidBatch    = errors.New("a batch must contain at least one request")
+	ErrBatchTooLarge   = errors.New("too many requests in batch")
+	ErrNestedBatch     = errors.New("batches can't be nested")
+	ErrInvalidPath     = errors.New("path must start with /")
+	ErrBatchRolledBack = errors.New("rolled back, because another request of the batch failed")
+)
+
+// forwardingHeaders tell about the client and the proxies in between, they
+// are taken from the batch request and never from the sub-requests
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+func NewBatchController(t *persistence.Transactor, maxRequests int, concurrency int) *BatchController {
+	return &BatchController{t: t, maxRequests: maxRequests, concurrency: concurrency}
+}
+
+// RegisterRoutes registers /batch, sub-requests are dispatched through router.
+func (c *BatchController) RegisterRoutes(router *mux.Router) {
+	c.router = router
+
+	router.HandleFunc("/batch", c.postBatch).Methods("POST")
+
+	fmt.Println("Batch routes registered")
+}
+
+// postBatch executes the requests of the batch and returns their results in
+// the same order. With ?atomic=true the requests are executed one after
+// another in a transaction, which is rolled back if any of them fails.
+func (c *BatchController) postBatch(w http.ResponseWriter, req *http.Request) {
+	var requests []batchRequest
+	err := json.NewDecoder(req.Body).Decode(&requests)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(requests) == 0 {
+		http.Error(w, ErrInvalidBatch.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(requests) > c.maxRequests {
+		http.Error(w, fmt.Sprintf("%s (max. %d)", ErrBatchTooLarge, c.maxRequests), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchResult, len(requests))
+
+	if req.URL.Query().Get("atomic") == "true" {
+		err = c.executeAtomic(req, requests, results)
+	} else {
+		c.execute(req, requests, results)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// execute dispatches the requests concurrently, at most c.concurrency at a time
+func (c *BatchController) execute(req *http.Request, requests []batchRequest, results []batchResult) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, c.concurrency)
+
+	for i := range requests {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.dispatch(req.Context(), req, requests[i])
+			<-slots
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// executeAtomic dispatches the requests in a transaction. If one of them
+// fails, the others are reported as rolled back. Events are only passed on
+// to listeners (webhooks, federation, ...) after the transaction has been
+// committed. An error is returned, if the transaction itself fails.
+func (c *BatchController) executeAtomic(req *http.Request, requests []batchRequest, results []batchResult) error {
+	ctx, release := service.DeferEvents(req.Context())
+	failed := -1
+
+	err := c.t.WithTransaction(ctx, func(ctx context.Context) error {
+		for i := range requests {
+			results[i] = c.dispatch(ctx, req, requests[i])
+
+			if results[i].Status >= http.StatusBadRequest {
+				failed = i
+				return ErrBatchRolledBack
+			}
+		}
+		return nil
+	})
+
+	release(err == nil)
+
+	if err != nil && failed == -1 {
+		return err
+	}
+
+	if err != nil {
+		for i := range results {
+			if i != failed {
+				results[i] = batchResult{Status: http.StatusFailedDependency, Body: ErrBatchRolledBack.Error()}
+			}
+		}
+	}
+
+	return nil
+}
+
+// dispatch sends a sub-request through the router. It's authenticated with
+// the credentials of the caller.
+func (c *BatchController) dispatch(ctx context.Context, caller *http.Request, r batchRequest) batchResult {
+	if !strings.HasPrefix(r.Path, "/") {
+		return batchResult{Status: http.StatusBadRequest, Body: ErrInvalidPath.Error()}
+	}
+
+	var body io.Reader
+	if len(r.Body) > 0 {
+		body = bytes.NewReader(r.Body)
+	}
+
+	sub, err := http.NewRequestWithContext(ctx, strings.ToUpper(r.Method), r.Path, body)
+
+	if err != nil {
+		return batchResult{Status: http.StatusBadRequest, Body: err.Error()}
+	}
+
+	if sub.URL.Path == "/batch" {
+		return batchResult{Status: http.StatusBadRequest, Body: ErrNestedBatch.Error()}
+	}
+
+	for k, v := range r.Headers {
+		sub.Header.Set(k, v)
+	}
+
+	// sub-requests can't use other credentials than the batch itself, nor
+	// pose as other clients to the rate limiter
+	sub.Header.Del("Authorization")
+	if auth := caller.Header.Get("Authorization"); auth != "" {
+		sub.Header.Set("Authorization", auth)
+	}
+
+	for _, h := range forwardingHeaders {
+		sub.Header.Del(h)
+
+		if values := caller.Header.Values(h); len(values) > 0 {
+			sub.Header[h] = append([]string(nil), values...)
+		}
+	}
+
+	if body != nil && sub.Header.Get("Content-Type") == "" {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+
+	sub.RemoteAddr = caller.RemoteAddr
+
+	rec := &batchRecorder{header: http.Header{}}
+	c.router.ServeHTTP(rec, sub)
+
+	return rec.result()
+}
+
+// batchRecorder captures the response of a sub-request
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// result returns the captured response. JSON bodies are embedded as they
+// are, other bodies (e.g. error messages) as string.
+func (r *batchRecorder) result() batchResult {
+	res := batchResult{Status: r.status, Headers: map[string]string{}}
+
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+
+	for k := range r.header {
+		res.Headers[k] = r.header.Get(k)
+	}
+
+	body := bytes.TrimSpace(r.body.Bytes())
+
+	switch {
+	case len(body) == 0:
+	case json.Valid(body):
+		res.Body = json.RawMessage(body)
+	default:
+		res.Body = string(body)
+	}
+
+	return res
+}
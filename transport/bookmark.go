@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BookmarkController lets users save messages for later.
+type BookmarkController struct {
+	s *service.BookmarkService
+	a *service.AuthService
+}
+
+type bookmarkBody struct {
+	Collection string `json:"collection"`
+}
+
+// defaultBookmarkLimit is the page size, if no limit is requested
+const defaultBookmarkLimit = 50
+
+func NewBookmarkController(s *service.BookmarkService, a *service.AuthService) *BookmarkController {
+	return &BookmarkController{s, a}
+}
+
+func (c *BookmarkController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/message/{id}/bookmark", c.a.Middleware(c.putBookmark)).Methods("PUT")
+	router.HandleFunc("/message/{id}/bookmark", c.a.Middleware(c.deleteBookmark)).Methods("DELETE")
+	router.HandleFunc("/user/me/bookmarks", c.a.Middleware(c.getBookmarks)).Methods("GET")
+	router.HandleFunc("/user/me/bookmarks/collections", c.a.Middleware(c.getCollections)).Methods("GET")
+
+	fmt.Println("Bookmark routes registered")
+}
+
+func (c *BookmarkController) putBookmark(w http.ResponseWriter, req *http.Request) {
+	var body bookmarkBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	// the body is optional
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bookmark, err := c.s.Bookmark(req.Context(), mux.Vars(req)["id"], body.Collection)
+	writeBookmarkJSON(w, bookmark, err)
+}
+
+func (c *BookmarkController) deleteBookmark(w http.ResponseWriter, req *http.Request) {
+	err := c.s.RemoveBookmark(req.Context(), mux.Vars(req)["id"])
+
+	if err != nil {
+		writeBookmarkJSON(w, nil, err)
+	}
+}
+
+// getBookmarks returns a page of bookmarks. The collection parameter limits
+// them to a collection, an empty one to the bookmarks without collection.
+func (c *BookmarkController) getBookmarks(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	limit := int64(defaultBookmarkLimit)
+
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = l
+	}
+
+	var collection *string
+	if values, ok := query["collection"]; ok {
+		collection = &values[0]
+	}
+
+	page, err := c.s.GetBookmarks(req.Context(), collection, query.Get("cursor"), limit)
+	writeBookmarkJSON(w, page, err)
+}
+
+func (c *BookmarkController) getCollections(w http.ResponseWriter, req *http.Request) {
+	collections, err := c.s.GetCollections(req.Context())
+	writeBookmarkJSON(w, collections, err)
+}
+
+func writeBookmarkJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments, err == persistence.ErrNothingDeleted:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrNotAuthenticated:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrInvalidCursor, err == service.ErrInvalidCollection, err == service.ErrBookmarkUnpublished:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ResponseCache answers conditional GET requests (If-None-Match and
+// If-Modified-Since) and optionally keeps recent responses of public routes
+// in an in-process LRU cache, so they don't hit the database on every request.
+type ResponseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+
+	// generations counts the invalidations per group, responses read before
+	// an invalidation aren't stored anymore
+	generations map[string]uint64
+}
+
+type cachedResponse struct {
+	key     string
+	group   string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewResponseCache creates a cache holding up to size responses for ttl.
+// A size of 0 disables caching, conditional requests are answered anyway.
+func NewResponseCache(size int, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		size:        size,
+		ttl:         ttl,
+		order:       list.New(),
+		entries:     map[string]*list.Element{},
+		generations: map[string]uint64{},
+	}
+}
+
+// Middleware serves GET requests of next with the given Cache-Control policy.
+// Cached responses are stored under group, so they can be dropped by Invalidate.
+// Authenticated requests and requests within a transaction (see BatchController)
+// are never served from or stored in the cache.
+func (rc *ResponseCache) Middleware(group string, cacheControl string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.URL.RequestURI()
+		shared := req.Header.Get("Authorization") == "" && mongo.SessionFromContext(req.Context()) == nil
+
+		if shared {
+			if entry := rc.get(key); entry != nil {
+				writeConditional(w, req, entry.header, entry.body)
+				return
+			}
+		}
+
+		generation := rc.generation(group)
+		rec := newResponseRecorder()
+		next(rec, req)
+
+		if rec.status != http.StatusOK {
+			copyHeader(w.Header(), rec.header)
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+
+		header := rec.header
+		header.Set("Cache-Control", cacheControl)
+		header.Add("Vary", "Authorization")
+
+		if header.Get("ETag") == "" {
+			header.Set("ETag", weakETag(rec.body.Bytes()))
+		}
+
+		if shared {
+			rc.put(key, group, generation, header, rec.body.Bytes())
+		}
+
+		writeConditional(w, req, header, rec.body.Bytes())
+	})
+}
+
+// Invalidate drops every cached response of group.
+func (rc *ResponseCache) Invalidate(group string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.generations[group]++
+
+	for key, el := range rc.entries {
+		if el.Value.(*cachedResponse).group == group {
+			rc.order.Remove(el)
+			delete(rc.entries, key)
+		}
+	}
+}
+
+func (rc *ResponseCache) generation(group string) uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.generations[group]
+}
+
+func (rc *ResponseCache) get(key string) *cachedResponse {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := el.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		rc.order.Remove(el)
+		delete(rc.entries, key)
+		return nil
+	}
+
+	rc.order.MoveToFront(el)
+	return entry
+}
+
+// put stores a response, unless group has been invalidated since generation
+// was read, the response may be outdated then.
+func (rc *ResponseCache) put(key string, group string, generation uint64, header http.Header, body []byte) {
+	if rc.size <= 0 {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.generations[group] != generation {
+		return
+	}
+
+	entry := &cachedResponse{key, group, header.Clone(), append([]byte(nil), body...), time.Now().Add(rc.ttl)}
+
+	if el, ok := rc.entries[key]; ok {
+		el.Value = entry
+		rc.order.MoveToFront(el)
+		return
+	}
+
+	rc.entries[key] = rc.order.PushFront(entry)
+
+	for rc.order.Len() > rc.size {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// writeConditional writes the response or 304 Not Modified, if the client
+// already has the current representation.
+func writeConditional(w http.ResponseWriter, req *http.Request, header http.Header, body []byte) {
+	copyHeader(w.Header(), header)
+
+	if notModified(req, header) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func notModified(req *http.Request, header http.Header) bool {
+	// If-None-Match takes precedence over If-Modified-Since (RFC 7232, 6.)
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, header.Get("ETag"))
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lm.After(ims)
+}
+
+func weakETag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+// responseRecorder buffers a response, so it can be inspected before sending it.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
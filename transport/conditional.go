@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gofeed-go/persistence"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidIfMatch = errors.New("invalid If-Match header")
+
+// messageETag returns the strong entity tag of a message as presented to the
+// reader, see representationETag.
+func messageETag(message *persistence.Message) string {
+	return representationETag(message.Version, message)
+}
+
+// representationETag returns the strong entity tag of v, a representation of
+// a message with the given version: "<version>-<hash>". If-Match only compares
+// the version, the hash covers what changes without a new version, like the
+// tallies of polls, the choices of the reader or the embedded author.
+func representationETag(version int64, v interface{}) string {
+	data, _ := json.Marshal(v)
+	sum := sha1.Sum(data)
+
+	return strconv.Quote(strconv.FormatInt(version, 10) + "-" + hex.EncodeToString(sum[:8]))
+}
+
+// parseIfMatch extracts the message versions listed in the If-Match header.
+// An empty result means the request is unconditional (no header or "*").
+func parseIfMatch(req *http.Request) ([]int64, error) {
+	header := strings.TrimSpace(req.Header.Get("If-Match"))
+
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+
+	versions := []int64{}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		// If-Match uses the strong comparison, weak tags never match
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+
+		unquoted, err := strconv.Unquote(tag)
+		if err != nil {
+			return nil, ErrInvalidIfMatch
+		}
+
+		// only the version counts, see messageETag
+		if i := strings.IndexByte(unquoted, '-'); i >= 0 {
+			unquoted = unquoted[:i]
+		}
+
+		v, err := strconv.ParseInt(unquoted, 10, 64)
+		if err != nil {
+			// tags we didn't issue can never match
+			continue
+		}
+
+		versions = append(versions, v)
+	}
+
+	// none of the listed tags can match a message version
+	if len(versions) == 0 {
+		versions = append(versions, -1)
+	}
+
+	return versions, nil
+}
+
+// etagMatches reports whether etag is listed in an If-None-Match header,
+// using the weak comparison.
+func etagMatches(header string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DraftController lets users prepare drafts and schedule messages.
+type DraftController struct {
+	s *service.DraftService
+	a *service.AuthService
+}
+
+func NewDraftController(s *service.DraftService, a *service.AuthService) *DraftController {
+	return &DraftController{s, a}
+}
+
+func (c *DraftController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/user/me/drafts", c.a.Middleware(c.getDrafts)).Methods("GET")
+	router.HandleFunc("/user/me/drafts", c.a.Middleware(c.postDraft)).Methods("POST")
+	router.HandleFunc("/user/me/drafts/{id}", c.a.Middleware(c.getDraft)).Methods("GET")
+	router.HandleFunc("/user/me/drafts/{id}", c.a.Middleware(c.patchDraft)).Methods("PATCH")
+	router.HandleFunc("/user/me/drafts/{id}", c.a.Middleware(c.deleteDraft)).Methods("DELETE")
+	router.HandleFunc("/user/me/drafts/{id}/publish", c.a.Middleware(c.publishDraft)).Methods("POST")
+
+	fmt.Println("Draft routes registered")
+}
+
+// getDrafts lists the drafts, optionally only the scheduled (scheduled=true) or unscheduled ones
+func (c *DraftController) getDrafts(w http.ResponseWriter, req *http.Request) {
+	limit, skip := pageParams(req)
+
+	var scheduled *bool
+	if s, err := strconv.ParseBool(req.URL.Query().Get("scheduled")); err == nil {
+		scheduled = &s
+	}
+
+	drafts, err := c.s.GetDrafts(req.Context(), scheduled, limit, skip)
+	writeDraftJSON(w, drafts, err)
+}
+
+func (c *DraftController) getDraft(w http.ResponseWriter, req *http.Request) {
+	draft, err := c.s.GetDraft(req.Context(), mux.Vars(req)["id"])
+	writeDraftJSON(w, draft, err)
+}
+
+func (c *DraftController) postDraft(w http.ResponseWriter, req *http.Request) {
+	var body service.DraftUpdate
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	draft, err := c.s.CreateDraft(req.Context(), body)
+
+	if err == nil {
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	writeDraftJSON(w, draft, err)
+}
+
+func (c *DraftController) patchDraft(w http.ResponseWriter, req *http.Request) {
+	var body service.DraftUpdate
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	draft, err := c.s.UpdateDraft(req.Context(), mux.Vars(req)["id"], body)
+	writeDraftJSON(w, draft, err)
+}
+
+// deleteDraft removes a draft or cancels a scheduled message
+func (c *DraftController) deleteDraft(w http.ResponseWriter, req *http.Request) {
+	err := c.s.DeleteDraft(req.Context(), mux.Vars(req)["id"])
+
+	if err != nil {
+		writeDraftJSON(w, nil, err)
+	}
+}
+
+// publishDraft publishes a draft right away
+func (c *DraftController) publishDraft(w http.ResponseWriter, req *http.Request) {
+	message, err := c.s.PublishDraft(req.Context(), mux.Vars(req)["id"])
+
+	if err == nil {
+		w.Header().Set("ETag", messageETag(message))
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	writeDraftJSON(w, message, err)
+}
+
+func writeDraftJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrReplyNotFound, err == service.ErrInvalidAttachment, err == service.ErrTooManyAttachments,
+		err == service.ErrPublishAtPast, err == service.ErrPublishAtFuture, err == persistence.ErrMissingDraftContent:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == service.ErrDraftLocked:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case isPolicyViolation(err):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+	"strings"
+)
+
+// expandedMessage is a message with its author embedded, see expand=author
+type expandedMessage struct {
+	persistence.Message
+	Author *service.UserInfo `json:"author"`
+}
+
+// wantsExpand reports whether the request asks to expand field,
+// e.g. ?expand=author or ?expand=author,other
+func wantsExpand(req *http.Request, field string) bool {
+	for _, value := range req.URL.Query()["expand"] {
+		for _, f := range strings.Split(value, ",") {
+			if strings.TrimSpace(f) == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandAuthors embeds the authors of messages. All authors are loaded with a
+// single query through loader, which caches them for the rest of the request.
+// Authors, which don't exist anymore, are embedded as null.
+func expandAuthors(loader *service.UserLoader, messages []persistence.Message) ([]expandedMessage, error) {
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.AuthorID.Hex())
+	}
+
+	authors, err := loader.LoadMany(ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := []expandedMessage{}
+	for _, m := range messages {
+		expanded = append(expanded, expandedMessage{m, authors[m.AuthorID.Hex()]})
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,495 @@
+package transport
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type FeedController struct {
+	ms *service.MessageService
+	us *service.UserService
+	rc *ResponseCache
+}
+
+const (
+	feedDefaultLimit = 20
+	feedMaxLimit     = 100
+	feedTitleLength  = 80
+)
+
+func NewFeedController(ms *service.MessageService, us *service.UserService, rc *ResponseCache) *FeedController {
+	return &FeedController{ms, us, rc}
+}
+
+func (c *FeedController) RegisterRoutes(router *mux.Router) {
+
+	router.HandleFunc("/feed.{format:rss|atom|json}", c.rc.Middleware("message", "public, max-age=300", c.getFeed)).Methods("GET")
+	router.HandleFunc("/user/{id}/feed.{format:rss|atom|json}", c.rc.Middleware("message", "public, max-age=300", c.getFeed)).Methods("GET")
+
+	fmt.Println("Feed routes registered")
+}
+
+// feed is the format independent representation of a feed
+type feed struct {
+	Title   string
+	SiteURL string
+	FeedURL string
+	Author  *service.UserInfo
+	Updated time.Time
+	Items   []feedItem
+}
+
+type feedItem struct {
+	ID        string
+	URL       string
+	Title     string
+	Content   string
+	HTML      string
+	Author    *service.UserInfo
+	Published time.Time
+	Updated   time.Time
+
+	// Repost marks reposts, Author is the author of the original then and
+	// RepostedBy the one of the repost
+	Repost     bool
+	RepostedBy *service.UserInfo
+}
+
+func (c *FeedController) getFeed(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	author := vars["id"]
+
+	limit := int64(feedDefaultLimit)
+	if l, err := strconv.ParseInt(req.URL.Query().Get("limit"), 10, 64); err == nil && l > 0 && l <= feedMaxLimit {
+		limit = l
+	}
+
+	f, err := c.buildFeed(req, author, limit)
+
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == persistence.ErrInvalidObjectID, err == service.ErrInvalidObjectID:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// like other lists, feeds have no Last-Modified header: deleted messages
+	// don't change the time of the latest item, only the ETag notices them
+
+	switch vars["format"] {
+	case "rss":
+		err = writeRSS(w, f)
+	case "atom":
+		err = writeAtom(w, f)
+	default:
+		err = writeJSONFeed(w, f)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *FeedController) buildFeed(req *http.Request, author string, limit int64) (*feed, error) {
+	f := &feed{
+		Title:   "GoFeed",
+		SiteURL: siteURL(),
+		FeedURL: os.Getenv("CALLBACK") + req.URL.Path,
+	}
+
+	if author != "" {
+		userInfo, err := c.us.GetUserInfo(req.Context(), author)
+
+		if err != nil {
+			return nil, err
+		}
+
+		f.Title = "GoFeed - " + userInfo.Name
+		f.Author = userInfo
+	}
+
+	messages, err := c.ms.GetLatestMessages(req.Context(), author, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// look up every author only once
+	authors := map[string]*service.UserInfo{}
+	if f.Author != nil {
+		authors[author] = f.Author
+	}
+
+	lookup := func(aid string) *service.UserInfo {
+		userInfo, ok := authors[aid]
+
+		if !ok {
+			// deleted users shouldn't break the whole feed
+			userInfo, _ = c.us.GetUserInfo(req.Context(), aid)
+			authors[aid] = userInfo
+		}
+
+		return userInfo
+	}
+
+	for _, m := range *messages {
+		// reposts show the content of their original, if it's still available
+		content := &m
+		if m.RepostOf != nil {
+			if m.Original == nil {
+				continue
+			}
+			content = m.Original
+		}
+
+		item := feedItem{
+			ID:        os.Getenv("CALLBACK") + "/message/" + m.MessageID.Hex(),
+			Title:     feedTitle(content.Content),
+			Content:   content.Content,
+			HTML:      service.MessageHTML(content),
+			Author:    lookup(content.AuthorID.Hex()),
+			Published: millisToTime(m.Created),
+			Updated:   millisToTime(m.Updated),
+		}
+		item.URL = item.ID
+
+		if content != &m {
+			item.Repost = true
+			item.RepostedBy = lookup(m.AuthorID.Hex())
+		}
+
+		if item.Updated.After(f.Updated) {
+			f.Updated = item.Updated
+		}
+
+		f.Items = append(f.Items, item)
+	}
+
+	return f, nil
+}
+
+// --- RSS 2.0 ---
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	SelfLink      rssAtomLink `xml:"atom:link"`
+	LastBuildDate string      `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	Category    string  `xml:"category,omitempty"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+func writeRSS(w http.ResponseWriter, f *feed) error {
+	doc := rssDocument{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.SiteURL,
+			Description: f.Title,
+			SelfLink:    rssAtomLink{f.FeedURL, "self", "application/rss+xml"},
+		},
+	}
+
+	if !f.Updated.IsZero() {
+		doc.Channel.LastBuildDate = f.Updated.Format(time.RFC1123Z)
+	}
+
+	for _, item := range f.Items {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:    item.Title,
+			Link:     item.URL,
+			GUID:     rssGUID{item.ID, true},
+			PubDate:  item.Published.Format(time.RFC1123Z),
+			Creator:  authorName(item.Author),
+			Category: repostCategory(item),
+			// description contains HTML, which gets escaped once more by the encoder
+			Description: item.HTML,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	return writeXML(w, doc)
+}
+
+// --- Atom ---
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Icon    string      `xml:"icon,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string        `xml:"id"`
+	Title     string        `xml:"title"`
+	Updated   string        `xml:"updated"`
+	Published string        `xml:"published"`
+	Link      atomLink      `xml:"link"`
+	Author    *atomAuthor   `xml:"author,omitempty"`
+	Category  *atomCategory `xml:"category,omitempty"`
+	Content   atomContent   `xml:"content"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func writeAtom(w http.ResponseWriter, f *feed) error {
+	// updated is mandatory, even for empty feeds. A fixed time keeps their
+	// ETag, so conditional requests still get 304.
+	updated := f.Updated
+	if updated.IsZero() {
+		updated = time.Unix(0, 0).UTC()
+	}
+
+	doc := atomFeed{
+		ID:      f.FeedURL,
+		Title:   f.Title,
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.FeedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.SiteURL, Rel: "alternate"},
+		},
+		Author: newAtomAuthor(f.Author),
+	}
+
+	if f.Author != nil {
+		doc.Icon = f.Author.Avatar
+	}
+
+	for _, item := range f.Items {
+		entry := atomEntry{
+			ID:        item.ID,
+			Title:     item.Title,
+			Updated:   item.Updated.Format(time.RFC3339),
+			Published: item.Published.Format(time.RFC3339),
+			Link:      atomLink{Href: item.URL, Rel: "alternate"},
+			Author:    newAtomAuthor(item.Author),
+			Content:   atomContent{"html", item.HTML},
+		}
+
+		if term := repostCategory(item); term != "" {
+			entry.Category = &atomCategory{Term: term}
+
+			if item.RepostedBy != nil {
+				entry.Category.Label = "Repost von " + item.RepostedBy.Name
+			}
+		}
+
+		doc.Entries = append(doc.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return writeXML(w, doc)
+}
+
+func newAtomAuthor(userInfo *service.UserInfo) *atomAuthor {
+	if userInfo == nil {
+		return nil
+	}
+
+	return &atomAuthor{userInfo.Name, userURL(userInfo)}
+}
+
+// --- JSON Feed 1.1 ---
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url,omitempty"`
+	FeedURL     string           `json:"feed_url,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name   string `json:"name,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHTML   string           `json:"content_html"`
+	ContentText   string           `json:"content_text"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified,omitempty"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+}
+
+func writeJSONFeed(w http.ResponseWriter, f *feed) error {
+	doc := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.SiteURL,
+		FeedURL:     f.FeedURL,
+		Authors:     newJSONFeedAuthors(f.Author),
+		Items:       []jsonFeedItem{},
+	}
+
+	if f.Author != nil {
+		doc.Icon = f.Author.Avatar
+	}
+
+	for _, item := range f.Items {
+		var tags []string
+		if term := repostCategory(item); term != "" {
+			tags = []string{term}
+		}
+
+		doc.Items = append(doc.Items, jsonFeedItem{
+			ID:            item.ID,
+			URL:           item.URL,
+			Title:         item.Title,
+			ContentHTML:   item.HTML,
+			ContentText:   item.Content,
+			DatePublished: item.Published.Format(time.RFC3339),
+			DateModified:  item.Updated.Format(time.RFC3339),
+			Authors:       newJSONFeedAuthors(item.Author),
+			Tags:          tags,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	return json.NewEncoder(w).Encode(doc)
+}
+
+func newJSONFeedAuthors(userInfo *service.UserInfo) []jsonFeedAuthor {
+	if userInfo == nil {
+		return nil
+	}
+
+	return []jsonFeedAuthor{{userInfo.Name, userURL(userInfo), userInfo.Avatar}}
+}
+
+// --- helpers ---
+
+func writeXML(w http.ResponseWriter, doc interface{}) error {
+	_, err := w.Write([]byte(xml.Header))
+	if err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// siteURL is the page feed readers link to, usually the frontend
+func siteURL() string {
+	if u := os.Getenv("FEED_SITE_URL"); u != "" {
+		return u
+	}
+	return os.Getenv("CALLBACK")
+}
+
+func userURL(userInfo *service.UserInfo) string {
+	return os.Getenv("CALLBACK") + "/user/" + userInfo.UserID.Hex()
+}
+
+func authorName(userInfo *service.UserInfo) string {
+	if userInfo == nil {
+		return ""
+	}
+	return userInfo.Name
+}
+
+// repostCategory marks reposts in every format, as none of them knows reposts
+func repostCategory(item feedItem) string {
+	if !item.Repost {
+		return ""
+	}
+
+	return "repost"
+}
+
+// feedTitle uses the first line of a message as title, shortened if necessary
+func feedTitle(content string) string {
+	title := strings.TrimSpace(strings.SplitN(strings.TrimSpace(content), "\n", 2)[0])
+
+	if utf8.RuneCountInString(title) > feedTitleLength {
+		runes := []rune(title)
+		title = strings.TrimSpace(string(runes[:feedTitleLength-1])) + "…"
+	}
+
+	return title
+}
+
+func millisToTime(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,318 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphQLSchema exposes the message and user services. Timestamps are
+// milliseconds, which don't fit into a GraphQL Int, therefore they are Floats.
+const graphQLSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	messages(limit: Int, skip: Int): [Message!]!
+	message(id: ID!): Message
+	user(id: ID!): User
+}
+
+type Mutation {
+	createMessage(content: String!): Message!
+	# version works like If-Match, the update fails if the message has been modified in the meantime
+	updateMessage(id: ID!, content: String!, version: Int): Message!
+	deleteMessage(id: ID!, version: Int): Boolean!
+}
+
+type Message {
+	id: ID!
+	authorId: ID!
+	author: User
+	content: String!
+	contentHtml: String!
+	created: Float!
+	updated: Float!
+	version: Int!
+	reposts: Int!
+	# the reposted or quoted message, originalUnavailable tells why it's missing
+	original: Message
+	originalUnavailable: String
+}
+
+type User {
+	id: ID!
+	name: String!
+	avatar: String!
+}
+`
+
+type GraphQLController struct {
+	a      *service.AuthService
+	us     *service.UserService
+	schema *graphql.Schema
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type loaderKey struct{}
+
+// NewGraphQLController creates the controller. The mutations count against
+// the rate limits of the REST routes they mirror in rl.
+func NewGraphQLController(ms *service.MessageService, us *service.UserService, a *service.AuthService, rl *RateLimiter) *GraphQLController {
+	schema := graphql.MustParseSchema(graphQLSchema, &rootResolver{ms, a, rl}, graphql.UseFieldResolvers())
+	return &GraphQLController{a, us, schema}
+}
+
+func (c *GraphQLController) RegisterRoutes(router *mux.Router) {
+
+	router.HandleFunc("/graphql", c.handleGraphQL).Methods("POST")
+
+	fmt.Println("GraphQL routes registered")
+}
+
+// handleGraphQL answers queries anonymously, unless a bearer token is sent.
+// Mutations require the token.
+func (c *GraphQLController) handleGraphQL(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "" {
+		c.a.Middleware(c.execute)(w, req)
+		return
+	}
+
+	c.execute(w, req)
+}
+
+func (c *GraphQLController) execute(w http.ResponseWriter, req *http.Request) {
+	var body graphQLRequest
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// authors are loaded in batches, at most once per request
+	ctx := context.WithValue(req.Context(), loaderKey{}, service.NewUserLoader(req.Context(), c.us))
+
+	res := c.schema.Exec(ctx, body.Query, body.OperationName, body.Variables)
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type rootResolver struct {
+	ms *service.MessageService
+	a  *service.AuthService
+	rl *RateLimiter
+}
+
+func (r *rootResolver) Messages(ctx context.Context, args struct{ Limit, Skip *int32 }) ([]*messageResolver, error) {
+	var limit, skip *int64
+
+	if args.Limit != nil {
+		l := int64(*args.Limit)
+		limit = &l
+	}
+	if args.Skip != nil {
+		s := int64(*args.Skip)
+		skip = &s
+	}
+
+	messages, err := r.ms.GetMessages(ctx, "", limit, skip)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resolvers := []*messageResolver{}
+	for i := range *messages {
+		resolvers = append(resolvers, &messageResolver{&(*messages)[i]})
+	}
+
+	return resolvers, nil
+}
+
+func (r *rootResolver) Message(ctx context.Context, args struct{ ID graphql.ID }) (*messageResolver, error) {
+	message, err := r.ms.GetMessageById(ctx, string(args.ID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &messageResolver{message}, nil
+}
+
+func (r *rootResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	user, err := loader(ctx).Load(string(args.ID))
+
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	return &userResolver{user}, nil
+}
+
+func (r *rootResolver) CreateMessage(ctx context.Context, args struct{ Content string }) (*messageResolver, error) {
+	user, err := r.a.UserFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.rl.Limit(ctx, "POST /message"); err != nil {
+		return nil, err
+	}
+
+	message, err := r.ms.CreateMessage(ctx, persistence.Message{AuthorID: user.UserID, Content: args.Content})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &messageResolver{message}, nil
+}
+
+func (r *rootResolver) UpdateMessage(ctx context.Context, args struct {
+	ID      graphql.ID
+	Content string
+	Version *int32
+}) (*messageResolver, error) {
+	user, err := r.a.UserFromContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.rl.Limit(ctx, "PATCH /message/{id}"); err != nil {
+		return nil, err
+	}
+
+	message, err := r.ms.UpdateMessage(ctx, string(args.ID), user.UserID.Hex(), versions(args.Version), persistence.Message{Content: args.Content})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &messageResolver{message}, nil
+}
+
+func (r *rootResolver) DeleteMessage(ctx context.Context, args struct {
+	ID      graphql.ID
+	Version *int32
+}) (bool, error) {
+	user, err := r.a.UserFromContext(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.rl.Limit(ctx, "DELETE /message/{id}"); err != nil {
+		return false, err
+	}
+
+	return r.ms.DeleteMessage(ctx, string(args.ID), user.UserID.Hex(), versions(args.Version))
+}
+
+type messageResolver struct {
+	m *persistence.Message
+}
+
+func (r *messageResolver) ID() graphql.ID {
+	return graphql.ID(r.m.MessageID.Hex())
+}
+
+func (r *messageResolver) AuthorID() graphql.ID {
+	return graphql.ID(r.m.AuthorID.Hex())
+}
+
+func (r *messageResolver) Author(ctx context.Context) (*userResolver, error) {
+	user, err := loader(ctx).Load(r.m.AuthorID.Hex())
+
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	return &userResolver{user}, nil
+}
+
+func (r *messageResolver) Content() string {
+	return r.m.Content
+}
+
+func (r *messageResolver) ContentHtml() string {
+	return service.MessageHTML(r.m)
+}
+
+func (r *messageResolver) Created() float64 {
+	return float64(r.m.Created)
+}
+
+func (r *messageResolver) Updated() float64 {
+	return float64(r.m.Updated)
+}
+
+func (r *messageResolver) Version() int32 {
+	return int32(r.m.Version)
+}
+
+func (r *messageResolver) Reposts() int32 {
+	return int32(r.m.Reposts)
+}
+
+func (r *messageResolver) Original() *messageResolver {
+	if r.m.Original == nil {
+		return nil
+	}
+
+	return &messageResolver{r.m.Original}
+}
+
+func (r *messageResolver) OriginalUnavailable() *string {
+	if r.m.OriginalUnavailable == "" {
+		return nil
+	}
+
+	return &r.m.OriginalUnavailable
+}
+
+type userResolver struct {
+	u *service.UserInfo
+}
+
+func (r *userResolver) ID() graphql.ID {
+	return graphql.ID(r.u.UserID.Hex())
+}
+
+func (r *userResolver) Name() string {
+	return r.u.Name
+}
+
+func (r *userResolver) Avatar() string {
+	return r.u.Avatar
+}
+
+func loader(ctx context.Context) *service.UserLoader {
+	return ctx.Value(loaderKey{}).(*service.UserLoader)
+}
+
+// versions converts an optional expected version to the list used by MessageService
+func versions(version *int32) []int64 {
+	if version == nil {
+		return nil
+	}
+	return []int64{int64(*version)}
+}
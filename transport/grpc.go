@@ -0,0 +1,412 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/gofeedpb"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCController implements the gRPC services defined in gofeedpb/gofeed.proto
+// on top of MessageService and UserService.
+type GRPCController struct {
+	gofeedpb.UnimplementedMessageServiceServer
+	gofeedpb.UnimplementedUserServiceServer
+
+	ms *service.MessageService
+	us *service.UserService
+	a  *service.AuthService
+	rl *RateLimiter
+
+	mu       sync.Mutex
+	watchers map[chan *persistence.Message]bool
+}
+
+// watchBuffer is the number of messages buffered for slow watchers, further
+// messages are dropped for them
+const watchBuffer = 64
+
+// watchRelationsInterval is how often the blocks and mutes of a watcher are
+// reloaded
+const watchRelationsInterval = time.Minute
+
+// grpcAuthRequired lists the methods, which require an authenticated user
+var grpcAuthRequired = map[string]bool{
+	"/gofeed.v1.MessageService/CreateMessage": true,
+	"/gofeed.v1.MessageService/UpdateMessage": true,
+	"/gofeed.v1.MessageService/DeleteMessage": true,
+}
+
+// grpcRoutes maps the unary methods to the REST routes they mirror, they
+// share their rate limits
+var grpcRoutes = map[string]string{
+	"/gofeed.v1.MessageService/ListMessages":  "GET /message",
+	"/gofeed.v1.MessageService/GetMessage":    "GET /message/{id}",
+	"/gofeed.v1.MessageService/CreateMessage": "POST /message",
+	"/gofeed.v1.MessageService/UpdateMessage": "PATCH /message/{id}",
+	"/gofeed.v1.MessageService/DeleteMessage": "DELETE /message/{id}",
+	"/gofeed.v1.UserService/GetUser":          "GET /user/{id}",
+}
+
+// NewGRPCController creates the controller. The RPCs count against the rate
+// limits of the REST routes they mirror in rl, see grpcRoutes.
+func NewGRPCController(ms *service.MessageService, us *service.UserService, a *service.AuthService, rl *RateLimiter) *GRPCController {
+	c := &GRPCController{ms: ms, us: us, a: a, rl: rl, watchers: map[chan *persistence.Message]bool{}}
+	ms.Subscribe(c.onMessageEvent)
+	return c
+}
+
+// NewServer creates a gRPC server with the JWT and rate limit interceptors
+// and both services registered.
+func (c *GRPCController) NewServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(c.unaryAuth, c.rl.UnaryInterceptor(grpcRoutes)),
+		grpc.StreamInterceptor(c.streamAuth),
+	)
+
+	gofeedpb.RegisterMessageServiceServer(server, c)
+	gofeedpb.RegisterUserServiceServer(server, c)
+
+	fmt.Println("gRPC services registered")
+
+	return server
+}
+
+// --- auth ---
+
+// authenticate verifies the JWT sent in the "authorization" metadata, like
+// AuthService.Middleware does for REST. Requests without token are anonymous.
+func (c *GRPCController) authenticate(ctx context.Context, method string) (context.Context, error) {
+	var header string
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			header = values[0]
+		}
+	}
+
+	if header == "" && !grpcAuthRequired[method] {
+		return ctx, nil
+	}
+
+	user, err := c.a.Authenticate(header)
+
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return c.a.WithUser(ctx, user), nil
+}
+
+func (c *GRPCController) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := c.authenticate(ctx, info.FullMethod)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (c *GRPCController) streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := c.authenticate(ss.Context(), info.FullMethod)
+
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ss, ctx})
+}
+
+// authenticatedStream replaces the context of a stream with the authenticated one
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// --- MessageService ---
+
+func (c *GRPCController) ListMessages(ctx context.Context, req *gofeedpb.ListMessagesRequest) (*gofeedpb.ListMessagesResponse, error) {
+	var limit, skip *int64
+
+	if req.Limit > 0 {
+		limit = &req.Limit
+	}
+	if req.Skip > 0 {
+		skip = &req.Skip
+	}
+
+	messages, err := c.ms.GetMessages(ctx, "", limit, skip)
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	res := &gofeedpb.ListMessagesResponse{}
+	for i := range *messages {
+		res.Messages = append(res.Messages, toProtoMessage(&(*messages)[i]))
+	}
+
+	return res, nil
+}
+
+func (c *GRPCController) GetMessage(ctx context.Context, req *gofeedpb.GetMessageRequest) (*gofeedpb.Message, error) {
+	message, err := c.ms.GetMessageById(ctx, req.Id)
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return toProtoMessage(message), nil
+}
+
+func (c *GRPCController) CreateMessage(ctx context.Context, req *gofeedpb.CreateMessageRequest) (*gofeedpb.Message, error) {
+	user, err := c.a.UserFromContext(ctx)
+
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	message, err := c.ms.CreateMessage(ctx, persistence.Message{AuthorID: user.UserID, Content: req.Content})
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return toProtoMessage(message), nil
+}
+
+func (c *GRPCController) UpdateMessage(ctx context.Context, req *gofeedpb.UpdateMessageRequest) (*gofeedpb.Message, error) {
+	user, err := c.a.UserFromContext(ctx)
+
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	message, err := c.ms.UpdateMessage(ctx, req.Id, user.UserID.Hex(), req.IfMatch, persistence.Message{Content: req.Content})
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return toProtoMessage(message), nil
+}
+
+func (c *GRPCController) DeleteMessage(ctx context.Context, req *gofeedpb.DeleteMessageRequest) (*gofeedpb.DeleteMessageResponse, error) {
+	user, err := c.a.UserFromContext(ctx)
+
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	deleted, err := c.ms.DeleteMessage(ctx, req.Id, user.UserID.Hex(), req.IfMatch)
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &gofeedpb.DeleteMessageResponse{Deleted: deleted}, nil
+}
+
+// WatchMessages streams new messages. Like the timelines, the messages of
+// users the caller has blocked or muted, or who have blocked the caller, are
+// left out.
+func (c *GRPCController) WatchMessages(req *gofeedpb.WatchMessagesRequest, stream gofeedpb.MessageService_WatchMessagesServer) error {
+	hidden, err := c.ms.HiddenAuthors(stream.Context())
+
+	if err != nil {
+		return grpcError(err)
+	}
+
+	reload := time.NewTicker(watchRelationsInterval)
+	defer reload.Stop()
+
+	ch := make(chan *persistence.Message, watchBuffer)
+
+	c.mu.Lock()
+	c.watchers[ch] = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.watchers, ch)
+		c.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-reload.C:
+			if h, err := c.ms.HiddenAuthors(stream.Context()); err == nil {
+				hidden = h
+			}
+		case message := <-ch:
+			if req.AuthorId != "" && message.AuthorID.Hex() != req.AuthorId {
+				continue
+			}
+
+			if hidden[message.AuthorID] {
+				continue
+			}
+
+			// the tallies of polls are hidden like for the other RPCs
+			m := *message
+			m.Poll = service.PresentPoll(stream.Context(), m.Poll)
+
+			if err := stream.Send(toProtoMessage(&m)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// onMessageEvent passes new published messages to every WatchMessages
+// stream, messages held or hidden by the content policy aren't streamed
+func (c *GRPCController) onMessageEvent(e service.MessageEvent) {
+	if e.Type != service.EventMessageCreated || e.Message.Status != "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ch := range c.watchers {
+		select {
+		case ch <- e.Message:
+		default:
+		}
+	}
+}
+
+// --- UserService ---
+
+func (c *GRPCController) GetUser(ctx context.Context, req *gofeedpb.GetUserRequest) (*gofeedpb.User, error) {
+	user, err := c.us.GetUserInfo(ctx, req.Id)
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &gofeedpb.User{Id: user.UserID.Hex(), Name: user.Name, Avatar: user.Avatar}, nil
+}
+
+// --- helpers ---
+
+// toProtoMessage converts a message, which has been prepared for the caller
+// by MessageService, like the REST API returns it.
+func toProtoMessage(m *persistence.Message) *gofeedpb.Message {
+	message := &gofeedpb.Message{
+		Id:                  m.MessageID.Hex(),
+		AuthorId:            m.AuthorID.Hex(),
+		Created:             m.Created,
+		Updated:             m.Updated,
+		Content:             m.Content,
+		Version:             m.Version,
+		ContentHtml:         m.ContentHTML,
+		Tags:                m.Tags,
+		ReplyTo:             hexOrEmpty(m.ReplyTo),
+		Poll:                toProtoPoll(m.Poll),
+		RepostOf:            hexOrEmpty(m.RepostOf),
+		QuoteOf:             hexOrEmpty(m.QuoteOf),
+		Reposts:             m.Reposts,
+		OriginalUnavailable: m.OriginalUnavailable,
+		Status:              m.Status,
+		PolicyReason:        m.PolicyReason,
+	}
+
+	for _, a := range m.Attachments {
+		message.Attachments = append(message.Attachments, &gofeedpb.Attachment{
+			Id:          a.AttachmentID.Hex(),
+			Name:        a.Name,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+		})
+	}
+
+	for _, p := range m.Previews {
+		message.Previews = append(message.Previews, &gofeedpb.LinkPreview{
+			Url:         p.URL,
+			Title:       p.Title,
+			Description: p.Description,
+			Image:       p.Image,
+			SiteName:    p.SiteName,
+		})
+	}
+
+	if m.Original != nil {
+		message.Original = toProtoMessage(m.Original)
+	}
+
+	return message
+}
+
+func toProtoPoll(p *persistence.Poll) *gofeedpb.Poll {
+	if p == nil {
+		return nil
+	}
+
+	poll := &gofeedpb.Poll{
+		Multiple: p.Multiple,
+		Closes:   p.Closes,
+		Voters:   p.Voters,
+		Closed:   p.Closed,
+	}
+
+	for _, o := range p.Options {
+		poll.Options = append(poll.Options, &gofeedpb.PollOption{Text: o.Text, Votes: o.Votes})
+	}
+
+	for _, v := range p.Voted {
+		poll.Voted = append(poll.Voted, int32(v))
+	}
+
+	return poll
+}
+
+func hexOrEmpty(id *primitive.ObjectID) string {
+	if id == nil {
+		return ""
+	}
+
+	return id.Hex()
+}
+
+// grpcError maps service errors to gRPC status codes, like the REST handlers map them to HTTP status codes.
+func grpcError(err error) error {
+	switch err {
+	case mongo.ErrNoDocuments:
+		return status.Error(codes.NotFound, err.Error())
+	case service.ErrInvalidObjectID, persistence.ErrInvalidObjectID, persistence.ErrMissingContent:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case service.ErrNotAuthor:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case service.ErrVersionMismatch:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	if isPolicyViolation(err) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
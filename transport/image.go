@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"fmt"
+	"gofeed-go/service"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImageController serves the variants of processed images, e.g. avatars.
+type ImageController struct {
+	s *service.ImageService
+}
+
+func NewImageController(s *service.ImageService) *ImageController {
+	return &ImageController{s}
+}
+
+func (c *ImageController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/image/{id}/{file}", c.getImage).Methods("GET")
+
+	fmt.Println("Image routes registered")
+}
+
+func (c *ImageController) getImage(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	content, contentType, err := c.s.Open(req.Context(), vars["id"], vars["file"])
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer content.Close()
+
+	// a new image gets a new id, variants never change
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	io.Copy(w, content)
+}
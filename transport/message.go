@@ -2,6 +2,7 @@ package transport
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gofeed-go/persistence"
 	"gofeed-go/service"
@@ -9,21 +10,28 @@ import (
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type MessageController struct {
-	s *service.MessageService
-	a *service.AuthService
+	s    *service.MessageService
+	us   *service.UserService
+	pins *service.PinService
+	a    *service.AuthService
+	rc   *ResponseCache
 }
 
-func NewMessageController(s *service.MessageService, a *service.AuthService) *MessageController {
-	return &MessageController{s, a}
+func NewMessageController(s *service.MessageService, us *service.UserService, pins *service.PinService, a *service.AuthService, rc *ResponseCache) *MessageController {
+	return &MessageController{s, us, pins, a, rc}
 }
 
 func (c *MessageController) RegisterRoutes(router *mux.Router) {
 
-	router.HandleFunc("/message", c.getMessages).Methods("GET")
-	router.HandleFunc("/message/{id}", c.getMessage).Methods("GET")
+	// Public routes are answered by the response cache where possible. Signed in
+	// users additionally see their own messages, which aren't published (yet).
+	router.HandleFunc("/message", c.rc.Middleware("message", "public, max-age=5", c.a.OptionalMiddleware(c.getMessages))).Methods("GET")
+	router.HandleFunc("/message/{id}", c.rc.Middleware("message", "public, no-cache", c.a.OptionalMiddleware(c.getMessage))).Methods("GET")
 
 	// Use middleware to authenticate user
 	router.HandleFunc("/message", c.a.Middleware(c.postMessage)).Methods("POST")
@@ -48,17 +56,28 @@ func (c *MessageController) getMessages(w http.ResponseWriter, req *http.Request
 		skip = &s
 	}
 
-	messages, err := c.s.GetMessages(req.Context(), limit, skip)
+	messages, err := c.s.GetMessages(req.Context(), query.Get("tag"), limit, skip)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(messages)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// announcements are pinned ahead of the first page of the timeline
+	if (skip == nil || *skip == 0) && query.Get("tag") == "" {
+		pinned, err := c.pins.GetGlobalPins(req.Context())
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		messages = withPinned(pinned, *messages)
 	}
+
+	// lists have no Last-Modified: deleting a message or blocking its author
+	// removes it without changing any timestamp, only the ETag notices that
+	c.writeMessages(w, req, *messages)
 }
 
 func (c *MessageController) getMessage(w http.ResponseWriter, req *http.Request) {
@@ -72,16 +91,20 @@ func (c *MessageController) getMessage(w http.ResponseWriter, req *http.Request)
 
 	message, err := c.s.GetMessageById(req.Context(), id)
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		// if errors.Is(err, service.ErrInvalidObjectID) { }
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// if errors.Is(err, service.ErrInvalidObjectID) { }
+		return
 	}
+
+	// no Last-Modified, votes and reposts change the message without
+	// changing its update time, only the ETag notices them
+	c.writeMessage(w, req, message)
 }
 
 func (c *MessageController) postMessage(w http.ResponseWriter, req *http.Request) {
@@ -101,16 +124,21 @@ func (c *MessageController) postMessage(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	message, err := c.s.CreateMessage(req.Context(), persistence.Message{AuthorID: user.UserID, Content: body.Content})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	message, err := c.s.CreateMessage(req.Context(), persistence.Message{AuthorID: user.UserID, Content: body.Content, ReplyTo: body.ReplyTo, Attachments: body.Attachments, Poll: body.Poll, QuoteOf: body.QuoteOf})
+	if err == service.ErrReplyNotFound || err == service.ErrQuoteNotFound || err == service.ErrInvalidAttachment || err == service.ErrTooManyAttachments || err == service.ErrInvalidPoll || err == service.ErrInvalidPollClosing {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isPolicyViolation(err) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
-
-	err = json.NewEncoder(w).Encode(message)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	c.writeMessage(w, req, message)
 }
 
 func (c *MessageController) deleteMessage(w http.ResponseWriter, req *http.Request) {
@@ -121,13 +149,23 @@ func (c *MessageController) deleteMessage(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	versions, err := parseIfMatch(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	user, err := c.a.ExtractUser(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	success, err := c.s.DeleteMessage(req.Context(), id, user.UserID.Hex())
+	success, err := c.s.DeleteMessage(req.Context(), id, user.UserID.Hex(), versions)
+	if err == service.ErrVersionMismatch {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -148,8 +186,14 @@ func (c *MessageController) patchMessage(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	versions, err := parseIfMatch(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var body persistence.Message
-	err := json.NewDecoder(req.Body).Decode(&body)
+	err = json.NewDecoder(req.Body).Decode(&body)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -163,14 +207,90 @@ func (c *MessageController) patchMessage(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	message, err := c.s.UpdateMessage(req.Context(), id, user.UserID.Hex(), persistence.Message{Content: body.Content})
+	message, err := c.s.UpdateMessage(req.Context(), id, user.UserID.Hex(), versions, persistence.Message{Content: body.Content})
+	if err == service.ErrVersionMismatch {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err == service.ErrRepostNotEditable {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isPolicyViolation(err) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(message)
+	c.writeMessage(w, req, message)
+}
+
+// writeMessages encodes messages, with their authors embedded if the request asks for expand=author
+func (c *MessageController) writeMessages(w http.ResponseWriter, req *http.Request, messages []persistence.Message) {
+	var res interface{} = messages
+
+	if wantsExpand(req, "author") {
+		expanded, err := expandAuthors(service.NewUserLoader(req.Context(), c.us), messages)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res = expanded
+	}
+
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeMessage encodes a single message like writeMessages, the ETag covers
+// the embedded author as well
+func (c *MessageController) writeMessage(w http.ResponseWriter, req *http.Request, message *persistence.Message) {
+	var res interface{} = message
+
+	if wantsExpand(req, "author") {
+		expanded, err := expandAuthors(service.NewUserLoader(req.Context(), c.us), []persistence.Message{*message})
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res = expanded[0]
+	}
+
+	w.Header().Set("ETag", representationETag(message.Version, res))
+
+	err := json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// withPinned puts the pinned messages ahead of messages, which don't repeat them
+func withPinned(pinned []persistence.Message, messages []persistence.Message) *[]persistence.Message {
+	ids := map[primitive.ObjectID]bool{}
+	for _, m := range pinned {
+		ids[m.MessageID] = true
+	}
+
+	for _, m := range messages {
+		if !ids[m.MessageID] {
+			pinned = append(pinned, m)
+		}
+	}
+
+	return &pinned
+}
+
+// isPolicyViolation reports whether a message has been rejected by the content policy
+func isPolicyViolation(err error) bool {
+	var violation *service.PolicyViolation
+	return errors.As(err, &violation)
+}
@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ModerationController lets users report messages and moderators review
+// reported messages and messages held by the content policy.
+type ModerationController struct {
+	ms  *service.MessageService
+	mod *service.ModerationService
+	a   *service.AuthService
+}
+
+type moderationBody struct {
+	Action string `json:"action"`
+	Note   string `json:"note"`
+}
+
+// defaultModerationLimit is the page size of the queue and the audit trail
+const defaultModerationLimit = 50
+
+func NewModerationController(ms *service.MessageService, mod *service.ModerationService, a *service.AuthService) *ModerationController {
+	return &ModerationController{ms, mod, a}
+}
+
+func (c *ModerationController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/message/{id}/report", c.a.Middleware(c.reportMessage)).Methods("POST")
+
+	// Moderation is restricted to moderators and admins
+	router.HandleFunc("/mod/reports", c.a.ModeratorMiddleware(c.getReports)).Methods("GET")
+	router.HandleFunc("/mod/reports/{id}", c.a.ModeratorMiddleware(c.moderate)).Methods("POST")
+	router.HandleFunc("/mod/audit", c.a.ModeratorMiddleware(c.getAuditTrail)).Methods("GET")
+	router.HandleFunc("/mod/messages", c.a.ModeratorMiddleware(c.getMessages)).Methods("GET")
+	router.HandleFunc("/mod/messages/{id}/approve", c.a.ModeratorMiddleware(c.setStatus(""))).Methods("POST")
+	router.HandleFunc("/mod/messages/{id}/reject", c.a.ModeratorMiddleware(c.setStatus(persistence.MessageRejected))).Methods("POST")
+	router.HandleFunc("/mod/messages/{id}/hide", c.a.ModeratorMiddleware(c.setStatus(persistence.MessageHidden))).Methods("POST")
+
+	fmt.Println("Moderation routes registered")
+}
+
+func (c *ModerationController) reportMessage(w http.ResponseWriter, req *http.Request) {
+	var body persistence.Report
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := c.mod.ReportMessage(req.Context(), mux.Vars(req)["id"], body)
+
+	switch {
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrOwnMessage, err == persistence.ErrInvalidReport:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getReports returns the moderation queue
+func (c *ModerationController) getReports(w http.ResponseWriter, req *http.Request) {
+	limit, skip := pageParams(req)
+
+	queue, err := c.mod.GetQueue(req.Context(), limit, skip)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(queue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// moderate takes action on a reported message
+func (c *ModerationController) moderate(w http.ResponseWriter, req *http.Request) {
+	var body moderationBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := c.mod.Moderate(req.Context(), mux.Vars(req)["id"], body.Action, body.Note)
+
+	switch {
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrUnknownModerationAction:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getAuditTrail lists the actions taken, optionally filtered by messageId or userId
+func (c *ModerationController) getAuditTrail(w http.ResponseWriter, req *http.Request) {
+	limit, skip := pageParams(req)
+	query := req.URL.Query()
+
+	entries, err := c.mod.GetAuditTrail(req.Context(), query.Get("messageId"), query.Get("userId"), limit, skip)
+
+	if err == service.ErrInvalidObjectID {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getMessages lists the messages with the given status (held by default)
+func (c *ModerationController) getMessages(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	status := query.Get("status")
+
+	switch status {
+	case "":
+		status = persistence.MessageHeld
+	case persistence.MessageHeld, persistence.MessageHidden, persistence.MessageRejected:
+	default:
+		http.Error(w, "Unknown status: "+status, http.StatusBadRequest)
+		return
+	}
+
+	var limit, skip *int64
+
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil {
+		limit = &l
+	}
+	if s, err := strconv.ParseInt(query.Get("skip"), 10, 64); err == nil {
+		skip = &s
+	}
+
+	messages, err := c.ms.GetMessagesByStatus(req.Context(), status, limit, skip)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// setStatus returns a handler, which moves a message to status
+func (c *ModerationController) setStatus(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		message, err := c.mod.SetMessageStatus(req.Context(), mux.Vars(req)["id"], status)
+
+		switch {
+		case err == mongo.ErrNoDocuments:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err == service.ErrInvalidObjectID:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(message)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// pageParams reads limit and skip from the query
+func pageParams(req *http.Request) (int64, int64) {
+	query := req.URL.Query()
+	limit, skip := int64(defaultModerationLimit), int64(0)
+
+	if l, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = l
+	}
+	if s, err := strconv.ParseInt(query.Get("skip"), 10, 64); err == nil && s >= 0 {
+		skip = s
+	}
+
+	return limit, skip
+}
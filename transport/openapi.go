@@ -0,0 +1,57 @@
+package transport
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPISpec describes every route of the API. openapi_test.go makes sure it
+// stays in sync with the registered routes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders openapi.json with Swagger UI
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>GoFeed API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+type DocsController struct{}
+
+func NewDocsController() *DocsController {
+	return &DocsController{}
+}
+
+func (c *DocsController) RegisterRoutes(router *mux.Router) {
+
+	router.HandleFunc("/openapi.json", c.getSpec).Methods("GET")
+	router.HandleFunc("/docs", c.getDocs).Methods("GET")
+
+	fmt.Println("Docs routes registered")
+}
+
+func (c *DocsController) getSpec(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (c *DocsController) getDocs(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, docsPage)
+}
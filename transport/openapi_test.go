@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// routePattern strips regular expressions from mux path variables ({format:rss|atom} => {format})
+var routePattern = regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+
+// registerAllRoutes registers the routes of every controller, like app.go does.
+// Controllers only need their dependencies when handling requests, so they are left nil.
+func registerAllRoutes(router *mux.Router) {
+	NewUserController(nil, nil, 0).RegisterRoutes(router)
+	NewProfileController(nil, nil, nil, 0).RegisterRoutes(router)
+	NewImageController(nil).RegisterRoutes(router)
+	NewMessageController(nil, nil, nil, nil, nil).RegisterRoutes(router)
+	NewPinController(nil, nil, nil).RegisterRoutes(router)
+	NewPollController(nil, nil).RegisterRoutes(router)
+	NewRepostController(nil, nil).RegisterRoutes(router)
+	NewBookmarkController(nil, nil).RegisterRoutes(router)
+	NewAttachmentController(nil, nil, 0).RegisterRoutes(router)
+	NewDraftController(nil, nil).RegisterRoutes(router)
+	NewRelationController(nil, nil).RegisterRoutes(router)
+	NewModerationController(nil, nil, nil).RegisterRoutes(router)
+	NewActivityPubController(nil).RegisterRoutes(router)
+	NewWebhookController(nil, nil).RegisterRoutes(router)
+	NewFeedController(nil, nil, nil).RegisterRoutes(router)
+	NewGraphQLController(nil, nil, nil, nil).RegisterRoutes(router)
+	NewBatchController(nil, 0, 0).RegisterRoutes(router)
+	NewDocsController().RegisterRoutes(router)
+}
+
+func TestOpenAPICoversAllRoutes(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is invalid: %v", err)
+	}
+
+	if !strings.HasPrefix(spec.OpenAPI, "3.1") {
+		t.Errorf("expected OpenAPI 3.1, got %q", spec.OpenAPI)
+	}
+
+	router := mux.NewRouter()
+	registerAllRoutes(router)
+
+	routes := 0
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("route %s has no methods", tpl)
+			return nil
+		}
+
+		path := routePattern.ReplaceAllString(tpl, "{$1}")
+
+		for _, m := range methods {
+			routes++
+			if _, ok := spec.Paths[path][strings.ToLower(m)]; !ok {
+				t.Errorf("no operation for %s %s in openapi.json", m, path)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if routes == 0 {
+		t.Fatal("no routes registered")
+	}
+}
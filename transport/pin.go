@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PinController lets admins pin announcements ahead of the timeline and users
+// pin messages to their profile.
+type PinController struct {
+	s  *service.PinService
+	a  *service.AuthService
+	rc *ResponseCache
+}
+
+type pinBody struct {
+	Expires *int64 `json:"expires"`
+}
+
+type pinOrderBody struct {
+	Messages []string `json:"messages"`
+}
+
+func NewPinController(s *service.PinService, a *service.AuthService, rc *ResponseCache) *PinController {
+	return &PinController{s, a, rc}
+}
+
+func (c *PinController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/pins", c.rc.Middleware("message", "public, max-age=5", c.a.OptionalMiddleware(c.getGlobalPins))).Methods("GET")
+	router.HandleFunc("/user/{id}/pins", c.rc.Middleware("message", "public, max-age=5", c.a.OptionalMiddleware(c.getProfilePins))).Methods("GET")
+
+	// Announcements are pinned by admins
+	router.HandleFunc("/pins", c.a.AdminMiddleware(c.reorder(true))).Methods("PUT")
+	router.HandleFunc("/pins/{id}", c.a.AdminMiddleware(c.pin(true))).Methods("PUT")
+	router.HandleFunc("/pins/{id}", c.a.AdminMiddleware(c.unpin(true))).Methods("DELETE")
+
+	router.HandleFunc("/user/me/pins", c.a.Middleware(c.reorder(false))).Methods("PUT")
+	router.HandleFunc("/user/me/pins/{id}", c.a.Middleware(c.pin(false))).Methods("PUT")
+	router.HandleFunc("/user/me/pins/{id}", c.a.Middleware(c.unpin(false))).Methods("DELETE")
+
+	fmt.Println("Pin routes registered")
+}
+
+func (c *PinController) getGlobalPins(w http.ResponseWriter, req *http.Request) {
+	messages, err := c.s.GetGlobalPins(req.Context())
+	writePinJSON(w, messages, err)
+}
+
+// getProfilePins returns the messages pinned to a profile, "me" for the signed in user
+func (c *PinController) getProfilePins(w http.ResponseWriter, req *http.Request) {
+	messages, err := c.s.GetProfilePins(req.Context(), mux.Vars(req)["id"])
+	writePinJSON(w, messages, err)
+}
+
+// pin returns a handler, which pins a message globally or to the profile
+func (c *PinController) pin(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body pinBody
+		err := json.NewDecoder(req.Body).Decode(&body)
+
+		// the body is optional
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pin, err := c.s.Pin(req.Context(), global, mux.Vars(req)["id"], body.Expires)
+
+		if err == nil {
+			c.rc.Invalidate("message")
+		}
+
+		writePinJSON(w, pin, err)
+	}
+}
+
+func (c *PinController) unpin(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		err := c.s.Unpin(req.Context(), global, mux.Vars(req)["id"])
+
+		if err != nil {
+			writePinJSON(w, nil, err)
+			return
+		}
+
+		c.rc.Invalidate("message")
+	}
+}
+
+// reorder returns a handler, which changes the order of the pinned messages
+func (c *PinController) reorder(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body pinOrderBody
+		err := json.NewDecoder(req.Body).Decode(&body)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		messages, err := c.s.Reorder(req.Context(), global, body.Messages)
+
+		if err == nil {
+			c.rc.Invalidate("message")
+		}
+
+		writePinJSON(w, messages, err)
+	}
+}
+
+func writePinJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments, err == persistence.ErrNothingDeleted:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrNotAuthenticated:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == service.ErrPinForeign:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrPinUnpublished, err == service.ErrPinExpired, err == service.ErrInvalidPinOrder:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == service.ErrTooManyGlobalPins, err == service.ErrTooManyProfilePins:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PollController lets users vote in the polls of messages and pushes the
+// tallies to clients watching a poll (Server-Sent Events).
+type PollController struct {
+	ms *service.MessageService
+	a  *service.AuthService
+
+	mu       sync.Mutex
+	watchers map[primitive.ObjectID]map[chan *persistence.Message]bool
+}
+
+type voteBody struct {
+	Choices []int `json:"choices"`
+}
+
+// pollHeartbeat is the interval of the comments keeping event streams open.
+// Closed connections are noticed, when a heartbeat can't be written.
+const pollHeartbeat = 30 * time.Second
+
+func NewPollController(ms *service.MessageService, a *service.AuthService) *PollController {
+	return &PollController{ms: ms, a: a, watchers: map[primitive.ObjectID]map[chan *persistence.Message]bool{}}
+}
+
+func (c *PollController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/message/{id}/vote", c.a.Middleware(c.vote)).Methods("POST")
+	router.HandleFunc("/message/{id}/poll/events", c.events).Methods("GET")
+
+	fmt.Println("Poll routes registered")
+}
+
+// OnMessageEvent passes new tallies to the watchers of a poll.
+// It's meant to be registered with MessageService.Subscribe.
+func (c *PollController) OnMessageEvent(e service.MessageEvent) {
+	if e.Type != service.EventPollVoted && e.Type != service.EventMessageDeleted {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ch := range c.watchers[e.Message.MessageID] {
+		if e.Type == service.EventMessageDeleted {
+			// ends the stream
+			close(ch)
+			delete(c.watchers[e.Message.MessageID], ch)
+			continue
+		}
+
+		select {
+		case ch <- e.Message:
+		default:
+			// the watcher gets the newer tallies with the next vote
+		}
+	}
+}
+
+func (c *PollController) vote(w http.ResponseWriter, req *http.Request) {
+	var body voteBody
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message, err := c.ms.Vote(req.Context(), mux.Vars(req)["id"], body.Choices)
+
+	if err == nil {
+		w.Header().Set("ETag", messageETag(message))
+	}
+
+	writePollJSON(w, message, err)
+}
+
+// events streams the poll of a message: the current state on connect, the new
+// tallies after every vote and the results once the poll closes. EventSource
+// can't send headers, so the token may be passed as access_token parameter.
+func (c *PollController) events(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	header := req.Header.Get("Authorization")
+
+	if token := req.URL.Query().Get("access_token"); header == "" && token != "" {
+		header = "bearer " + token
+	}
+
+	if header != "" {
+		user, err := c.a.Authenticate(header)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		ctx = c.a.WithUser(ctx, user)
+	}
+
+	message, err := c.ms.GetMessageById(ctx, mux.Vars(req)["id"])
+
+	if err == nil && message.Poll == nil {
+		err = service.ErrNoPoll
+	}
+
+	if err != nil {
+		writePollJSON(w, nil, err)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := c.watch(message.MessageID)
+	defer c.unwatch(message.MessageID, ch)
+
+	// the stream outlives the write timeout of the server, so the connection
+	// is taken over and the response written by hand
+	conn, buf, err := hijacker.Hijack()
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "close")
+
+	buf.WriteString("HTTP/1.1 200 OK\r\n")
+	w.Header().Write(buf)
+	buf.WriteString("\r\n")
+
+	if writePollEvent(buf, message.Poll) != nil || message.Poll.Closed {
+		return
+	}
+
+	closes := time.NewTimer(time.Until(time.Unix(0, message.Poll.Closes*int64(time.Millisecond))))
+	defer closes.Stop()
+
+	heartbeat := time.NewTicker(pollHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case updated, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			err = writePollEvent(buf, service.PresentPoll(ctx, updated.Poll))
+		case <-closes.C:
+			// the results of the closed poll are visible to everybody
+			message, err = c.ms.GetMessageById(ctx, message.MessageID.Hex())
+
+			if err == nil {
+				writePollEvent(buf, service.PresentPoll(ctx, message.Poll))
+			}
+
+			return
+		case <-heartbeat.C:
+			buf.WriteString(": heartbeat\n\n")
+			err = buf.Flush()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *PollController) watch(id primitive.ObjectID) chan *persistence.Message {
+	ch := make(chan *persistence.Message, watchBuffer)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watchers[id] == nil {
+		c.watchers[id] = map[chan *persistence.Message]bool{}
+	}
+
+	c.watchers[id][ch] = true
+	return ch
+}
+
+func (c *PollController) unwatch(id primitive.ObjectID, ch chan *persistence.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the channel has already been closed, if the message has been deleted
+	if c.watchers[id][ch] {
+		delete(c.watchers[id], ch)
+		close(ch)
+	}
+
+	if len(c.watchers[id]) == 0 {
+		delete(c.watchers, id)
+	}
+}
+
+// writePollEvent writes a "poll" event and flushes it to the client
+func writePollEvent(buf *bufio.ReadWriter, poll *persistence.Poll) error {
+	data, err := json.Marshal(poll)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(buf, "event: poll\ndata: %s\n\n", data)
+	return buf.Flush()
+}
+
+func writePollJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrNotAuthenticated:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == service.ErrPollBlocked:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err == service.ErrInvalidObjectID, err == persistence.ErrInvalidObjectID, err == service.ErrNoPoll, err == service.ErrInvalidChoice:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == service.ErrPollClosed, err == service.ErrAlreadyVoted:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
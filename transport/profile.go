@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ProfileController serves the public profiles and lets users edit their own.
+type ProfileController struct {
+	s  *service.ProfileService
+	a  *service.AuthService
+	rc *ResponseCache
+
+	// maxBannerSize is the size in bytes profile banners may have
+	maxBannerSize int64
+}
+
+func NewProfileController(s *service.ProfileService, a *service.AuthService, rc *ResponseCache, maxBannerSize int64) *ProfileController {
+	return &ProfileController{s, a, rc, maxBannerSize}
+}
+
+func (c *ProfileController) RegisterRoutes(router *mux.Router) {
+	// the own profile includes the settings, it must not be cached
+	router.HandleFunc("/user/me", c.a.Middleware(c.getProfile)).Methods("GET")
+	router.HandleFunc("/user/me", c.a.Middleware(c.patchProfile)).Methods("PATCH")
+	router.HandleFunc("/user/{id}", c.rc.Middleware("user", "public, max-age=300", c.getProfile)).Methods("GET")
+
+	router.HandleFunc("/user/me/banner", c.a.Middleware(c.patchBanner)).Methods("PATCH")
+	router.HandleFunc("/user/me/banner", c.a.Middleware(c.deleteBanner)).Methods("DELETE")
+
+	fmt.Println("Profile routes registered")
+}
+
+func (c *ProfileController) getProfile(w http.ResponseWriter, req *http.Request) {
+	id, ok := mux.Vars(req)["id"]
+
+	if !ok {
+		id = "me"
+	}
+
+	// no Last-Modified, the counts change without changing the profile
+	profile, err := c.s.GetProfile(req.Context(), id)
+	writeProfileJSON(w, profile, err)
+}
+
+func (c *ProfileController) patchProfile(w http.ResponseWriter, req *http.Request) {
+	var update service.ProfileUpdate
+	err := json.NewDecoder(req.Body).Decode(&update)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile, err := c.s.UpdateProfile(req.Context(), update)
+	writeProfileJSON(w, profile, err)
+}
+
+// patchBanner replaces the banner of the user by the image sent as
+// multipart/form-data field "file"
+func (c *ProfileController) patchBanner(w http.ResponseWriter, req *http.Request) {
+	file, _, ok := formFile(w, req, c.maxBannerSize)
+
+	if !ok {
+		return
+	}
+
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile, err := c.s.SetBanner(req.Context(), data)
+	writeProfileJSON(w, profile, err)
+}
+
+func (c *ProfileController) deleteBanner(w http.ResponseWriter, req *http.Request) {
+	profile, err := c.s.RemoveBanner(req.Context())
+	writeProfileJSON(w, profile, err)
+}
+
+func writeProfileJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrNotAuthenticated:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == persistence.ErrInvalidObjectID, err == service.ErrInvalidName, err == service.ErrInvalidBio, err == service.ErrInvalidWebsite, err == service.ErrInvalidLocation:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == service.ErrInvalidImage:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err == service.ErrImageTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
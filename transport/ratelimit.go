@@ -0,0 +1,246 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gofeed-go/service"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimiter limits the requests per route and principal. Principals are
+// users (identified by their JWT) or, for anonymous requests, client IPs.
+// Admins aren't limited.
+type RateLimiter struct {
+	store  service.RateLimitStore
+	a      *service.AuthService
+	def    service.RateLimit
+	routes map[string]service.RateLimit
+
+	// trustedProxies is the number of reverse proxies in front of the app,
+	// each of them appends an address to X-Forwarded-For
+	trustedProxies int
+}
+
+// ErrRateLimited is returned by Limit, once the limit of a route is exceeded
+var ErrRateLimited = errors.New("Too many requests")
+
+type clientIPKey struct{}
+
+// versionPrefix is stripped from route templates, so the versions and the
+// unversioned aliases of a route share their limit
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+/`)
+
+// NewRateLimiter creates a limiter, which applies the limits of routes (keyed
+// by "METHOD /path/{template}") and def to every other route. Behind
+// trustedProxies reverse proxies, the client IP is taken from X-Forwarded-For.
+func NewRateLimiter(store service.RateLimitStore, a *service.AuthService, def service.RateLimit, routes map[string]service.RateLimit, trustedProxies int) *RateLimiter {
+	return &RateLimiter{store, a, def, routes, trustedProxies}
+}
+
+// ParseRouteLimits parses per route limits like
+// "POST /message=10/1m, PATCH /message/{id}=30/1m".
+func ParseRouteLimits(s string) (map[string]service.RateLimit, error) {
+	routes := map[string]service.RateLimit{}
+
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", service.ErrInvalidRateLimit, entry)
+		}
+
+		limit, err := service.ParseRateLimit(entry[i+1:])
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, entry)
+		}
+
+		routes[strings.Join(strings.Fields(entry[:i]), " ")] = limit
+	}
+
+	return routes, nil
+}
+
+// Middleware limits the requests of every route of the router. It sets the
+// RateLimit-* headers and answers with 429 Too Many Requests once the limit
+// is exceeded.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		principal, admin := rl.principal(req)
+
+		if admin {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// Limit needs the address for anonymous requests to other APIs
+		req = req.WithContext(context.WithValue(req.Context(), clientIPKey{}, rl.clientIP(req)))
+
+		limit, status, ok := rl.take(req.Context(), rl.route(req), principal)
+
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Capacity))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(status.Reset))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Capacity, int(limit.Period.Seconds())))
+
+		if !status.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(status.RetryAfter))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Limit counts a request to route (e.g. "POST /message") made through another
+// API than REST, like GraphQL or gRPC, so it shares the bucket of the REST
+// route. The principal is the user in ctx or the client IP, see Middleware
+// and UnaryInterceptor.
+func (rl *RateLimiter) Limit(ctx context.Context, route string) error {
+	principal := ""
+
+	if user, err := rl.a.UserFromContext(ctx); err == nil {
+		if user.Group == service.GroupAdmin {
+			return nil
+		}
+
+		principal = "user:" + user.UserID.Hex()
+	} else {
+		ip, _ := ctx.Value(clientIPKey{}).(string)
+		principal = "ip:" + ip
+	}
+
+	_, status, ok := rl.take(ctx, route, principal)
+
+	if ok && !status.Allowed {
+		return fmt.Errorf("%w, retry after %ss", ErrRateLimited, ceilSeconds(status.RetryAfter))
+	}
+
+	return nil
+}
+
+// UnaryInterceptor applies the limits of the REST routes to the gRPC methods
+// mapped to them in routes. It has to run after the authentication.
+func (rl *RateLimiter) UnaryInterceptor(routes map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		route, ok := routes[info.FullMethod]
+
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		// gRPC isn't served behind the HTTP proxies
+		if p, ok := peer.FromContext(ctx); ok {
+			host, _, err := net.SplitHostPort(p.Addr.String())
+
+			if err != nil {
+				host = p.Addr.String()
+			}
+
+			ctx = context.WithValue(ctx, clientIPKey{}, host)
+		}
+
+		if err := rl.Limit(ctx, route); err != nil {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// take removes a token from the bucket of route and principal. ok is false,
+// if the store isn't available, the request is allowed then.
+func (rl *RateLimiter) take(ctx context.Context, route string, principal string) (service.RateLimit, service.RateLimitStatus, bool) {
+	limit, ok := rl.routes[route]
+
+	if !ok {
+		limit = rl.def
+	}
+
+	status, err := rl.store.Take(ctx, route+"|"+principal, limit)
+
+	if err != nil {
+		// don't lock out everybody, if the store isn't available
+		log.Println("rate limit:", err)
+		return limit, status, false
+	}
+
+	return limit, status, true
+}
+
+// principal returns the user id of authenticated requests and the client IP
+// of all others. Invalid tokens are treated like anonymous requests, they are
+// rejected by the routes requiring authentication anyway.
+func (rl *RateLimiter) principal(req *http.Request) (string, bool) {
+	if header := req.Header.Get("Authorization"); header != "" {
+		user, err := rl.a.Authenticate(header)
+
+		if err == nil {
+			return "user:" + user.UserID.Hex(), user.Group == service.GroupAdmin
+		}
+	}
+
+	return "ip:" + rl.clientIP(req), false
+}
+
+func (rl *RateLimiter) clientIP(req *http.Request) string {
+	// the client can send any X-Forwarded-For, only the addresses appended
+	// by our proxies (the rightmost ones) can be trusted
+	if rl.trustedProxies > 0 {
+		forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+
+		if len(forwarded) >= rl.trustedProxies {
+			if ip := strings.TrimSpace(forwarded[len(forwarded)-rl.trustedProxies]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// route returns the key of the matched route, e.g. "POST /message"
+func (rl *RateLimiter) route(req *http.Request) string {
+	tpl := req.URL.Path
+
+	if route := mux.CurrentRoute(req); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			tpl = t
+		}
+	}
+
+	return req.Method + " " + versionPrefix.ReplaceAllString(tpl, "/")
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
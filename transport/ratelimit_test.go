@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"gofeed-go/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		forwarded      []string
+		want           string
+	}{
+		{"no proxy", 0, nil, "198.51.100.7"},
+		{"no proxy ignores the header", 0, []string{"203.0.113.1"}, "198.51.100.7"},
+		{"one proxy", 1, []string{"203.0.113.1"}, "203.0.113.1"},
+		{"one proxy ignores spoofed entries", 1, []string{"10.0.0.1, 203.0.113.1"}, "203.0.113.1"},
+		{"one proxy, several headers", 1, []string{"10.0.0.1", "203.0.113.1"}, "203.0.113.1"},
+		{"two proxies", 2, []string{"10.0.0.1, 203.0.113.1, 192.0.2.9"}, "203.0.113.1"},
+		{"two proxies, spaces", 2, []string{" 203.0.113.1 ,192.0.2.9"}, "203.0.113.1"},
+		{"fewer entries than proxies", 2, []string{"203.0.113.1"}, "198.51.100.7"},
+		{"missing header", 1, nil, "198.51.100.7"},
+		{"empty entry", 1, []string{"203.0.113.1, "}, "198.51.100.7"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rl := NewRateLimiter(nil, nil, service.RateLimit{}, nil, test.trustedProxies)
+
+			req := httptest.NewRequest(http.MethodGet, "/message", nil)
+			req.RemoteAddr = "198.51.100.7:51234"
+
+			for _, f := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+
+			if got := rl.clientIP(req); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limits := map[string]service.RateLimit{"POST /message": {Capacity: 2, Period: time.Hour}}
+	rl := NewRateLimiter(service.NewMemoryRateLimitStore(), nil, service.RateLimit{Capacity: 100, Period: time.Hour}, limits, 1)
+
+	router := mux.NewRouter()
+	router.Use(rl.Middleware)
+	router.HandleFunc("/message", func(w http.ResponseWriter, req *http.Request) {}).Methods("POST")
+	router.HandleFunc("/v1/message", func(w http.ResponseWriter, req *http.Request) {}).Methods("POST")
+
+	send := func(path string, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = "192.0.2.9:443"
+		req.Header.Set("X-Forwarded-For", client)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		path      string
+		client    string
+		status    int
+		remaining string
+	}{
+		{"/message", "203.0.113.1", http.StatusOK, "1"},
+		// the versions share the limit of the unversioned route
+		{"/v1/message", "203.0.113.1", http.StatusOK, "0"},
+		{"/message", "203.0.113.1", http.StatusTooManyRequests, "0"},
+		// other clients have buckets of their own, spoofed entries don't matter
+		{"/message", "203.0.113.1, 203.0.113.2", http.StatusOK, "1"},
+		{"/message", "10.0.0.1, 203.0.113.1", http.StatusTooManyRequests, "0"},
+	}
+
+	for i, test := range tests {
+		rec := send(test.path, test.client)
+
+		if rec.Code != test.status || rec.Header().Get("RateLimit-Remaining") != test.remaining {
+			t.Fatalf("request %d: got %d with %s remaining, want %d with %s", i, rec.Code, rec.Header().Get("RateLimit-Remaining"), test.status, test.remaining)
+		}
+
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: Retry-After is missing", i)
+		}
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	a := &service.AuthService{}
+	limits := map[string]service.RateLimit{"POST /message": {Capacity: 1, Period: time.Hour}}
+	rl := NewRateLimiter(service.NewMemoryRateLimitStore(), a, service.RateLimit{Capacity: 100, Period: time.Hour}, limits, 0)
+
+	user := a.WithUser(context.Background(), &service.User{UserID: primitive.NewObjectID()})
+	other := a.WithUser(context.Background(), &service.User{UserID: primitive.NewObjectID()})
+	admin := a.WithUser(context.Background(), &service.User{UserID: primitive.NewObjectID(), Group: service.GroupAdmin})
+	anonymous := context.WithValue(context.Background(), clientIPKey{}, "203.0.113.1")
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		route string
+		want  error
+	}{
+		{"user", user, "POST /message", nil},
+		{"user again", user, "POST /message", ErrRateLimited},
+		{"user, other route", user, "PATCH /message/{id}", nil},
+		{"other user", other, "POST /message", nil},
+		{"anonymous", anonymous, "POST /message", nil},
+		{"anonymous again", anonymous, "POST /message", ErrRateLimited},
+		{"admin", admin, "POST /message", nil},
+		{"admin again", admin, "POST /message", nil},
+	}
+
+	for _, test := range tests {
+		err := rl.Limit(test.ctx, test.route)
+
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
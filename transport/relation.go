@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RelationController lets users manage the users they have blocked or muted.
+type RelationController struct {
+	s *service.RelationService
+	a *service.AuthService
+}
+
+func NewRelationController(s *service.RelationService, a *service.AuthService) *RelationController {
+	return &RelationController{s, a}
+}
+
+func (c *RelationController) RegisterRoutes(router *mux.Router) {
+	for path, relationType := range map[string]string{"blocks": persistence.RelationBlock, "mutes": persistence.RelationMute} {
+		router.HandleFunc("/user/me/"+path, c.a.Middleware(c.getRelations(relationType))).Methods("GET")
+		router.HandleFunc("/user/me/"+path+"/{id}", c.a.Middleware(c.putRelation(relationType))).Methods("PUT")
+		router.HandleFunc("/user/me/"+path+"/{id}", c.a.Middleware(c.deleteRelation(relationType))).Methods("DELETE")
+	}
+
+	fmt.Println("Relation routes registered")
+}
+
+func (c *RelationController) getRelations(relationType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		users, err := c.s.GetRelations(req.Context(), relationType)
+		writeRelationJSON(w, users, err)
+	}
+}
+
+func (c *RelationController) putRelation(relationType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		user, err := c.s.AddRelation(req.Context(), relationType, mux.Vars(req)["id"])
+		writeRelationJSON(w, user, err)
+	}
+}
+
+func (c *RelationController) deleteRelation(relationType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		err := c.s.RemoveRelation(req.Context(), relationType, mux.Vars(req)["id"])
+
+		if err != nil {
+			writeRelationJSON(w, nil, err)
+		}
+	}
+}
+
+func writeRelationJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments, err == persistence.ErrNothingDeleted:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrSelfRelation:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
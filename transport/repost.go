@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RepostController lets users share messages with their followers. Quotes
+// are created like other messages, see MessageController.
+type RepostController struct {
+	s *service.MessageService
+	a *service.AuthService
+}
+
+func NewRepostController(s *service.MessageService, a *service.AuthService) *RepostController {
+	return &RepostController{s, a}
+}
+
+func (c *RepostController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/message/{id}/repost", c.a.Middleware(c.putRepost)).Methods("PUT")
+	router.HandleFunc("/message/{id}/repost", c.a.Middleware(c.deleteRepost)).Methods("DELETE")
+
+	fmt.Println("Repost routes registered")
+}
+
+func (c *RepostController) putRepost(w http.ResponseWriter, req *http.Request) {
+	repost, err := c.s.Repost(req.Context(), mux.Vars(req)["id"])
+
+	if err == nil {
+		w.Header().Set("ETag", messageETag(repost))
+	}
+
+	writeRepostJSON(w, repost, err)
+}
+
+func (c *RepostController) deleteRepost(w http.ResponseWriter, req *http.Request) {
+	err := c.s.Unrepost(req.Context(), mux.Vars(req)["id"])
+
+	if err != nil {
+		writeRepostJSON(w, nil, err)
+	}
+}
+
+func writeRepostJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments, err == persistence.ErrNothingDeleted:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == service.ErrNotAuthenticated:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == service.ErrInvalidObjectID, err == service.ErrRepostUnpublished:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case isPolicyViolation(err):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"gofeed-go/service"
 	"html/template"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"time"
@@ -12,25 +13,32 @@ import (
 	"github.com/brianvoe/sjwt"
 	"github.com/gorilla/mux"
 	"github.com/markbates/goth/gothic"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type UserController struct {
 	s *service.UserService
 	a *service.AuthService
+
+	// maxAvatarSize is the size in bytes custom avatars may have
+	maxAvatarSize int64
 }
 
 type JwtToken struct {
 	Token string `json:"token"`
 }
 
-func NewUserController(s *service.UserService, a *service.AuthService) *UserController {
-	return &UserController{s, a}
+func NewUserController(s *service.UserService, a *service.AuthService, maxAvatarSize int64) *UserController {
+	return &UserController{s, a, maxAvatarSize}
 }
 
 func (c *UserController) RegisterRoutes(router *mux.Router) {
 
-	// Special Route for UserInformation
-	router.HandleFunc("/user/{id}", c.getUserInfo).Methods("GET")
+	// Profiles are served by the ProfileController
+
+	// Custom avatars
+	router.HandleFunc("/user/me/avatar", c.a.Middleware(c.patchAvatar)).Methods("PATCH")
+	router.HandleFunc("/user/me/avatar", c.a.Middleware(c.deleteAvatar)).Methods("DELETE")
 
 	// Use middleware to authenticate user
 	router.HandleFunc("/auth/valid", c.a.Middleware(nil)).Methods("POST")
@@ -41,17 +49,45 @@ func (c *UserController) RegisterRoutes(router *mux.Router) {
 	fmt.Println("User routes registered")
 }
 
-func (c *UserController) getUserInfo(w http.ResponseWriter, req *http.Request) {
-	id, ok := mux.Vars(req)["id"]
+// patchAvatar replaces the avatar of the user by the image sent as
+// multipart/form-data field "file"
+func (c *UserController) patchAvatar(w http.ResponseWriter, req *http.Request) {
+	file, _, ok := formFile(w, req, c.maxAvatarSize)
 
 	if !ok {
-		http.Error(w, "Missing param: id", http.StatusBadRequest)
 		return
 	}
 
-	userInfo, err := c.s.GetUserInfo(req.Context(), id)
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
 
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userInfo, err := c.s.SetAvatar(req.Context(), data)
+	writeUserInfo(w, userInfo, err)
+}
+
+func (c *UserController) deleteAvatar(w http.ResponseWriter, req *http.Request) {
+	userInfo, err := c.s.RemoveAvatar(req.Context())
+	writeUserInfo(w, userInfo, err)
+}
+
+func writeUserInfo(w http.ResponseWriter, userInfo *service.UserInfo, err error) {
+	switch {
+	case err == service.ErrInvalidImage:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err == service.ErrImageTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -74,6 +110,11 @@ func (c *UserController) handleOAuthCallback(w http.ResponseWriter, req *http.Re
 	// register or update existing user in db
 	user, err := c.s.UserSignedIn(req.Context(), gothUser)
 
+	if err == service.ErrSuspended {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Versioning policy
+//
+// The REST API is served under /v1 and /v2. The unversioned paths (/message,
+// /user/{id}, ...) are aliases for v1, so existing clients keep working.
+//
+//   - Changes to a response shape, which may break clients (removing or
+//     renaming fields, changing types or status codes), are only made in the
+//     newest version. Adding fields or endpoints is allowed in every version.
+//   - Once a newer version is available, the older one is deprecated: its
+//     responses carry a Deprecation header and a Link to the successor.
+//   - A deprecated version is removed at its sunset date, announced with the
+//     Sunset header. Afterwards it answers with 410 Gone. The unversioned
+//     aliases aren't removed, they serve the successor from then on.
+//
+// Handlers can branch on the version with APIVersionFromContext.
+
+// RouteRegistrar is implemented by the controllers.
+type RouteRegistrar interface {
+	RegisterRoutes(router *mux.Router)
+}
+
+// APIVersion describes a version of the REST API.
+type APIVersion struct {
+	Name string
+
+	// Successor is the version replacing this one, e.g. "v2"
+	Successor string
+
+	// Deprecation and Sunset are left zero, as long as the version isn't deprecated
+	Deprecation time.Time
+	Sunset      time.Time
+}
+
+type versionKey struct{}
+
+// Mount registers the routes of the controllers on a subrouter under prefix.
+// An empty prefix registers them at the root as aliases, see the versioning
+// policy.
+func (v APIVersion) Mount(router *mux.Router, prefix string, controllers ...RouteRegistrar) *mux.Router {
+	var sub *mux.Router
+
+	if prefix == "" {
+		sub = router.NewRoute().Subrouter()
+	} else {
+		sub = router.PathPrefix(prefix).Subrouter()
+	}
+
+	sub.Use(v.middleware(prefix))
+
+	for _, c := range controllers {
+		c.RegisterRoutes(sub)
+	}
+
+	fmt.Printf("API %s mounted at %s/\n", v.Name, prefix)
+
+	return sub
+}
+
+// middleware sets the version headers described in the versioning policy
+func (v APIVersion) middleware(prefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			v := v
+
+			if prefix == "" && v.Successor != "" && v.removed() {
+				v = APIVersion{Name: v.Successor}
+			}
+
+			w.Header().Set("API-Version", v.Name)
+
+			if !v.Deprecation.IsZero() && time.Now().After(v.Deprecation) {
+				// RFC 9745
+				w.Header().Set("Deprecation", fmt.Sprintf("@%d", v.Deprecation.Unix()))
+				w.Header().Add("Link", `</docs>; rel="deprecation"; type="text/html"`)
+
+				if v.Successor != "" {
+					path := "/" + v.Successor + strings.TrimPrefix(req.URL.Path, prefix)
+					w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, path))
+				}
+			}
+
+			if !v.Sunset.IsZero() {
+				// RFC 8594
+				w.Header().Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+
+				if v.removed() {
+					http.Error(w, fmt.Sprintf("API %s has been removed, please use %s", v.Name, v.Successor), http.StatusGone)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), versionKey{}, v.Name)))
+		})
+	}
+}
+
+// removed reports whether the sunset of the version has passed
+func (v APIVersion) removed() bool {
+	return !v.Sunset.IsZero() && time.Now().After(v.Sunset)
+}
+
+// APIVersionFromContext returns the version of the API the request has been
+// made to, e.g. "v1". It's empty for routes outside of the versioned API.
+func APIVersionFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(versionKey{}).(string)
+	return name
+}
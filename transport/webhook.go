@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gofeed-go/persistence"
+	"gofeed-go/service"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type WebhookController struct {
+	s *service.WebhookService
+	a *service.AuthService
+}
+
+func NewWebhookController(s *service.WebhookService, a *service.AuthService) *WebhookController {
+	return &WebhookController{s, a}
+}
+
+func (c *WebhookController) RegisterRoutes(router *mux.Router) {
+
+	// Webhooks can only be managed by admins
+	router.HandleFunc("/webhook", c.a.AdminMiddleware(c.getWebhooks)).Methods("GET")
+	router.HandleFunc("/webhook", c.a.AdminMiddleware(c.postWebhook)).Methods("POST")
+	router.HandleFunc("/webhook/{id}", c.a.AdminMiddleware(c.getWebhook)).Methods("GET")
+	router.HandleFunc("/webhook/{id}", c.a.AdminMiddleware(c.deleteWebhook)).Methods("DELETE")
+	router.HandleFunc("/webhook/{id}/deliveries", c.a.AdminMiddleware(c.getDeliveries)).Methods("GET")
+	router.HandleFunc("/webhook/{id}/deliveries/{delivery}/redeliver", c.a.AdminMiddleware(c.postRedeliver)).Methods("POST")
+
+	fmt.Println("Webhook routes registered")
+}
+
+func (c *WebhookController) getWebhooks(w http.ResponseWriter, req *http.Request) {
+	webhooks, err := c.s.GetWebhooks(req.Context())
+	writeWebhookJSON(w, webhooks, err)
+}
+
+func (c *WebhookController) postWebhook(w http.ResponseWriter, req *http.Request) {
+	var body persistence.Webhook
+	err := json.NewDecoder(req.Body).Decode(&body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := c.a.ExtractUser(req)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	webhook, err := c.s.CreateWebhook(req.Context(), user.UserID, body)
+	writeWebhookJSON(w, webhook, err)
+}
+
+func (c *WebhookController) getWebhook(w http.ResponseWriter, req *http.Request) {
+	webhook, err := c.s.GetWebhook(req.Context(), mux.Vars(req)["id"])
+	writeWebhookJSON(w, webhook, err)
+}
+
+func (c *WebhookController) deleteWebhook(w http.ResponseWriter, req *http.Request) {
+	err := c.s.DeleteWebhook(req.Context(), mux.Vars(req)["id"])
+
+	if err != nil {
+		writeWebhookJSON(w, nil, err)
+	}
+}
+
+func (c *WebhookController) getDeliveries(w http.ResponseWriter, req *http.Request) {
+	deliveries, err := c.s.GetDeliveries(req.Context(), mux.Vars(req)["id"])
+	writeWebhookJSON(w, deliveries, err)
+}
+
+func (c *WebhookController) postRedeliver(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	delivery, err := c.s.Redeliver(req.Context(), vars["id"], vars["delivery"])
+	writeWebhookJSON(w, delivery, err)
+}
+
+func writeWebhookJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err == nil:
+	case err == mongo.ErrNoDocuments, err == persistence.ErrNothingDeleted:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == persistence.ErrInvalidObjectID, err == persistence.ErrInvalidWebhook, errors.Is(err, service.ErrUnknownEvent):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}